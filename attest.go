@@ -7,12 +7,15 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/korylprince/macos-device-attestation/authorizer"
 	"github.com/korylprince/macos-device-attestation/filestore"
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/ratelimit"
 	"github.com/korylprince/macos-device-attestation/tokenstore"
 	"github.com/korylprince/macos-device-attestation/transport"
 )
@@ -21,8 +24,16 @@ const pathSize = 16
 
 type ContextKey int
 
-// ContextKeyIdentifier is used to retrieve the identifier from an http.Request's context
-const ContextKeyIdentifier ContextKey = iota
+const (
+	// ContextKeyIdentifier is used to retrieve the identifier from an http.Request's context
+	ContextKeyIdentifier ContextKey = iota
+	// ContextKeyScopes is used to retrieve the scopes ([]string) granted to the token from an http.Request's context
+	ContextKeyScopes
+	// ContextKeyDevice is used to retrieve the *Device from an http.Request's context. Use FromContext instead
+	ContextKeyDevice
+	// ContextKeyIdentifierType is used to retrieve the type of the client-given identifier from PlaceHandler's context. Use IdentifierType instead
+	ContextKeyIdentifierType
+)
 
 // StatusCodeSkip is returned by a ReturnHandlerFunc to indicate the ResponseWriter should not be written to
 const StatusCodeSkip int = -1
@@ -36,32 +47,164 @@ type Transformer interface {
 	Transform(identifier string) (string, error)
 }
 
-// AttestationService is an HTTP service to allow a macOS client to attest that it has root access on a device with a particular identifier
+// ContextTransformer is an optional interface that a Transport can implement to transform identifiers with a context.Context. It takes precedence over Transformer
+type ContextTransformer interface {
+	// TransformContext transforms identifier into another one. If the identifier is invalid, ErrInvalidIdentifier is returned
+	TransformContext(ctx context.Context, identifier string) (string, error)
+}
+
+type contextTransformer struct {
+	Transformer
+}
+
+func (t contextTransformer) TransformContext(ctx context.Context, identifier string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return t.Transform(identifier)
+}
+
+// transformer returns t as a ContextTransformer if it implements ContextTransformer or Transformer
+func transformer(t transport.Transport) (ContextTransformer, bool) {
+	if ct, ok := t.(ContextTransformer); ok {
+		return ct, true
+	}
+	if tr, ok := t.(Transformer); ok {
+		return contextTransformer{tr}, true
+	}
+	return nil, false
+}
+
+// AttestationService is an HTTP service to allow a macOS client to attest that it has root access on a device with a particular identifier.
+// An AttestationService must be created with New
 type AttestationService struct {
 	tokenstore.TokenStore
 	transport.Transport
 	filestore.FileStore
-	*log.Logger
+	// Logger is an optional logging.Logger. *slog.Logger can be used directly, and a *log.Logger can be adapted with logging.NewStdLogger
+	Logger logging.Logger
+
+	// CoalesceWindow is how long after a placement is started that PlaceHandler requests for the same (transformed) identifier are coalesced into it.
+	// While the placement is outstanding (not downloaded, expired, or failed), they get its ID and path back instead of starting another placement. If zero, placements aren't coalesced.
+	// The client deletes the token file once it's read, so only one of the coalesced requesters gets the token. This is meant for retries from a single client, not several clients on one device
+	CoalesceWindow time.Duration
+
+	// PlaceTimeout is the maximum time a placement started by PlaceHandler is allowed to run. If zero, DefaultPlaceTimeout is used
+	PlaceTimeout time.Duration
+
+	// RefreshMaxLifetime is the maximum time since the original placement that RefreshHandler will refresh tokens. If zero, tokens can be refreshed indefinitely
+	RefreshMaxLifetime time.Duration
+
+	// PathStrategy chooses where tokens are placed on devices. If nil, DefaultPathStrategy is used
+	PathStrategy PathStrategy
+
+	// Authorizer is an optional authorizer.Authorizer that's consulted after an identifier is transformed and before a token is created
+	Authorizer authorizer.Authorizer
+
+	// ScopePolicy optionally decides the scopes granted to placed tokens. The TokenStore must implement tokenstore.ClaimsTokenStore to grant scopes
+	ScopePolicy ScopePolicy
+
+	// ErrorRenderer writes error responses. If nil, ProblemRenderer is used
+	ErrorRenderer ErrorRenderer
+
+	// Realm is the realm sent in WWW-Authenticate headers. If empty, no realm is sent
+	Realm string
+
+	// Limiter is an optional ratelimit.Limiter that's consulted before a placement is started. Its remote limits are checked before the identifier is transformed, so they also protect Transformers (e.g. MDM lookups).
+	// Its identifier limits are given the transformed identifier, so a device is limited the same whichever type of identifier it sends. Requests coalesced into an outstanding placement aren't charged against them
+	Limiter ratelimit.Limiter
+
+	// EventHook is an optional EventHook that receives Events as the AttestationService handles requests
+	EventHook EventHook
+
+	// Metrics is an optional Metrics that records the duration and outcome of attestation operations
+	Metrics Metrics
+
+	placements *placements
 }
 
 // New returns a new AttestationService
-func New(tokenStore tokenstore.TokenStore, transport transport.Transport, fileStore filestore.FileStore, logger *log.Logger) *AttestationService {
-	return &AttestationService{TokenStore: tokenStore, Transport: transport, FileStore: fileStore, Logger: logger}
+func New(tokenStore tokenstore.TokenStore, transport transport.Transport, fileStore filestore.FileStore, logger logging.Logger) *AttestationService {
+	return &AttestationService{
+		TokenStore:         tokenStore,
+		Transport:          transport,
+		FileStore:          fileStore,
+		Logger:             logger,
+		PlaceTimeout:       DefaultPlaceTimeout,
+		CoalesceWindow:     DefaultCoalesceWindow,
+		RefreshMaxLifetime: DefaultRefreshMaxLifetime,
+		placements:         newPlacements(),
+	}
+}
+
+// randomString returns a random, URL-safe string encoding size bytes
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// logger returns the AttestationService's Logger, or logging.Discard if it's nil
+func (s *AttestationService) logger() logging.Logger {
+	return logging.OrDiscard(s.Logger)
+}
+
+// remoteIP returns the IP address of the client that sent r. If the server is behind a proxy, r.RemoteAddr should be rewritten before the request reaches the AttestationService
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 // ReturnHandlerFunc returns an HTTP status code and body for the given request. If the returned code is StatusCodeSkip, the ResponseWriter should not be written to by the caller
 type ReturnHandlerFunc func(w http.ResponseWriter, r *http.Request) (int, interface{})
 
-func (s *AttestationService) placeReturnHandlerFunc(w http.ResponseWriter, r *http.Request) (int, interface{}) {
-	type request struct {
-		Identifier string `json:"identifier"`
+// placeRequest is the request body of PlaceHandler
+type placeRequest struct {
+	Identifier string `json:"identifier"`
+	// IdentifierType is the type of Identifier. If empty, IdentifierTypeSerial is assumed
+	IdentifierType string `json:"identifier_type,omitempty"`
+}
+
+// placeResponse is the response body of PlaceHandler
+type placeResponse struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// ExpiresAt is when the placed token expires, if known
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expiresAt returns a pointer to t, or nil if t is zero
+func expiresAt(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
+	return &t
+}
 
-	type response struct {
-		Path string `json:"path"`
+// limitResponse returns the response for err returned by a ratelimit.Limiter
+func limitResponse(err error) (int, error) {
+	e := fmt.Errorf("attest place: could not start placement: %w", err)
+	if errors.As(err, new(*ratelimit.LimitError)) {
+		return http.StatusTooManyRequests, e
 	}
+	return http.StatusInternalServerError, e
+}
+
+func (s *AttestationService) placeReturnHandlerFunc(w http.ResponseWriter, r *http.Request) (code int, body interface{}) {
+	ctx := r.Context()
+	ev := &Event{Type: EventPlaceRequested, RemoteAddr: r.RemoteAddr, Time: time.Now()}
+	defer func() {
+		ev.Err, _ = body.(error)
+		s.emit(ctx, ev)
+		s.observe(OpPlace, ev.Time, code, ev.Err)
+	}()
 
-	req := new(request)
+	req := new(placeRequest)
 	if err := parseJSON(r, req); err != nil {
 		return http.StatusBadRequest, fmt.Errorf("attest place: could not parse request: %w", err)
 	}
@@ -70,10 +213,33 @@ func (s *AttestationService) placeReturnHandlerFunc(w http.ResponseWriter, r *ht
 		return http.StatusBadRequest, errors.New("attest place: empty identifier")
 	}
 
+	if req.IdentifierType == "" {
+		req.IdentifierType = IdentifierTypeSerial
+	}
+	if err := validateIdentifierType(req.IdentifierType); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("attest place: %w", err)
+	}
+	ctx = WithIdentifierType(ctx, req.IdentifierType)
+
+	ev.Identifier, ev.ClientIdentifier = req.Identifier, req.Identifier
+
+	if s.Limiter != nil {
+		if err := s.Limiter.AllowRemote(ctx, remoteIP(r)); err != nil {
+			return limitResponse(err)
+		}
+	}
+
 	identifier := req.Identifier
 
-	if trans, ok := s.Transport.(Transformer); ok {
-		i, err := trans.Transform(identifier)
+	if trans, ok := transformer(s.Transport); ok {
+		tev := &Event{Type: EventIdentifierTransformed, Identifier: identifier, ClientIdentifier: req.Identifier, RemoteAddr: r.RemoteAddr, Time: time.Now()}
+		i, err := trans.TransformContext(ctx, identifier)
+		if err == nil {
+			tev.Identifier = i
+		}
+		tev.Err = err
+		s.emit(ctx, tev)
+		s.observe(OpTransform, tev.Time, 0, err)
 		if err != nil {
 			e := fmt.Errorf("attest place: could not transform identifier: %w", err)
 			if errors.Is(err, ErrInvalidIdentifier) {
@@ -82,87 +248,210 @@ func (s *AttestationService) placeReturnHandlerFunc(w http.ResponseWriter, r *ht
 			return http.StatusInternalServerError, e
 		}
 		identifier = i
+		ev.Identifier = identifier
+	}
+
+	if s.Authorizer != nil {
+		if err := s.Authorizer.Authorize(ctx, req.Identifier, req.IdentifierType, identifier); err != nil {
+			e := fmt.Errorf("attest place: could not authorize identifier: %w", err)
+			if errors.As(err, new(*authorizer.DeniedError)) {
+				return http.StatusForbidden, e
+			}
+			return http.StatusInternalServerError, e
+		}
 	}
 
-	token, err := s.TokenStore.New(identifier)
+	coalesce := func(pl *Placement) (int, interface{}) {
+		ev.PlacementID = pl.ID
+		s.logger().Info("placement coalesced", logging.ContextArgs(ctx,
+			logging.KeyPlacementID, pl.ID,
+			logging.KeyIdentifier, identifier,
+			logging.KeyClientIdentifier, req.Identifier,
+			logging.KeyPlacementPath, pl.Path,
+			logging.KeyStatus, pl.Status,
+		)...)
+		return http.StatusAccepted, &placeResponse{ID: pl.ID, Path: pl.Path, ExpiresAt: expiresAt(pl.expiresAt)}
+	}
+
+	// retries for an outstanding placement aren't charged against the Limiter's identifier limits
+	pl, err := s.coalesced(ctx, identifier)
 	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("attest place: could not create token: %w", err)
+		return http.StatusInternalServerError, fmt.Errorf("attest place: could not query placements: %w", err)
+	}
+	if pl != nil {
+		return coalesce(pl)
+	}
+
+	if s.Limiter != nil {
+		if err := s.Limiter.AllowIdentifier(ctx, identifier); err != nil {
+			return limitResponse(err)
+		}
 	}
 
-	p := make([]byte, pathSize)
-	if _, err := rand.Read(p); err != nil {
+	path, err := s.pathStrategy().Path(identifier)
+	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("attest place: could not generate path: %w", err)
 	}
 
-	path := fmt.Sprintf("/tmp/%s", base64.RawURLEncoding.EncodeToString(p))
+	pl, created, err := s.reserve(identifier, path)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("attest place: could not queue placement: %w", err)
+	}
+	if !created {
+		return coalesce(pl)
+	}
+
+	id := pl.ID
+	ev.PlacementID = id
 
-	if err := s.Transport.Place(token, identifier, path); err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("attest place: could not place token: %w", err)
+	tev := &Event{Type: EventTokenIssued, Identifier: identifier, ClientIdentifier: req.Identifier, PlacementID: id, RemoteAddr: r.RemoteAddr, Time: time.Now()}
+	token, err := s.newToken(ctx, req.Identifier, identifier)
+	tev.Err = err
+	s.emit(ctx, tev)
+	if err != nil {
+		err = fmt.Errorf("attest place: could not create token: %w", err)
+		s.placements.update(id, transport.StatusFailed, "", err)
+		return http.StatusInternalServerError, err
 	}
 
-	return http.StatusOK, &response{Path: path}
+	expires := s.tokenExpiry(token)
+	s.placements.setExpiry(id, expires)
+
+	s.logger().Info("placement queued", logging.ContextArgs(ctx,
+		logging.KeyPlacementID, id,
+		logging.KeyIdentifier, identifier,
+		logging.KeyClientIdentifier, req.Identifier,
+		logging.KeyIdentifierType, req.IdentifierType,
+		logging.KeyPlacementPath, path,
+	)...)
+
+	go s.place(ctx, id, token, identifier, path)
+
+	return http.StatusAccepted, &placeResponse{ID: id, Path: path, ExpiresAt: expiresAt(expires)}
 }
 
-// PlaceHandler is a token placing http.Handler. PlaceHandler should be mounted to a URL that's called by an attestation client
+func (s *AttestationService) statusReturnHandlerFunc(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+	id := strings.TrimPrefix(r.URL.Path, "/")
+	if id == "" {
+		return http.StatusBadRequest, errors.New("attest status: empty id")
+	}
+
+	pl, err := s.status(r.Context(), id)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("attest status: could not get placement: %w", err)
+	}
+	if pl == nil {
+		return http.StatusNotFound, fmt.Errorf("attest status: placement not found: %s", id)
+	}
+
+	return http.StatusOK, pl
+}
+
+// PlaceHandler is a token placing http.Handler. PlaceHandler should be mounted to a URL that's called by an attestation client.
+// PlaceHandler responds as soon as the placement is queued with the placement's id and the path the token will be placed at. Placement progress can be checked with StatusHandler
 func (s *AttestationService) PlaceHandler() http.Handler {
 	return s.withJSONResponse(s.placeReturnHandlerFunc)
 }
 
+// StatusHandler is an http.Handler that returns the Placement with the id given in the request path. If the handler is not mounted at "/", then it should be wrapped in http.StripPrefix so the handler sees the request rooted at /
+func (s *AttestationService) StatusHandler() http.Handler {
+	return s.withJSONResponse(s.statusReturnHandlerFunc)
+}
+
 // FileStoreHandler is a file handler. If the handler is not mounted at "/", then it should be wrapped in http.StripPrefix so the handler sees the request rooted at /
 func (s *AttestationService) FileStoreHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = withRequestID(w, r)
 		path := r.URL.Path
 		var (
 			file []byte
 			err  error
+			code = http.StatusOK
 		)
+		defer func() {
+			s.observe(OpFileStore, start, code, err)
+		}()
+
+		fs := filestore.WithContext(s.FileStore)
 		if r.Method == http.MethodHead {
-			file, err = s.FileStore.Peek(path)
+			file, err = fs.PeekContext(r.Context(), path)
 		} else {
-			file, err = s.FileStore.Get(path)
+			file, err = fs.GetContext(r.Context(), path)
 		}
 
 		if err != nil {
 			if errors.Is(err, filestore.ErrNotFound) {
+				code = http.StatusNotFound
 				w.WriteHeader(http.StatusNotFound)
 				w.Write([]byte("404 Not Found"))
 				return
 			}
-			if s.Logger != nil {
-				s.Logger.Printf("ERROR: %v\n", err)
-			}
+			s.logger().Error("could not get file", logging.ContextArgs(r.Context(),
+				logging.KeyFileStorePath, path,
+				logging.KeyError, err,
+			)...)
 
+			code = http.StatusInternalServerError
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("500 Internal Server Error"))
 			return
 		}
 
+		if r.Method != http.MethodHead {
+			ev := &Event{Type: EventPkgServed, RemoteAddr: r.RemoteAddr, Time: start}
+			if pl := s.placements.downloaded(path); pl != nil {
+				ev.Identifier, ev.PlacementID = pl.identifier, pl.ID
+			}
+			s.emit(r.Context(), ev)
+			s.logger().Info("payload served", logging.ContextArgs(r.Context(),
+				logging.KeyFileStorePath, path,
+				logging.KeyPlacementID, ev.PlacementID,
+				logging.KeyIdentifier, ev.Identifier,
+			)...)
+		}
+
 		http.ServeContent(w, r, "payload.pkg", time.Now(), bytes.NewReader(file))
 	})
 }
 
-// Middleware is a middleware that checks that a valid attestation token has been sent in the Authorization header, and sets the corresponding identifier in the request's context. Middleware returns a ReturnHandlerFunc and is intended to be wrapped by an http.Handler that will handle the returned status code and error. See ReturnHandlerFunc for more information. JSONMiddleware is a pre-built handler that marshals the code and error as JSON.
+// Middleware is a middleware that checks that a valid attestation token has been sent in the Authorization header, and sets the corresponding Device in the request's context (see FromContext). Middleware returns a ReturnHandlerFunc and is intended to be wrapped by an http.Handler that will handle the returned status code and error. See ReturnHandlerFunc for more information. JSONMiddleware is a pre-built handler that marshals the code and error as JSON.
 func (s *AttestationService) Middleware(next http.Handler) ReturnHandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) (int, interface{}) {
-		header := strings.Split(r.Header.Get("Authorization"), " ")
+		ev := &Event{Type: EventAuthenticationFailed, RemoteAddr: r.RemoteAddr, Time: time.Now()}
 
-		if len(header) != 2 || header[0] != "Bearer" {
-			return http.StatusBadRequest, errors.New("attest middleware: invalid header")
+		token, err := bearerToken(r)
+		if err != nil {
+			ev.Err = fmt.Errorf("attest middleware: %w", err)
+			code := bearerStatus(err)
+			s.emit(r.Context(), ev)
+			s.observe(OpMiddleware, ev.Time, code, ev.Err)
+			return code, ev.Err
 		}
-		token := header[1]
-		identifier, err := s.TokenStore.Authenticate(token)
+		claims, err := tokenstore.AuthenticateClaims(s.TokenStore, token)
 		if err != nil {
-			return http.StatusInternalServerError, fmt.Errorf("attest middleware: could not get identifier: %w", err)
+			ev.Err = fmt.Errorf("attest middleware: could not get identifier: %w", err)
+			code := http.StatusInternalServerError
+			if errors.As(err, new(*tokenstore.InvalidTokenError)) {
+				code = http.StatusUnauthorized
+			}
+			s.emit(r.Context(), ev)
+			s.observe(OpMiddleware, ev.Time, code, ev.Err)
+			return code, ev.Err
 		}
 
-		ctx := context.WithValue(r.Context(), ContextKeyIdentifier, identifier)
+		ev.Type, ev.Identifier = EventTokenAuthenticated, claims.Identifier
+		s.emit(r.Context(), ev)
+		s.logger().Debug("token authenticated", logging.ContextArgs(r.Context(), logging.KeyIdentifier, claims.Identifier)...)
+		s.observe(OpMiddleware, ev.Time, http.StatusOK, nil)
 
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), newDevice(claims))))
 		return StatusCodeSkip, nil
 	}
 }
 
-// JSONMiddleware is a wrapper for Middleware that returns errors encountered back to the client in JSON format. e.g. {"code":401,"description":"Bad Request"}
+// JSONMiddleware is a wrapper for Middleware that returns errors encountered back to the client with the AttestationService's ErrorRenderer, application/problem+json by default.
+// Missing and invalid tokens get a 401 Unauthorized response with an RFC 6750 WWW-Authenticate header. e.g. {"type":"about:blank","title":"Unauthorized","status":401,"error":"invalid_token"}
 func (s *AttestationService) JSONMiddleware(next http.Handler) http.Handler {
 	return s.withJSONResponse(s.Middleware(next))
 }
@@ -0,0 +1,396 @@
+package attest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/authorizer"
+	"github.com/korylprince/macos-device-attestation/filestore"
+	fsmem "github.com/korylprince/macos-device-attestation/filestore/mem"
+	"github.com/korylprince/macos-device-attestation/ratelimit"
+	rlmem "github.com/korylprince/macos-device-attestation/ratelimit/mem"
+	tsmem "github.com/korylprince/macos-device-attestation/tokenstore/mem"
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+// testTransport is a Transport that stores the token as the payload in a FileStore and reports its progress.
+// If release is set, placements wait for it to be closed. If err is set, placements fail with it
+type testTransport struct {
+	fs      filestore.FileStore
+	err     error
+	release chan struct{}
+
+	mu     sync.Mutex
+	placed []string
+}
+
+func (t *testTransport) Place(token, identifier, path string) error {
+	return t.PlaceContext(context.Background(), token, identifier, path)
+}
+
+func (t *testTransport) PlaceContext(ctx context.Context, token, identifier, path string) error {
+	t.mu.Lock()
+	t.placed = append(t.placed, identifier)
+	t.mu.Unlock()
+
+	if t.release != nil {
+		select {
+		case <-t.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if t.err != nil {
+		return t.err
+	}
+
+	fsPath, err := t.fs.Put("payload.pkg", []byte(token))
+	if err != nil {
+		return err
+	}
+	transport.ReportStatus(ctx, transport.StatusPkgGenerated, fsPath)
+	transport.ReportStatus(ctx, transport.StatusCommandSent, fsPath)
+	return nil
+}
+
+// placements returns the identifiers the token was placed for, in order
+func (t *testTransport) placements() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.placed...)
+}
+
+// newTestService returns an AttestationService with in-memory stores and a testTransport
+func newTestService(t *testing.T) (*AttestationService, *testTransport) {
+	t.Helper()
+	fs := fsmem.New(100, time.Minute)
+	tr := &testTransport{fs: fs}
+	return New(tsmem.New(100, time.Hour), tr, fs, nil), tr
+}
+
+// doJSON sends a request with body marshaled as JSON, unless it's a string, to h and returns the response
+func doJSON(t *testing.T, h http.Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		buf = []byte(b)
+	default:
+		var err error
+		if buf, err = json.Marshal(body); err != nil {
+			t.Fatalf("could not marshal body: %v", err)
+		}
+	}
+
+	r := httptest.NewRequest(method, target, bytes.NewReader(buf))
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decode unmarshals w's body into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("could not parse response %q: %v", w.Body.String(), err)
+	}
+}
+
+type testPlaceResponse struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+// place starts a placement for identifier with s's PlaceHandler
+func place(t *testing.T, s *AttestationService, identifier string) *testPlaceResponse {
+	t.Helper()
+	w := doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": identifier})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	resp := new(testPlaceResponse)
+	decode(t, w, resp)
+	return resp
+}
+
+// waitStatus waits for the Placement with id to reach status and returns it
+func waitStatus(t *testing.T, s *AttestationService, id string, status transport.Status) *Placement {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pl, err := s.status(context.Background(), id)
+		if err != nil {
+			t.Fatalf("could not get status: %v", err)
+		}
+		if pl != nil && pl.Status == status {
+			return pl
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status %s, got: %+v", status, pl)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPlaceHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"valid", "application/json", `{"identifier":"serial"}`, http.StatusAccepted},
+		{"empty identifier", "application/json", `{"identifier":""}`, http.StatusBadRequest},
+		{"invalid json", "application/json", `{"identifier":`, http.StatusBadRequest},
+		{"wrong content type", "text/plain", `{"identifier":"serial"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			w := httptest.NewRecorder()
+			s.PlaceHandler().ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if test.code != http.StatusAccepted {
+				return
+			}
+
+			resp := new(testPlaceResponse)
+			decode(t, w, resp)
+			if resp.ID == "" || resp.Path == "" {
+				t.Errorf("expected id and path, got: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestPlacementStatus(t *testing.T) {
+	s, tr := newTestService(t)
+	tr.release = make(chan struct{})
+
+	resp := place(t, s, "serial")
+
+	w := doJSON(t, s.StatusHandler(), http.MethodGet, "/"+resp.ID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	pl := new(Placement)
+	decode(t, w, pl)
+	if pl.ID != resp.ID || pl.Path != resp.Path || pl.Status != transport.StatusQueued {
+		t.Errorf("expected queued placement %s at %s, got: %+v", resp.ID, resp.Path, pl)
+	}
+
+	close(tr.release)
+	pl = waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+
+	w = doJSON(t, http.StripPrefix("/files/", s.FileStoreHandler()), http.MethodGet, "/files/"+pl.fsPath, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	waitStatus(t, s, resp.ID, transport.StatusDownloaded)
+
+	if placed := tr.placements(); len(placed) != 1 || placed[0] != "serial" {
+		t.Errorf("expected one placement for serial, got %v", placed)
+	}
+}
+
+func TestPlacementFailed(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"unknown", errors.New("transport failed: 10.0.0.1:443: connection refused"), "error"},
+		{"invalid identifier", fmt.Errorf("transport failed: %w", ErrInvalidIdentifier), "invalid_identifier"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, tr := newTestService(t)
+			tr.err = test.err
+
+			resp := place(t, s, "serial")
+			waitStatus(t, s, resp.ID, transport.StatusFailed)
+
+			// the unauthenticated status only exposes a coarse error code
+			w := doJSON(t, s.StatusHandler(), http.MethodGet, "/"+resp.ID, nil)
+			body := make(map[string]interface{})
+			decode(t, w, &body)
+			if body["error"] != test.code {
+				t.Errorf("expected error %q, got %v", test.code, body["error"])
+			}
+			if _, ok := body["identifier"]; ok {
+				t.Errorf("expected identifier not to be exposed, got %v", body["identifier"])
+			}
+			if strings.Contains(w.Body.String(), "10.0.0.1") || strings.Contains(w.Body.String(), "serial") {
+				t.Errorf("expected transport error and identifier not to be exposed, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPlacementExpired(t *testing.T) {
+	s, _ := newTestService(t)
+
+	resp := place(t, s, "serial")
+	pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+
+	// the payload expiring from the FileStore is the same as it being removed
+	if _, err := s.FileStore.Get(pl.fsPath); err != nil {
+		t.Fatalf("could not remove payload: %v", err)
+	}
+	waitStatus(t, s, resp.ID, transport.StatusExpired)
+}
+
+func TestStatusHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{"empty id", "/", http.StatusBadRequest},
+		{"unknown id", "/unknown", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			if w := doJSON(t, s.StatusHandler(), http.MethodGet, test.path, nil); w.Code != test.code {
+				t.Errorf("expected status %d, got %d", test.code, w.Code)
+			}
+		})
+	}
+}
+
+func TestPlaceHandlerRateLimit(t *testing.T) {
+	s, _ := newTestService(t)
+	s.Limiter = rlmem.New(100, rlmem.Rate{Burst: 1, Interval: time.Hour}, rlmem.Rate{}, rlmem.Rate{}, 0)
+
+	resp := place(t, s, "serial")
+
+	// retries for an outstanding placement aren't limited
+	if retry := place(t, s, "serial"); retry.ID != resp.ID {
+		t.Fatalf("expected retry to be coalesced into %s, got %s", resp.ID, retry.ID)
+	}
+
+	pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+	doJSON(t, http.StripPrefix("/files/", s.FileStoreHandler()), http.MethodGet, "/files/"+pl.fsPath, nil)
+
+	w := doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": "serial"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusTooManyRequests, w.Code, w.Body.String())
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "3600" {
+		t.Errorf("expected Retry-After 3600, got %q", ra)
+	}
+
+	// other identifiers have their own bucket
+	place(t, s, "other")
+}
+
+// errLimiter is a ratelimit.Limiter that returns remoteErr and identifierErr from its checks
+type errLimiter struct{ remoteErr, identifierErr error }
+
+func (l errLimiter) AllowRemote(ctx context.Context, remoteIP string) error { return l.remoteErr }
+
+func (l errLimiter) AllowIdentifier(ctx context.Context, identifier string) error {
+	return l.identifierErr
+}
+
+func (l errLimiter) Placed(ctx context.Context, identifier string) {}
+
+func TestPlaceHandlerLimiterError(t *testing.T) {
+	limited := &ratelimit.LimitError{Kind: ratelimit.KindGlobal, After: time.Second}
+	failed := errors.New("limiter failed")
+
+	tests := []struct {
+		name    string
+		limiter errLimiter
+		code    int
+		// transformed is true if the identifier should be transformed before the limiter rejects the request
+		transformed bool
+	}{
+		{"remote limited", errLimiter{remoteErr: limited}, http.StatusTooManyRequests, false},
+		{"remote failed", errLimiter{remoteErr: failed}, http.StatusInternalServerError, false},
+		{"identifier limited", errLimiter{identifierErr: limited}, http.StatusTooManyRequests, true},
+		{"identifier failed", errLimiter{identifierErr: failed}, http.StatusInternalServerError, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, tr := newTestService(t)
+			s.Transport = &transformingTransport{tr, map[string]string{"serial": "udid"}}
+			hook := new(recordHook)
+			s.EventHook = hook
+			s.Limiter = test.limiter
+			if w := doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": "serial"}); w.Code != test.code {
+				t.Errorf("expected status %d, got %d", test.code, w.Code)
+			}
+			if transformed := len(hook.get(EventIdentifierTransformed)) != 0; transformed != test.transformed {
+				t.Errorf("expected transformed %t, got %t", test.transformed, transformed)
+			}
+		})
+	}
+}
+
+func TestPlaceHandlerAuthorizer(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   int
+		detail string
+	}{
+		{"allowed", nil, http.StatusAccepted, ""},
+		{"denied", &authorizer.DeniedError{Reason: "not enrolled"}, http.StatusForbidden, "not enrolled"},
+		{"failed", errors.New("directory unavailable"), http.StatusInternalServerError, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, tr := newTestService(t)
+			s.Transport = &transformingTransport{tr, map[string]string{"serial": "udid"}}
+			var clientIdentifier, identifierType, identifier string
+			s.Authorizer = authorizer.Func(func(ctx context.Context, ci, typ, i string) error {
+				clientIdentifier, identifierType, identifier = ci, typ, i
+				return test.err
+			})
+
+			w := doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": "serial"})
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if clientIdentifier != "serial" || identifierType != IdentifierTypeSerial || identifier != "udid" {
+				t.Errorf("expected authorizer to be called with serial of type serial and udid, got %q of type %q and %q", clientIdentifier, identifierType, identifier)
+			}
+			if test.code == http.StatusAccepted {
+				return
+			}
+
+			resp := new(struct {
+				Detail string `json:"detail"`
+			})
+			decode(t, w, resp)
+			if resp.Detail != test.detail {
+				t.Errorf("expected detail %q, got %q", test.detail, resp.Detail)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package authorizer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Authorizer is an interface to decide whether a token may be placed on a device
+type Authorizer interface {
+	// Authorize returns nil if a token may be placed on the device. clientIdentifier is the identifier sent by the client and identifierType is its type (e.g. "serial"),
+	// and identifier is the identifier returned by the Transport's Transformer (or clientIdentifier if the Transport doesn't transform identifiers).
+	// The client chooses which type of identifier it sends, so an Authorizer that only knows one type must check identifierType or match identifier instead.
+	// If the device isn't authorized, the returned error will be of type *DeniedError
+	Authorize(ctx context.Context, clientIdentifier, identifierType, identifier string) error
+}
+
+// DeniedError is returned by an Authorizer when a device isn't authorized
+type DeniedError struct {
+	// Reason is a description of why the device was denied. It's returned to the client
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("identifier denied: %s", e.Reason)
+}
+
+// Detail returns e.Reason
+func (e *DeniedError) Detail() string {
+	return e.Reason
+}
+
+// Func is an adapter to allow the use of ordinary functions as Authorizers
+type Func func(ctx context.Context, clientIdentifier, identifierType, identifier string) error
+
+// Authorize calls f(ctx, clientIdentifier, identifierType, identifier)
+func (f Func) Authorize(ctx context.Context, clientIdentifier, identifierType, identifier string) error {
+	return f(ctx, clientIdentifier, identifierType, identifier)
+}
+
+type chain []Authorizer
+
+func (c chain) Authorize(ctx context.Context, clientIdentifier, identifierType, identifier string) error {
+	for _, a := range c {
+		if err := a.Authorize(ctx, clientIdentifier, identifierType, identifier); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chain returns an Authorizer that authorizes a device only if all authorizers do. The authorizers are called in order, and the first error is returned
+func Chain(authorizers ...Authorizer) Authorizer {
+	return chain(authorizers)
+}
+
+type types map[string]struct{}
+
+func (t types) Authorize(ctx context.Context, clientIdentifier, identifierType, identifier string) error {
+	if _, ok := t[identifierType]; !ok {
+		return &DeniedError{Reason: fmt.Sprintf("identifier type %q is not allowed", identifierType)}
+	}
+	return nil
+}
+
+// Types returns an Authorizer that denies devices whose client identifier isn't one of the given types.
+// Chain it before a List or Regexp keyed by client identifiers of one type, e.g. serial numbers, so devices can't avoid the list by sending another type of identifier
+func Types(identifierTypes ...string) Authorizer {
+	return types(toSet(identifierTypes))
+}
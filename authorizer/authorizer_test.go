@@ -0,0 +1,101 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	list := NewList(nil, []string{"C02DENIED"})
+	re, err := NewRegexp([]string{"^C02"}, []string{"^C02BAD"})
+	if err != nil {
+		t.Fatalf("could not create Regexp: %v", err)
+	}
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name             string
+		authorizer       Authorizer
+		clientIdentifier string
+		identifierType   string
+		identifier       string
+		allowed          bool
+	}{
+		{"list allowed", list, "C02OK", "serial", "udid", true},
+		{"list denied client identifier", list, "C02DENIED", "serial", "udid", false},
+		{"list denied identifier", list, "udid", "serial", "C02DENIED", false},
+		{"allowlist", NewList([]string{"udid"}, nil), "C02OK", "serial", "udid", true},
+		{"not in allowlist", NewList([]string{"other"}, nil), "C02OK", "serial", "udid", false},
+		{"denylist overrides allowlist", NewList([]string{"udid"}, []string{"C02DENIED"}), "C02DENIED", "serial", "udid", false},
+		{"regexp allowed", re, "C02OK", "serial", "udid", true},
+		{"regexp denied", re, "C02BAD1", "serial", "udid", false},
+		{"regexp not allowed", re, "D03OK", "serial", "udid", false},
+		{"chain allowed", Chain(list, re), "C02OK", "serial", "udid", true},
+		{"chain denied by first", Chain(list, re), "C02DENIED", "serial", "udid", false},
+		{"chain denied by second", Chain(list, re), "C02BAD1", "serial", "udid", false},
+		{"types allowed", Types("serial"), "C02OK", "serial", "udid", true},
+		{"types denied", Types("serial"), "udid", "udid", "udid", false},
+		{"chain denied by type", Chain(Types("serial"), list), "udid", "udid", "udid", false},
+		{"list only matches listed identifiers", list, "udid", "udid", "udid", true},
+		{"func", Func(func(ctx context.Context, clientIdentifier, identifierType, identifier string) error {
+			return &DeniedError{Reason: identifierType}
+		}), "C02OK", "serial", "udid", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.authorizer.Authorize(context.Background(), test.clientIdentifier, test.identifierType, test.identifier)
+			if test.allowed && err != nil {
+				t.Errorf("expected allowed, got: %v", err)
+			}
+			if !test.allowed && !errors.As(err, new(*DeniedError)) {
+				t.Errorf("expected DeniedError, got: %v", err)
+			}
+		})
+	}
+
+	// errors other than DeniedError are returned unchanged
+	failing := Func(func(ctx context.Context, clientIdentifier, identifierType, identifier string) error { return errFailed })
+	if err := Chain(list, failing).Authorize(context.Background(), "C02OK", "serial", "udid"); !errors.Is(err, errFailed) {
+		t.Errorf("expected error to be returned, got: %v", err)
+	}
+}
+
+func TestLoadList(t *testing.T) {
+	dir := t.TempDir()
+	allowPath := filepath.Join(dir, "allow")
+	if err := os.WriteFile(allowPath, []byte("# devices\nC02OK\n\n  udid  \n"), 0600); err != nil {
+		t.Fatalf("could not write allowlist: %v", err)
+	}
+
+	l, err := LoadList(allowPath, "")
+	if err != nil {
+		t.Fatalf("could not load list: %v", err)
+	}
+	for _, i := range []string{"C02OK", "udid"} {
+		if err = l.Authorize(context.Background(), i, "serial", i); err != nil {
+			t.Errorf("expected %s to be allowed, got: %v", i, err)
+		}
+	}
+	for _, i := range []string{"# devices", "", "other"} {
+		if err = l.Authorize(context.Background(), i, "serial", i); err == nil {
+			t.Errorf("expected %q to be denied", i)
+		}
+	}
+
+	if _, err = LoadList(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestNewRegexpInvalid(t *testing.T) {
+	if _, err := NewRegexp([]string{"("}, nil); err == nil {
+		t.Error("expected error for invalid allow pattern")
+	}
+	if _, err := NewRegexp(nil, []string{"("}); err == nil {
+		t.Error("expected error for invalid deny pattern")
+	}
+}
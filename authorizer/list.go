@@ -0,0 +1,98 @@
+package authorizer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// List is an Authorizer that uses static allowlists and denylists of identifiers. Either the client identifier or the transformed identifier can be listed.
+// Client identifiers of any type are matched, so lists of client identifiers should be chained after Types (see Authorizer)
+type List struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+func toSet(identifiers []string) map[string]struct{} {
+	if identifiers == nil {
+		return nil
+	}
+	set := make(map[string]struct{}, len(identifiers))
+	for _, i := range identifiers {
+		set[i] = struct{}{}
+	}
+	return set
+}
+
+// NewList returns a new List. If allow is nil, all identifiers not in deny are allowed. Identifiers in deny are always denied
+func NewList(allow, deny []string) *List {
+	return &List{allow: toSet(allow), deny: toSet(deny)}
+}
+
+// readList reads identifiers from path, one per line. Blank lines and lines starting with # are ignored
+func readList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+	defer f.Close()
+
+	identifiers := make([]string, 0)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identifiers = append(identifiers, line)
+	}
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+
+	return identifiers, nil
+}
+
+// LoadList returns a new List with identifiers read from the files at allowPath and denyPath, one per line. Blank lines and lines starting with # are ignored.
+// If allowPath or denyPath is empty, that list isn't used
+func LoadList(allowPath, denyPath string) (*List, error) {
+	var allow, deny []string
+	var err error
+
+	if allowPath != "" {
+		if allow, err = readList(allowPath); err != nil {
+			return nil, fmt.Errorf("could not read allowlist: %w", err)
+		}
+	}
+
+	if denyPath != "" {
+		if deny, err = readList(denyPath); err != nil {
+			return nil, fmt.Errorf("could not read denylist: %w", err)
+		}
+	}
+
+	return NewList(allow, deny), nil
+}
+
+// Authorize denies the device if either identifier is in the denylist, or if there is an allowlist and neither identifier is in it
+func (l *List) Authorize(ctx context.Context, clientIdentifier, identifierType, identifier string) error {
+	for _, i := range []string{clientIdentifier, identifier} {
+		if _, ok := l.deny[i]; ok {
+			return &DeniedError{Reason: "identifier is in denylist"}
+		}
+	}
+
+	if l.allow == nil {
+		return nil
+	}
+
+	for _, i := range []string{clientIdentifier, identifier} {
+		if _, ok := l.allow[i]; ok {
+			return nil
+		}
+	}
+
+	return &DeniedError{Reason: "identifier is not in allowlist"}
+}
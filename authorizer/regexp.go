@@ -0,0 +1,66 @@
+package authorizer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// Regexp is an Authorizer that uses regular expressions to allow and deny identifiers. Either the client identifier or the transformed identifier can match.
+// Client identifiers of any type are matched, so patterns for client identifiers should be chained after Types (see Authorizer)
+type Regexp struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	if patterns == nil {
+		return nil, nil
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// NewRegexp returns a new Regexp with the given patterns. Patterns aren't anchored, so use ^ and $ to match whole identifiers.
+// If allow is nil, all identifiers not matching deny are allowed. Identifiers matching deny are always denied
+func NewRegexp(allow, deny []string) (*Regexp, error) {
+	a, err := compile(allow)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile allow patterns: %w", err)
+	}
+
+	d, err := compile(deny)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile deny patterns: %w", err)
+	}
+
+	return &Regexp{allow: a, deny: d}, nil
+}
+
+// Authorize denies the device if either identifier matches a deny pattern, or if there are allow patterns and neither identifier matches one
+func (r *Regexp) Authorize(ctx context.Context, clientIdentifier, identifierType, identifier string) error {
+	for _, re := range r.deny {
+		if re.MatchString(clientIdentifier) || re.MatchString(identifier) {
+			return &DeniedError{Reason: "identifier matches a deny pattern"}
+		}
+	}
+
+	if r.allow == nil {
+		return nil
+	}
+
+	for _, re := range r.allow {
+		if re.MatchString(clientIdentifier) || re.MatchString(identifier) {
+			return nil
+		}
+	}
+
+	return &DeniedError{Reason: "identifier doesn't match an allow pattern"}
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultCachePath is the default path of a FileCache
+const DefaultCachePath = "/var/db/macos-device-attestation/token.json"
+
+// DefaultExpirySkew is how long before a cached token expires that it stops being used
+const DefaultExpirySkew = 2 * time.Minute
+
+// TokenCache stores a token so it can be reused instead of starting a new placement
+type TokenCache interface {
+	// Load returns the cached token and when it expires. If the expiry isn't known, expires is zero. If there's no cached token, token is empty and err is nil
+	Load() (token string, expires time.Time, err error)
+	// Store caches token, which expires at expires. If the expiry isn't known, expires is zero
+	Store(token string, expires time.Time) error
+	// Clear removes the cached token, e.g. because it was rejected
+	Clear() error
+}
+
+// FileCache is a TokenCache that stores the token in a file only readable by root. Writes are atomic, so a crash never leaves a partial token behind.
+// The cache file and its directory get the same checks as placed token files: a cache that could have been written or read by anyone but root is never used
+type FileCache struct {
+	// Path is the path of the cache file. Its directory is created with mode 0700 if it doesn't exist, and must be owned by root with mode 0700 if it does. If empty, DefaultCachePath is used
+	Path string
+}
+
+type cacheFile struct {
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (c *FileCache) path() string {
+	if c.Path == "" {
+		return DefaultCachePath
+	}
+	return c.Path
+}
+
+// Load returns the cached token. If the cache file or its directory isn't owned by root with mode 0600 or 0700, an *InsecureFileError is returned
+func (c *FileCache) Load() (string, time.Time, error) {
+	path := c.path()
+	if err := checkDir(filepath.Dir(path)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", time.Time{}, nil
+		}
+		return "", time.Time{}, fmt.Errorf("could not check cache directory: %w", err)
+	}
+
+	f, err := openFile(path, os.O_RDONLY)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not open cache: %w", err)
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(f, maxTokenSize+1))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not read cache: %w", err)
+	}
+	if len(buf) > maxTokenSize {
+		return "", time.Time{}, &InsecureFileError{Path: path, Reason: "file is too large"}
+	}
+
+	cf := new(cacheFile)
+	if err = json.Unmarshal(buf, cf); err != nil {
+		return "", time.Time{}, fmt.Errorf("could not parse cache: %w", err)
+	}
+
+	if cf.ExpiresAt == nil {
+		return cf.Token, time.Time{}, nil
+	}
+	return cf.Token, *cf.ExpiresAt, nil
+}
+
+// Store atomically writes token to the cache file with mode 0600. If the cache directory isn't owned by root with mode 0700, an *InsecureFileError is returned
+func (c *FileCache) Store(token string, expires time.Time) error {
+	path := c.path()
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("could not create cache directory: %w", err)
+	}
+	// the directory may already exist, so it's checked before the token is written to it
+	if err := checkDir(dir); err != nil {
+		return fmt.Errorf("could not check cache directory: %w", err)
+	}
+
+	f := &cacheFile{Token: token}
+	if !expires.IsZero() {
+		f.ExpiresAt = &expires
+	}
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("could not marshal cache: %w", err)
+	}
+
+	// os.CreateTemp creates files with mode 0600
+	tmp, err := os.CreateTemp(dir, ".token-*")
+	if err != nil {
+		return fmt.Errorf("could not create temporary cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write cache: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync cache: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("could not close cache: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not replace cache: %w", err)
+	}
+	return nil
+}
+
+// Clear removes the cache file
+func (c *FileCache) Clear() error {
+	if err := os.Remove(c.path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove cache: %w", err)
+	}
+	return nil
+}
+
+// jwtExpiry returns the exp claim of token if it's a JWT, or the zero time. The token's signature isn't verified
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp *json.Number `json:"exp"`
+	}
+	if err = json.Unmarshal(buf, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}
+	}
+
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(exp), 0)
+}
+
+// usable returns true if a token that expires at expires can still be used. Tokens with an unknown expiry are used until they're rejected
+func usable(expires time.Time) bool {
+	return expires.IsZero() || time.Now().Add(DefaultExpirySkew).Before(expires)
+}
+
+// GetTokenCached returns the token in cache if it doesn't expire soon. Otherwise it gets a new token with GetToken and stores it in cache.
+// If the returned token is rejected by the server, call cache.Clear and GetTokenCached again to start a new placement
+func (c *Client) GetTokenCached(ctx context.Context, cache TokenCache) (string, error) {
+	token, expires, err := cache.Load()
+	if err == nil && token != "" && usable(expires) {
+		return token, nil
+	}
+
+	token, expires, err = c.getToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if err = cache.Store(token, expires); err != nil {
+		return "", fmt.Errorf("could not cache token: %w", err)
+	}
+	return token, nil
+}
+
+// GetTokenCached is like GetToken, but uses the token in cache if it doesn't expire soon. See Client.GetTokenCached
+func GetTokenCached(url string, timeout time.Duration, cache TokenCache) (string, error) {
+	return NewClient(url, timeout).GetTokenCached(context.Background(), cache)
+}
@@ -0,0 +1,268 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileCache(t *testing.T) {
+	requireRoot(t)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name string
+		// setup runs after the token is stored in the cache at path in dir
+		setup func(t *testing.T, dir, path string)
+		// invalid is true if Load should return an error
+		invalid bool
+		// insecure is true if the error should be an *InsecureFileError
+		insecure bool
+	}{
+		{"valid", func(t *testing.T, dir, path string) {}, false, false},
+		{"file mode", func(t *testing.T, dir, path string) {
+			if err := os.Chmod(path, 0644); err != nil {
+				t.Fatalf("could not chmod file: %v", err)
+			}
+		}, true, true},
+		{"file owner", func(t *testing.T, dir, path string) {
+			if err := os.Chown(path, 1, 1); err != nil {
+				t.Fatalf("could not chown file: %v", err)
+			}
+		}, true, true},
+		{"directory mode", func(t *testing.T, dir, path string) {
+			if err := os.Chmod(dir, 0755); err != nil {
+				t.Fatalf("could not chmod directory: %v", err)
+			}
+		}, true, true},
+		{"symlink", func(t *testing.T, dir, path string) {
+			target := filepath.Join(dir, "target")
+			if err := os.Rename(path, target); err != nil {
+				t.Fatalf("could not move file: %v", err)
+			}
+			if err := os.Symlink(target, path); err != nil {
+				t.Fatalf("could not create symlink: %v", err)
+			}
+		}, true, true},
+		{"not json", func(t *testing.T, dir, path string) {
+			if err := os.WriteFile(path, []byte("token"), 0600); err != nil {
+				t.Fatalf("could not write file: %v", err)
+			}
+		}, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "cache")
+			path := filepath.Join(dir, "token.json")
+			c := &FileCache{Path: path}
+
+			if err := c.Store("token", expires); err != nil {
+				t.Fatalf("could not store token: %v", err)
+			}
+			if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0700 {
+				t.Fatalf("expected directory with mode 0700, got: %v, %v", fi, err)
+			}
+			test.setup(t, dir, path)
+
+			token, exp, err := c.Load()
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected error, got token %q", token)
+				}
+				if test.insecure && !errors.As(err, new(*InsecureFileError)) {
+					t.Errorf("expected InsecureFileError, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not load token: %v", err)
+			}
+			if token != "token" || !exp.Equal(expires) {
+				t.Errorf("expected token %q expiring at %v, got %q expiring at %v", "token", expires, token, exp)
+			}
+
+			if err = c.Clear(); err != nil {
+				t.Fatalf("could not clear cache: %v", err)
+			}
+			if token, _, err = c.Load(); err != nil || token != "" {
+				t.Errorf("expected empty cache, got %q: %v", token, err)
+			}
+		})
+	}
+}
+
+func TestFileCacheStoreInsecureDir(t *testing.T) {
+	requireRoot(t)
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatalf("could not chmod directory: %v", err)
+	}
+
+	c := &FileCache{Path: filepath.Join(dir, "token.json")}
+	if err := c.Store("token", time.Time{}); !errors.As(err, new(*InsecureFileError)) {
+		t.Errorf("expected InsecureFileError, got: %v", err)
+	}
+	if _, err := os.Lstat(c.Path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected token to not be written, got: %v", err)
+	}
+}
+
+func TestFileCacheUnknownExpiry(t *testing.T) {
+	requireRoot(t)
+
+	c := &FileCache{Path: filepath.Join(t.TempDir(), "cache", "token.json")}
+	if err := c.Store("token", time.Time{}); err != nil {
+		t.Fatalf("could not store token: %v", err)
+	}
+	if token, expires, err := c.Load(); err != nil || token != "token" || !expires.IsZero() {
+		t.Errorf("expected token with unknown expiry, got %q expiring at %v: %v", token, expires, err)
+	}
+	if entries, err := os.ReadDir(filepath.Dir(c.Path)); err != nil || len(entries) != 1 {
+		t.Errorf("expected only the cache file, got %v: %v", entries, err)
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	jwt := func(claims string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		expires time.Time
+	}{
+		{"exp", jwt(`{"exp":1700000000}`), time.Unix(1700000000, 0)},
+		{"float exp", jwt(`{"exp":1700000000.5}`), time.Unix(1700000000, 0)},
+		{"no exp", jwt(`{"sub":"serial"}`), time.Time{}},
+		{"invalid claims", jwt(`{`), time.Time{}},
+		{"invalid base64", "e30.!.sig", time.Time{}},
+		{"not a jwt", "token", time.Time{}},
+	}
+
+	for _, test := range tests {
+		if expires := jwtExpiry(test.token); !expires.Equal(test.expires) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expires, expires)
+		}
+	}
+}
+
+// memCache is a TokenCache for tests
+type memCache struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	cleared bool
+}
+
+func (c *memCache) Load() (string, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token, c.expires, nil
+}
+
+func (c *memCache) Store(token string, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.expires = token, expires
+	return nil
+}
+
+func (c *memCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.expires, c.cleared = "", time.Time{}, true
+	return nil
+}
+
+func TestGetTokenCached(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires time.Time
+		cached  bool
+	}{
+		{"unknown expiry", time.Time{}, true},
+		{"valid", time.Now().Add(time.Hour), true},
+		{"expires soon", time.Now().Add(DefaultExpirySkew / 2), false},
+		{"expired", time.Now().Add(-time.Hour), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := new(failingPlace)
+			place := httptest.NewServer(p)
+			defer place.Close()
+
+			token, err := GetTokenCached(place.URL, 0, &memCache{token: "cached", expires: test.expires})
+			if test.cached && (err != nil || token != "cached") {
+				t.Errorf("expected cached token, got %q: %v", token, err)
+			}
+			if !test.cached && err == nil {
+				t.Errorf("expected new placement to fail, got %q", token)
+			}
+			if placed := p.requests != 0; placed == test.cached {
+				t.Errorf("expected placement %t, got %d placements", !test.cached, p.requests)
+			}
+		})
+	}
+}
+
+func TestTransportCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		expires time.Time
+		// used is true if the cached token should be sent
+		used bool
+	}{
+		{"valid", "valid", time.Now().Add(time.Hour), true},
+		{"expires soon", "valid", time.Now().Add(time.Minute), false},
+		{"rejected", "stale", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := new(testAPI)
+			api := httptest.NewServer(a)
+			defer api.Close()
+			p := new(failingPlace)
+			place := httptest.NewServer(p)
+			defer place.Close()
+
+			cache := &memCache{token: test.token, expires: test.expires}
+			tr := NewTransport(place.URL, 0)
+			tr.Cache = cache
+
+			r, err := http.NewRequest(http.MethodGet, api.URL, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %v", err)
+			}
+			res, err := tr.RoundTrip(r)
+			if err == nil {
+				res.Body.Close()
+			}
+
+			if test.used && (err != nil || p.requests != 0) {
+				t.Errorf("expected cached token to be used, got %d placements: %v", p.requests, err)
+			}
+			if !test.used && (err == nil || p.requests != 1 || !cache.cleared) {
+				t.Errorf("expected cache to be cleared and a placement, got %d placements, cleared %t: %v", p.requests, cache.cleared, err)
+			}
+		})
+	}
+}
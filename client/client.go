@@ -2,76 +2,219 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
-	"github.com/korylprince/macserial"
 )
 
+// PlacementDir is the directory the server is expected to place tokens in. It must match the directory used by the server's attest.PathStrategy.
+// Paths returned by the server outside of PlacementDir are rejected
+var PlacementDir = "/var/run/macos-device-attestation"
+
+// DefaultInitialWait is the default value for Client.InitialWait
+const DefaultInitialWait = 5 * time.Second
+
+// DefaultUserAgent is the default value for Client.UserAgent
+const DefaultUserAgent = "macos-device-attestation-client"
+
+// maxTokenSize is the maximum size of a token or cache file
+const maxTokenSize = 64 * 1024
+
+// validatePath returns an *InvalidPathError if path isn't a clean, absolute path inside dir
+func validatePath(path, dir string) error {
+	dir = filepath.Clean(dir)
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path || !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return &InvalidPathError{Path: path, Dir: dir}
+	}
+	return nil
+}
+
+// Client retrieves tokens from the device attestation service. All fields except URL are optional and should be set before the Client is used
+type Client struct {
+	// URL is the URL of the service's PlaceHandler
+	URL string
+	// Timeout is how long to wait for a token to be placed after the placement request. If zero, GetToken waits until its context is done
+	Timeout time.Duration
+	// Identifier provides the identifier sent to the server. If nil, SerialProvider is used
+	Identifier IdentifierProvider
+
+	// HTTPClient is used to make requests. If nil, http.DefaultClient is used
+	HTTPClient *http.Client
+	// RootCAs, if set, is used to verify the server's certificate instead of the system roots
+	RootCAs *x509.CertPool
+	// SPKIPins, if set, requires a certificate in the server's verified chain to have one of the public keys. See SPKIPin.
+	// If RootCAs or SPKIPins are set, HTTPClient's Transport must be nil or an *http.Transport, which is cloned
+	SPKIPins []string
+
+	// Header is added to every request
+	Header http.Header
+	// UserAgent is the User-Agent header sent with every request. If empty, DefaultUserAgent is used
+	UserAgent string
+
+	// InitialWait is how long to wait for the token to be placed before trying to read it. If zero, DefaultInitialWait is used
+	InitialWait time.Duration
+	// Backoff returns the policy used to retry reading the token after InitialWait. If nil, an exponential backoff starting at one second is used.
+	// Retries stop when the policy stops or Timeout elapses, whichever is first
+	Backoff func() backoff.BackOff
+
+	once       sync.Once
+	httpClient *http.Client
+	err        error
+}
+
+// NewClient returns a new Client that gets tokens from the PlaceHandler at url, waiting up to timeout for each token to be placed
+func NewClient(url string, timeout time.Duration) *Client {
+	return &Client{URL: url, Timeout: timeout}
+}
+
+func (c *Client) client() (*http.Client, error) {
+	c.once.Do(func() {
+		c.httpClient, c.err = newHTTPClient(c.HTTPClient, c.RootCAs, c.SPKIPins)
+	})
+	return c.httpClient, c.err
+}
+
+func (c *Client) newBackoff() backoff.BackOff {
+	if c.Backoff != nil {
+		return c.Backoff()
+	}
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Second
+	b.MaxElapsedTime = 0
+	return b
+}
+
+// GetToken retrieves a token from the device attestation service. GetToken retries reading the token until it's placed, Timeout elapses, or ctx is done.
+// The token file is deleted once it's read, and the server coalesces concurrent requests for a device into one placement at one path, so if several processes on a device
+// request a token at the same time, only the first to read the file gets it; the others time out. Run one Client per device and share its token (e.g. with a FileCache) instead
+func (c *Client) GetToken(ctx context.Context) (string, error) {
+	token, _, err := c.getToken(ctx)
+	return token, err
+}
+
 // GetToken retrieves a token from the device attestation service. GetToken will retry with exponential backoff until timeout
 func GetToken(url string, timeout time.Duration) (string, error) {
+	return NewClient(url, timeout).GetToken(context.Background())
+}
+
+// getToken retrieves a token from the device attestation service and returns it with when it expires.
+// The expiry is read from the server's response or the token's exp claim if it's a JWT. If it isn't known, expires is zero
+func (c *Client) getToken(ctx context.Context) (token string, expires time.Time, err error) {
 	type request struct {
-		Identifier string `json:"identifier"`
+		Identifier     string `json:"identifier"`
+		IdentifierType string `json:"identifier_type,omitempty"`
 	}
 
 	type response struct {
-		Path string `json:"path"`
+		Path      string     `json:"path"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	hc, err := c.client()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not create http client: %w", err)
 	}
 
-	serial, err := macserial.Get()
+	var provider IdentifierProvider = SerialProvider{}
+	if c.Identifier != nil {
+		provider = c.Identifier
+	}
+	identifier, typ, err := provider.Identifier(ctx)
 	if err != nil {
-		return "", fmt.Errorf("could not get serial: %w", err)
+		return "", time.Time{}, fmt.Errorf("could not get identifier: %w", err)
 	}
-	if serial == "" {
-		return "", fmt.Errorf("could not get serial: %w", errors.New("serial is empty"))
+
+	body, err := json.Marshal(&request{Identifier: identifier, IdentifierType: typ})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not marshal request: %w", err)
 	}
 
-	req, err := json.Marshal(&request{Identifier: serial})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("could not marshal request: %w", err)
+		return "", time.Time{}, fmt.Errorf("could not create request: %w", err)
+	}
+	for k, v := range c.Header {
+		req.Header[k] = append([]string(nil), v...)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	ua := c.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
 
-	res, err := http.Post(url, "application/json", bytes.NewBuffer(req))
+	res, err := hc.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("could not perform request: %w", err)
+		return "", time.Time{}, fmt.Errorf("could not perform request: %w", err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", time.Time{}, fmt.Errorf("could not place token: %w", newStatusError(res))
+	}
+
 	resp := new(response)
 	d := json.NewDecoder(res.Body)
 	if err = d.Decode(resp); err != nil {
-		return "", fmt.Errorf("could not parse response: %w", err)
+		return "", time.Time{}, fmt.Errorf("could not parse response: %w", err)
 	}
 
-	// wait initially for token to be placed
-	time.Sleep(5 * time.Second)
+	if err = validatePath(resp.Path, PlacementDir); err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid token path: %w", err)
+	}
 
-	// try to get token with exponential backoff
-	var token string
-	b := backoff.NewExponentialBackOff()
-	b.InitialInterval = time.Second
-	b.MaxElapsedTime = timeout
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
 
+	// wait initially for token to be placed
+	wait := c.InitialWait
+	if wait == 0 {
+		wait = DefaultInitialWait
+	}
+	timer := time.NewTimer(wait)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return "", time.Time{}, fmt.Errorf("could not get token: %w", ctx.Err())
+	}
+
+	// try to get token with backoff. Insecure token files and unsupported platforms are never retried
+	var readErr error
 	if err = backoff.Retry(func() error {
-		buf, err := os.ReadFile(resp.Path)
-		if err != nil {
-			return fmt.Errorf("could not read token file: %w", err)
+		token, readErr = readTokenFile(resp.Path)
+		if readErr == nil {
+			return nil
 		}
-		if len(buf) == 0 {
-			return fmt.Errorf("could not read token file: %w", errors.New("token file empty"))
+		readErr = fmt.Errorf("could not read token file: %w", readErr)
+		if errors.As(readErr, new(*InsecureFileError)) || errors.As(readErr, new(*InvalidPathError)) || errors.Is(readErr, ErrUnsupportedPlatform) {
+			return backoff.Permanent(readErr)
 		}
-		token = string(buf)
-		return nil
-	}, b); err != nil {
-		return "", fmt.Errorf("could not get token: %w", err)
+		return readErr
+	}, backoff.WithContext(c.newBackoff(), ctx)); err != nil {
+		// report why the token couldn't be read instead of the context's error
+		if readErr != nil {
+			err = readErr
+		}
+		return "", time.Time{}, fmt.Errorf("could not get token: %w", err)
 	}
 
-	return token, nil
+	if resp.ExpiresAt != nil {
+		return token, *resp.ExpiresAt, nil
+	}
+	return token, jwtExpiry(token), nil
 }
 
 // SetToken will set the Authorization header for a request
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{"/var/run/attest/token", true},
+		{"/var/run/attest/sub/token", true},
+		{"/var/run/attest/", false},
+		{"/var/run/attest", false},
+		{"/var/run/attestation/token", false},
+		{"/var/run/attest/../token", false},
+		{"/var/run/attest/./token", false},
+		{"/var/run/attest//token", false},
+		{"var/run/attest/token", false},
+		{"/tmp/token", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		err := validatePath(test.path, "/var/run/attest/")
+		if test.valid && err != nil {
+			t.Errorf("validatePath(%q): expected valid, got: %v", test.path, err)
+		}
+		if !test.valid && !errors.As(err, new(*InvalidPathError)) {
+			t.Errorf("validatePath(%q): expected *InvalidPathError, got: %v", test.path, err)
+		}
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"problem", `{"type":"about:blank","title":"Forbidden","status":403,"error":"access_denied","detail":"not enrolled"}`, "unexpected status: 403 Forbidden: access_denied: not enrolled"},
+		{"legacy", `{"code":403,"description":"Forbidden"}`, "unexpected status: 403 Forbidden"},
+		{"not json", `403 Forbidden`, "unexpected status: 403 Forbidden"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: http.StatusForbidden, Body: io.NopCloser(strings.NewReader(test.body))}
+			if err := newStatusError(res); err.Error() != test.err {
+				t.Errorf("expected %q, got %q", test.err, err.Error())
+			}
+		})
+	}
+}
+
+// requireRoot skips the test unless it's running as root, since the checks require files owned by root
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("test must be run as root")
+	}
+}
+
+// placementDir sets PlacementDir to a new directory with mode 0700 for the duration of the test and returns it.
+// The test is skipped unless it's running as root, since token files must be owned by root
+func placementDir(t *testing.T) string {
+	t.Helper()
+	requireRoot(t)
+	dir := filepath.Join(t.TempDir(), "placement")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+	old := PlacementDir
+	PlacementDir = dir
+	t.Cleanup(func() { PlacementDir = old })
+	return dir
+}
+
+// testPlace is a PlaceHandler that writes tokens to files in PlacementDir with mode, or 0600 if it's zero.
+// It returns path instead if it's set, doesn't write the file if skip is set, and responds with status, or 202 if it's zero
+type testPlace struct {
+	path    string
+	skip    bool
+	mode    os.FileMode
+	status  int
+	expires *time.Time
+
+	mu         sync.Mutex
+	placements int
+	headers    []http.Header
+}
+
+func (p *testPlace) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.placements++
+	token := fmt.Sprintf("token-%d", p.placements)
+	p.headers = append(p.headers, r.Header.Clone())
+	p.mu.Unlock()
+
+	path := p.path
+	if path == "" {
+		path = filepath.Join(PlacementDir, token)
+	}
+	mode := p.mode
+	if mode == 0 {
+		mode = 0600
+	}
+	if !p.skip {
+		if err := os.WriteFile(path, []byte(token), mode); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	status := p.status
+	if status == 0 {
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "expires_at": p.expires})
+}
+
+// newTestClient returns a Client for the PlaceHandler at url that doesn't wait between reading the token
+func newTestClient(url string) *Client {
+	return &Client{
+		URL:         url,
+		InitialWait: time.Millisecond,
+		Backoff:     func() backoff.BackOff { return backoff.NewConstantBackOff(time.Millisecond) },
+	}
+}
+
+func TestClientGetToken(t *testing.T) {
+	placementDir(t)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	p := &testPlace{expires: &expires}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	c.Header = http.Header{"X-Test": {"value"}, "User-Agent": {"ignored"}}
+
+	token, exp, err := c.getToken(context.Background())
+	if err != nil {
+		t.Fatalf("could not get token: %v", err)
+	}
+	if token != "token-1" || !exp.Equal(expires) {
+		t.Errorf("expected token-1 expiring at %v, got %q expiring at %v", expires, token, exp)
+	}
+
+	h := p.headers[0]
+	if h.Get("User-Agent") != DefaultUserAgent || h.Get("X-Test") != "value" || h.Get("Content-Type") != "application/json" {
+		t.Errorf("expected default User-Agent, custom and content type headers, got: %v", h)
+	}
+
+	c.UserAgent = "test-agent"
+	if _, err = c.GetToken(context.Background()); err != nil {
+		t.Fatalf("could not get token: %v", err)
+	}
+	if ua := p.headers[1].Get("User-Agent"); ua != "test-agent" {
+		t.Errorf("expected User-Agent test-agent, got %q", ua)
+	}
+}
+
+func TestClientGetTokenStatus(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusCreated, http.StatusAccepted} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			placementDir(t)
+			srv := httptest.NewServer(&testPlace{status: status})
+			defer srv.Close()
+
+			token, _, err := newTestClient(srv.URL).getToken(context.Background())
+			if err != nil {
+				t.Fatalf("expected token for status %d, got error: %v", status, err)
+			}
+			if token != "token-1" {
+				t.Errorf("expected token-1, got %q", token)
+			}
+		})
+	}
+}
+
+func TestClientGetTokenErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		place   func(dir string) *testPlace
+		timeout time.Duration
+		cancel  bool
+		err     string
+	}{
+		{"path outside placement dir", func(dir string) *testPlace {
+			return &testPlace{path: filepath.Join(filepath.Dir(dir), "token")}
+		}, 0, false, "invalid token path"},
+		{"timeout", func(dir string) *testPlace {
+			return &testPlace{skip: true}
+		}, 20 * time.Millisecond, false, "could not read token file"},
+		{"canceled", func(dir string) *testPlace {
+			return &testPlace{skip: true}
+		}, 0, true, "context canceled"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := test.place(placementDir(t))
+			srv := httptest.NewServer(p)
+			defer srv.Close()
+
+			c := newTestClient(srv.URL)
+			c.Timeout = test.timeout
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				c.InitialWait = time.Hour
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+
+			_, err := c.GetToken(ctx)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got: %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestClientStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"status":403,"error":"access_denied","detail":"not enrolled"}`)
+	}))
+	defer srv.Close()
+
+	_, err := newTestClient(srv.URL).GetToken(context.Background())
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusForbidden || serr.Code != "access_denied" {
+		t.Errorf("expected access_denied StatusError, got: %v", err)
+	}
+}
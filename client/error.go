@@ -0,0 +1,71 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrUnsupportedPlatform is returned when token files can't be securely read on the current platform
+var ErrUnsupportedPlatform = errors.New("token files can't be verified on this platform")
+
+// StatusError is returned when the server responds with an unexpected status code
+type StatusError struct {
+	StatusCode int
+	// Code is the machine-readable error code returned by the server, if any. e.g. "invalid_token"
+	Code string
+	// Detail is the description of the error returned by the server, if any
+	Detail string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("unexpected status: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// maxErrorSize is the maximum size of an error response that will be parsed
+const maxErrorSize = 64 * 1024
+
+// newStatusError returns a StatusError for res, parsing an RFC 7807 problem or legacy error body if possible
+func newStatusError(res *http.Response) *StatusError {
+	type problem struct {
+		Error  string `json:"error"`
+		Detail string `json:"detail"`
+	}
+
+	e := &StatusError{StatusCode: res.StatusCode}
+	p := new(problem)
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxErrorSize)).Decode(p); err == nil {
+		e.Code, e.Detail = p.Error, p.Detail
+	}
+	return e
+}
+
+// InvalidPathError is returned when the server returns a token path that isn't a clean, absolute path inside PlacementDir
+type InvalidPathError struct {
+	Path string
+	Dir  string
+}
+
+func (e *InvalidPathError) Error() string {
+	return fmt.Sprintf("path is not a clean, absolute path in %s: %s", e.Dir, e.Path)
+}
+
+// InsecureFileError is returned when the token file or its directory could have been created, replaced, or read by someone other than root
+type InsecureFileError struct {
+	Path string
+	// Reason describes which check failed, e.g. "file is a symlink"
+	Reason string
+}
+
+func (e *InsecureFileError) Error() string {
+	return fmt.Sprintf("insecure token file: %s: %s", e.Reason, e.Path)
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/korylprince/macserial"
+)
+
+// Identifier types sent to the server. They match the attest.IdentifierType constants
+const (
+	IdentifierTypeSerial       = "serial"
+	IdentifierTypeUDID         = "udid"
+	IdentifierTypeHardwareUUID = "hardware_uuid"
+)
+
+// ErrEmptyIdentifier is returned by an IdentifierProvider when the identifier is empty
+var ErrEmptyIdentifier = errors.New("identifier is empty")
+
+// IdentifierProvider provides the identifier a device attests with. The server's Transformer must support its type
+type IdentifierProvider interface {
+	// Identifier returns the device's identifier and its type, e.g. IdentifierTypeSerial
+	Identifier(ctx context.Context) (identifier, typ string, err error)
+}
+
+// SerialProvider is an IdentifierProvider that returns the device's serial number. It's the default IdentifierProvider and only works on macOS
+type SerialProvider struct{}
+
+// Identifier returns the device's serial number
+func (SerialProvider) Identifier(ctx context.Context) (string, string, error) {
+	serial, err := macserial.Get()
+	if err != nil {
+		return "", "", fmt.Errorf("could not get serial: %w", err)
+	}
+	if serial == "" {
+		return "", "", fmt.Errorf("could not get serial: %w", ErrEmptyIdentifier)
+	}
+	return serial, IdentifierTypeSerial, nil
+}
+
+// StaticProvider is an IdentifierProvider that returns a fixed identifier, e.g. for testing or when the identifier is known ahead of time
+type StaticProvider struct {
+	Value string
+	// Type is the type of Value. If empty, IdentifierTypeSerial is used
+	Type string
+}
+
+// Identifier returns Value and Type
+func (p StaticProvider) Identifier(ctx context.Context) (string, string, error) {
+	if p.Value == "" {
+		return "", "", ErrEmptyIdentifier
+	}
+	if p.Type == "" {
+		return p.Value, IdentifierTypeSerial, nil
+	}
+	return p.Value, p.Type, nil
+}
+
+// FileProvider is an IdentifierProvider that reads the identifier from a file, e.g. a provisioning UDID written by an enrollment script.
+// Leading and trailing whitespace is removed
+type FileProvider struct {
+	Path string
+	// Type is the type of the identifier in the file. If empty, IdentifierTypeSerial is used
+	Type string
+}
+
+// Identifier returns the identifier read from Path and Type
+func (p FileProvider) Identifier(ctx context.Context) (string, string, error) {
+	buf, err := os.ReadFile(p.Path)
+	if err != nil {
+		return "", "", fmt.Errorf("could not read identifier: %w", err)
+	}
+	return StaticProvider{Value: strings.TrimSpace(string(buf)), Type: p.Type}.Identifier(ctx)
+}
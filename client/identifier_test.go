@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticProvider(t *testing.T) {
+	tests := []struct {
+		provider   StaticProvider
+		identifier string
+		typ        string
+		err        error
+	}{
+		{StaticProvider{Value: "serial"}, "serial", IdentifierTypeSerial, nil},
+		{StaticProvider{Value: "udid", Type: IdentifierTypeUDID}, "udid", IdentifierTypeUDID, nil},
+		{StaticProvider{Type: IdentifierTypeUDID}, "", "", ErrEmptyIdentifier},
+	}
+
+	for _, test := range tests {
+		identifier, typ, err := test.provider.Identifier(context.Background())
+		if identifier != test.identifier || typ != test.typ || !errors.Is(err, test.err) {
+			t.Errorf("%+v: expected %q, %q, %v, got %q, %q, %v", test.provider, test.identifier, test.typ, test.err, identifier, typ, err)
+		}
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("could not write file: %v", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		identifier string
+		err        error
+	}{
+		{"valid", write("valid", " udid\n"), "udid", nil},
+		{"empty", write("empty", "\n"), "", ErrEmptyIdentifier},
+		{"missing", filepath.Join(dir, "missing"), "", os.ErrNotExist},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identifier, typ, err := FileProvider{Path: test.path, Type: IdentifierTypeUDID}.Identifier(context.Background())
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if identifier != test.identifier || (err == nil && typ != IdentifierTypeUDID) {
+				t.Errorf("expected %q of type %s, got %q of type %s", test.identifier, IdentifierTypeUDID, identifier, typ)
+			}
+		})
+	}
+}
+
+func TestClientIdentifier(t *testing.T) {
+	var body map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	c.Identifier = StaticProvider{Value: "udid", Type: IdentifierTypeUDID}
+	c.GetToken(context.Background())
+	if body["identifier"] != "udid" || body["identifier_type"] != IdentifierTypeUDID {
+		t.Errorf("expected udid identifier, got: %v", body)
+	}
+
+	c.Identifier = StaticProvider{}
+	if _, err := c.GetToken(context.Background()); !errors.Is(err, ErrEmptyIdentifier) {
+		t.Errorf("expected ErrEmptyIdentifier, got %v", err)
+	}
+}
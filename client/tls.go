@@ -0,0 +1,73 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrPinMismatch is returned when none of the server's certificates match Client.SPKIPins
+var ErrPinMismatch = errors.New("no certificate matches pinned public keys")
+
+// SPKIPin returns the pin of cert for use in Client.SPKIPins: the base64 encoded SHA-256 hash of its Subject Public Key Info (as used by HPKP)
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins returns a tls.Config.VerifyConnection func that requires a certificate in the verified chain to match one of pins
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	set := make(map[string]struct{}, len(pins))
+	for _, p := range pins {
+		set[p] = struct{}{}
+	}
+	return func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if _, ok := set[SPKIPin(cert)]; ok {
+					return nil
+				}
+			}
+		}
+		return ErrPinMismatch
+	}
+}
+
+// newHTTPClient returns base with its TLS configuration changed to use roots and pins. If base is nil, http.DefaultClient is used.
+// base's Transport must be nil or an *http.Transport
+func newHTTPClient(base *http.Client, roots *x509.CertPool, pins []string) (*http.Client, error) {
+	if base == nil {
+		base = http.DefaultClient
+	}
+	if roots == nil && len(pins) == 0 {
+		return base, nil
+	}
+
+	var tr *http.Transport
+	switch t := base.Transport.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = t.Clone()
+	default:
+		return nil, fmt.Errorf("can't set TLS configuration on transport of type %T", base.Transport)
+	}
+
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if roots != nil {
+		tr.TLSClientConfig.RootCAs = roots
+	}
+	if len(pins) > 0 {
+		tr.TLSClientConfig.VerifyConnection = verifyPins(pins)
+	}
+
+	c := *base
+	c.Transport = tr
+	return &c, nil
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	// rejected handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	cert := srv.Certificate()
+	pool := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	tests := []struct {
+		name string
+		// modify configures the Client
+		modify func(c *Client)
+		// status is true if the request should reach the server
+		status bool
+		err    error
+	}{
+		{"untrusted", func(c *Client) {}, false, nil},
+		{"root CAs", func(c *Client) { c.RootCAs = pool }, true, nil},
+		{"pinned", func(c *Client) { c.RootCAs, c.SPKIPins = pool, []string{"other", SPKIPin(cert)} }, true, nil},
+		{"pin mismatch", func(c *Client) { c.RootCAs, c.SPKIPins = pool, []string{"other"} }, false, ErrPinMismatch},
+		{"custom transport", func(c *Client) {
+			c.RootCAs = pool
+			c.HTTPClient = &http.Client{Transport: http.NewFileTransport(http.Dir("."))}
+		}, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient(srv.URL)
+			test.modify(c)
+
+			_, err := c.GetToken(context.Background())
+			var serr *StatusError
+			if reached := errors.As(err, &serr); reached != test.status {
+				t.Fatalf("expected request to reach server: %t, got: %v", test.status, err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got: %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	base := &http.Client{Transport: &http.Transport{}}
+	if c, err := newHTTPClient(base, nil, nil); err != nil || c != base {
+		t.Errorf("expected base client to be used unchanged, got %v, %v", c, err)
+	}
+
+	c, err := newHTTPClient(base, nil, []string{"pin"})
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	if c == base || c.Transport == base.Transport {
+		t.Error("expected base client to be cloned")
+	}
+}
@@ -0,0 +1,151 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// errEmptyToken is returned when the token file is empty. The token may not have been written yet, so it's retried
+var errEmptyToken = errors.New("token file empty")
+
+// checkOwner returns an *InsecureFileError if fi isn't owned by root or has more than one link
+func checkOwner(path string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return &InsecureFileError{Path: path, Reason: "could not get owner"}
+	}
+	if st.Uid != 0 {
+		return &InsecureFileError{Path: path, Reason: fmt.Sprintf("owned by uid %d instead of root", st.Uid)}
+	}
+	if !fi.IsDir() && st.Nlink != 1 {
+		return &InsecureFileError{Path: path, Reason: fmt.Sprintf("file has %d links", st.Nlink)}
+	}
+	return nil
+}
+
+// checkDir returns an *InsecureFileError if dir isn't a directory owned by root with mode 0700, like the postinstall script requires
+func checkDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("could not stat directory: %w", err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return &InsecureFileError{Path: dir, Reason: "directory is a symlink"}
+	}
+	if !fi.IsDir() {
+		return &InsecureFileError{Path: dir, Reason: "not a directory"}
+	}
+	if fi.Mode().Perm() != 0700 {
+		return &InsecureFileError{Path: dir, Reason: fmt.Sprintf("directory has mode %#o instead of 0700", fi.Mode().Perm())}
+	}
+	return checkOwner(dir, fi)
+}
+
+// checkFile returns an *InsecureFileError if fi isn't a regular file owned by root with mode 0600
+func checkFile(path string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return &InsecureFileError{Path: path, Reason: "file is a symlink"}
+	}
+	if !fi.Mode().IsRegular() {
+		return &InsecureFileError{Path: path, Reason: "not a regular file"}
+	}
+	if fi.Mode().Perm() != 0600 {
+		return &InsecureFileError{Path: path, Reason: fmt.Sprintf("file has mode %#o instead of 0600", fi.Mode().Perm())}
+	}
+	return checkOwner(path, fi)
+}
+
+// openFile opens path with flag after checking it's a regular file owned by root with mode 0600. If the file doesn't exist, the returned error wraps os.ErrNotExist.
+// Failed checks return an *InsecureFileError
+func openFile(path string, flag int) (*os.File, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat file: %w", err)
+	}
+	if err = checkFile(path, fi); err != nil {
+		return nil, err
+	}
+
+	// O_NOFOLLOW and comparing with the Lstat result make sure the file wasn't swapped after it was checked.
+	// O_NONBLOCK keeps a swapped in FIFO from blocking the open
+	f, err := os.OpenFile(path, flag|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ELOOP) {
+			return nil, &InsecureFileError{Path: path, Reason: "file is a symlink"}
+		}
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+
+	ffi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not stat file: %w", err)
+	}
+	if !os.SameFile(fi, ffi) {
+		f.Close()
+		return nil, &InsecureFileError{Path: path, Reason: "file was replaced while opening"}
+	}
+	if err = checkFile(path, ffi); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readTokenFile verifies path is inside PlacementDir and that it and its directory can only have been written by root, then reads the token and securely deletes the file.
+// Requests coalesced by the server share a path, so the file can only be read by one of them (see Client.GetToken).
+// If the file doesn't exist yet or is empty, the returned error wraps os.ErrNotExist or errEmptyToken. Failed checks return an *InvalidPathError or *InsecureFileError
+func readTokenFile(path string) (string, error) {
+	if err := validatePath(path, PlacementDir); err != nil {
+		return "", err
+	}
+
+	if err := checkDir(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+
+	f, err := openFile(path, os.O_RDWR)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(f, maxTokenSize+1))
+	if err != nil {
+		return "", fmt.Errorf("could not read file: %w", err)
+	}
+	if len(buf) == 0 {
+		return "", errEmptyToken
+	}
+	if len(buf) > maxTokenSize {
+		return "", &InsecureFileError{Path: path, Reason: "file is too large"}
+	}
+
+	if err = shred(f, path, int64(len(buf))); err != nil {
+		return "", fmt.Errorf("could not delete file: %w", err)
+	}
+
+	return string(buf), nil
+}
+
+// shred overwrites the first size bytes of f with zeros, syncs it, and removes it from path
+func shred(f *os.File, path string, size int64) error {
+	if _, err := f.WriteAt(make([]byte, size), 0); err != nil {
+		return fmt.Errorf("could not overwrite file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync file: %w", err)
+	}
+	// the postinstall script may have already cleaned it up
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove file: %w", err)
+	}
+	return nil
+}
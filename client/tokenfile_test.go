@@ -0,0 +1,159 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, data string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), mode); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatalf("could not chmod file: %v", err)
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	requireRoot(t)
+
+	tests := []struct {
+		name string
+		// setup creates the token file at path in dir, and returns the path to read
+		setup func(t *testing.T, dir, path string) string
+		// err is the expected error: an *InsecureFileError or *InvalidPathError to check the type, or a sentinel error
+		err error
+	}{
+		{"valid", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, "token", 0600)
+			return path
+		}, nil},
+		{"missing", func(t *testing.T, dir, path string) string {
+			return path
+		}, os.ErrNotExist},
+		{"empty", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, "", 0600)
+			return path
+		}, errEmptyToken},
+		{"too large", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, string(make([]byte, maxTokenSize+1)), 0600)
+			return path
+		}, new(InsecureFileError)},
+		{"outside placement dir", func(t *testing.T, dir, path string) string {
+			other := filepath.Join(filepath.Dir(dir), "token")
+			writeFile(t, other, "token", 0600)
+			return other
+		}, new(InvalidPathError)},
+		{"unclean path", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, "token", 0600)
+			return filepath.Join(dir, "sub") + "/../token"
+		}, new(InvalidPathError)},
+		{"file mode", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, "token", 0644)
+			return path
+		}, new(InsecureFileError)},
+		{"directory mode", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, "token", 0600)
+			if err := os.Chmod(dir, 0755); err != nil {
+				t.Fatalf("could not chmod directory: %v", err)
+			}
+			return path
+		}, new(InsecureFileError)},
+		{"file owner", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, "token", 0600)
+			if err := os.Chown(path, 1, 1); err != nil {
+				t.Fatalf("could not chown file: %v", err)
+			}
+			return path
+		}, new(InsecureFileError)},
+		{"directory owner", func(t *testing.T, dir, path string) string {
+			writeFile(t, path, "token", 0600)
+			if err := os.Chown(dir, 1, 1); err != nil {
+				t.Fatalf("could not chown directory: %v", err)
+			}
+			return path
+		}, new(InsecureFileError)},
+		{"symlink", func(t *testing.T, dir, path string) string {
+			target := filepath.Join(dir, "target")
+			writeFile(t, target, "token", 0600)
+			if err := os.Symlink(target, path); err != nil {
+				t.Fatalf("could not create symlink: %v", err)
+			}
+			return path
+		}, new(InsecureFileError)},
+		{"hard link", func(t *testing.T, dir, path string) string {
+			target := filepath.Join(dir, "target")
+			writeFile(t, target, "token", 0600)
+			if err := os.Link(target, path); err != nil {
+				t.Fatalf("could not create link: %v", err)
+			}
+			return path
+		}, new(InsecureFileError)},
+		{"fifo", func(t *testing.T, dir, path string) string {
+			if err := syscall.Mkfifo(path, 0600); err != nil {
+				t.Fatalf("could not create fifo: %v", err)
+			}
+			return path
+		}, new(InsecureFileError)},
+		{"directory", func(t *testing.T, dir, path string) string {
+			if err := os.Mkdir(path, 0600); err != nil {
+				t.Fatalf("could not create directory: %v", err)
+			}
+			return path
+		}, new(InsecureFileError)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := placementDir(t)
+			path := test.setup(t, dir, filepath.Join(dir, "token"))
+
+			token, err := readTokenFile(path)
+			switch test.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("could not read token: %v", err)
+				}
+				if token != "token" {
+					t.Errorf("expected token %q, got %q", "token", token)
+				}
+				if _, err = os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("expected token file to be deleted, got: %v", err)
+				}
+			case *InsecureFileError:
+				if !errors.As(err, new(*InsecureFileError)) {
+					t.Errorf("expected InsecureFileError, got: %v", err)
+				}
+			case *InvalidPathError:
+				if !errors.As(err, new(*InvalidPathError)) {
+					t.Errorf("expected InvalidPathError, got: %v", err)
+				}
+			default:
+				if !errors.Is(err, test.err) {
+					t.Errorf("expected %v, got: %v", test.err, err)
+				}
+			}
+		})
+	}
+}
+
+func TestClientInsecureTokenFile(t *testing.T) {
+	requireRoot(t)
+	placementDir(t)
+	srv := httptest.NewServer(&testPlace{mode: 0644})
+	defer srv.Close()
+
+	// insecure token files aren't retried, so this doesn't wait for a timeout
+	if _, err := newTestClient(srv.URL).GetToken(context.Background()); !errors.As(err, new(*InsecureFileError)) {
+		t.Errorf("expected InsecureFileError, got: %v", err)
+	}
+}
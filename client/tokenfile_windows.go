@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package client
+
+import "os"
+
+// checkDir returns ErrUnsupportedPlatform, since the directory's owner can't be verified on Windows
+func checkDir(dir string) error {
+	return ErrUnsupportedPlatform
+}
+
+// openFile returns ErrUnsupportedPlatform, since the file's owner can't be verified on Windows
+func openFile(path string, flag int) (*os.File, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// readTokenFile returns ErrUnsupportedPlatform, since the token file's owner can't be verified on Windows
+func readTokenFile(path string) (string, error) {
+	return "", ErrUnsupportedPlatform
+}
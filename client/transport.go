@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxDrainSize is the maximum number of bytes read from a rejected response's body so its connection can be reused
+const maxDrainSize = 4096
+
+// Transport is an http.RoundTripper that authenticates requests with a token from the device attestation service.
+// The token is retrieved with Client on first use and attached to every request, and renewed shortly before it expires. If a request is rejected with 401 Unauthorized,
+// Transport drops the token and gets a new one once, replaying the request if it's idempotent. Otherwise the 401 response is returned and the next request gets a new token.
+// Concurrent requests share a single re-attestation.
+// Transport must be used by a process running as root, since tokens are only readable by root
+type Transport struct {
+	// URL is the URL of the service's PlaceHandler. It's ignored if Client is set
+	URL string
+	// Timeout is how long to wait for a token to be placed. It's ignored if Client is set
+	Timeout time.Duration
+	// Client, if set, is used to get tokens, e.g. to use a custom HTTP client or TLS pinning. If nil, a Client with URL and Timeout is used
+	Client *Client
+	// Base is the RoundTripper used to make requests. If nil, http.DefaultTransport is used
+	Base http.RoundTripper
+	// Cache, if set, is used to reuse a token across restarts instead of starting a new placement
+	Cache TokenCache
+
+	once   sync.Once
+	client *Client
+	// sem serializes getting tokens. It's a channel instead of a sync.Mutex so waiting requests can be canceled
+	sem     chan struct{}
+	loaded  bool
+	token   string
+	expires time.Time
+}
+
+// NewTransport returns a new Transport that gets tokens from the PlaceHandler at url, waiting up to timeout for each token to be placed
+func NewTransport(url string, timeout time.Duration) *Transport {
+	return &Transport{URL: url, Timeout: timeout}
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// getToken returns the current token, getting a new one if there isn't one, it expires soon, or it's rejected. rejected is the token that was rejected, if any.
+// If another request already replaced rejected, its token is returned without re-attesting
+func (t *Transport) getToken(ctx context.Context, rejected string) (string, error) {
+	t.once.Do(func() {
+		t.sem = make(chan struct{}, 1)
+		t.client = t.Client
+		if t.client == nil {
+			t.client = NewClient(t.URL, t.Timeout)
+		}
+	})
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-t.sem }()
+
+	// an unreadable cache only costs a new placement
+	if !t.loaded && t.Cache != nil {
+		t.token, t.expires, _ = t.Cache.Load()
+	}
+	t.loaded = true
+
+	if t.token != "" && t.token != rejected && usable(t.expires) {
+		return t.token, nil
+	}
+
+	if err := t.drop(); err != nil {
+		return "", err
+	}
+
+	token, expires, err := t.client.getToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.token, t.expires = token, expires
+
+	if t.Cache != nil {
+		if err = t.Cache.Store(token, expires); err != nil {
+			return "", fmt.Errorf("could not cache token: %w", err)
+		}
+	}
+	return token, nil
+}
+
+// drop forgets the current token and clears it from Cache. t.sem must be held
+func (t *Transport) drop() error {
+	if t.Cache != nil && t.token != "" {
+		if err := t.Cache.Clear(); err != nil {
+			return fmt.Errorf("could not clear cache: %w", err)
+		}
+	}
+	t.token, t.expires = "", time.Time{}
+	return nil
+}
+
+// invalidate drops rejected so the next request gets a new token. If another request already replaced rejected, the current token is kept
+func (t *Transport) invalidate(ctx context.Context, rejected string) error {
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-t.sem }()
+
+	if t.token != rejected {
+		return nil
+	}
+	return t.drop()
+}
+
+// idempotent returns true if r can be safely sent again. Like net/http, requests with an Idempotency-Key header are considered idempotent
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if _, ok := r.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := r.Header["X-Idempotency-Key"]
+	return ok
+}
+
+// replayable returns true if r is idempotent and its body, if any, can be read again
+func replayable(r *http.Request) bool {
+	if !idempotent(r) {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	token, err := t.getToken(ctx, "")
+	if err != nil {
+		closeBody(r)
+		return nil, fmt.Errorf("could not get token: %w", err)
+	}
+
+	req := r.Clone(ctx)
+	SetToken(req, token)
+	res, err := t.base().RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	// the rejected token is never sent again, even if the request can't be replayed
+	if !replayable(r) {
+		if err = t.invalidate(ctx, token); err != nil {
+			res.Body.Close()
+			return nil, fmt.Errorf("could not drop rejected token: %w", err)
+		}
+		return res, nil
+	}
+
+	// re-attest and replay the request
+	io.CopyN(io.Discard, res.Body, maxDrainSize)
+	res.Body.Close()
+
+	if token, err = t.getToken(ctx, token); err != nil {
+		return nil, fmt.Errorf("could not get new token: %w", err)
+	}
+
+	req = r.Clone(ctx)
+	if r.GetBody != nil && r.Body != nil && r.Body != http.NoBody {
+		if req.Body, err = r.GetBody(); err != nil {
+			return nil, fmt.Errorf("could not get request body: %w", err)
+		}
+	}
+	SetToken(req, token)
+	return t.base().RoundTrip(req)
+}
+
+// closeBody closes r's body, since a RoundTripper must always close the body, even on errors
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
@@ -0,0 +1,297 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testAPI is an API that rejects the token "stale" and records the tokens and bodies it receives
+type testAPI struct {
+	mu       sync.Mutex
+	requests []string
+	bodies   []string
+}
+
+func (a *testAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	a.mu.Lock()
+	a.requests = append(a.requests, token)
+	a.bodies = append(a.bodies, string(body))
+	a.mu.Unlock()
+
+	if token == "stale" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// failingPlace is a PlaceHandler that always fails and counts its requests
+type failingPlace struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (p *failingPlace) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.requests++
+	p.mu.Unlock()
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	get := func(url string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, url, nil)
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		request func(url string) *http.Request
+		status  int
+		// err is true if the request should fail because a new token couldn't be placed
+		err bool
+		// requests are the tokens the API is expected to receive
+		requests []string
+		// placements is the number of placements expected
+		placements int
+	}{
+		{"accepted", "valid", get, http.StatusOK, false, []string{"valid"}, 0},
+		{"no token", "", get, 0, true, nil, 1},
+		{"idempotent", "stale", get, 0, true, []string{"stale"}, 1},
+		{"idempotency key", "stale", func(url string) *http.Request {
+			r, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte("body")))
+			r.Header.Set("Idempotency-Key", "key")
+			return r
+		}, 0, true, []string{"stale"}, 1},
+		{"not idempotent", "stale", func(url string) *http.Request {
+			r, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte("body")))
+			return r
+		}, http.StatusUnauthorized, false, []string{"stale"}, 0},
+		{"body not replayable", "stale", func(url string) *http.Request {
+			r, _ := http.NewRequest(http.MethodPut, url, io.NopCloser(strings.NewReader("body")))
+			return r
+		}, http.StatusUnauthorized, false, []string{"stale"}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := new(testAPI)
+			api := httptest.NewServer(a)
+			defer api.Close()
+			p := new(failingPlace)
+			place := httptest.NewServer(p)
+			defer place.Close()
+
+			tr := NewTransport(place.URL, 0)
+			tr.token = test.token
+
+			res, err := tr.RoundTrip(test.request(api.URL))
+			if test.err {
+				if err == nil {
+					res.Body.Close()
+					t.Fatal("expected error")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("could not perform request: %v", err)
+				}
+				res.Body.Close()
+				if res.StatusCode != test.status {
+					t.Errorf("expected status %d, got %d", test.status, res.StatusCode)
+				}
+			}
+
+			if strings.Join(a.requests, ",") != strings.Join(test.requests, ",") {
+				t.Errorf("expected requests with tokens %v, got %v", test.requests, a.requests)
+			}
+			if p.requests != test.placements {
+				t.Errorf("expected %d placements, got %d", test.placements, p.requests)
+			}
+		})
+	}
+}
+
+func TestTransportGetToken(t *testing.T) {
+	p := new(failingPlace)
+	place := httptest.NewServer(p)
+	defer place.Close()
+
+	tr := NewTransport(place.URL, 0)
+	tr.token = "new"
+
+	// another request already replaced the rejected token
+	token, err := tr.getToken(context.Background(), "old")
+	if err != nil || token != "new" {
+		t.Errorf("expected token new, got %q, %v", token, err)
+	}
+	if p.requests != 0 {
+		t.Errorf("expected no placements, got %d", p.requests)
+	}
+
+	// waiting for another request to get a token can be canceled
+	tr.sem <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = tr.getToken(ctx, "new"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	tests := []struct {
+		method     string
+		header     string
+		body       io.Reader
+		replayable bool
+	}{
+		{http.MethodGet, "", nil, true},
+		{http.MethodDelete, "", nil, true},
+		{http.MethodPut, "", strings.NewReader("body"), true},
+		{http.MethodPut, "", io.NopCloser(strings.NewReader("body")), false},
+		{http.MethodPost, "", strings.NewReader("body"), false},
+		{http.MethodPost, "Idempotency-Key", strings.NewReader("body"), true},
+		{http.MethodPatch, "X-Idempotency-Key", nil, true},
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, "/", test.body)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		if test.header != "" {
+			r.Header.Set(test.header, "key")
+		}
+		if replayable(r) != test.replayable {
+			t.Errorf("%s %s %T: expected replayable %t", test.method, test.header, test.body, test.replayable)
+		}
+	}
+}
+
+func TestTransportReattest(t *testing.T) {
+	placementDir(t)
+	a := new(testAPI)
+	api := httptest.NewServer(a)
+	defer api.Close()
+	p := new(testPlace)
+	place := httptest.NewServer(p)
+	defer place.Close()
+
+	tr := &Transport{Client: newTestClient(place.URL)}
+	tr.token = "stale"
+
+	r, err := http.NewRequest(http.MethodPost, api.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	r.Header.Set("Idempotency-Key", "key")
+	res, err := tr.RoundTrip(r)
+	if err != nil {
+		t.Fatalf("could not perform request: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if strings.Join(a.requests, ",") != "stale,token-1" || strings.Join(a.bodies, ",") != "body,body" {
+		t.Errorf("expected request to be replayed with new token and body, got tokens %v, bodies %v", a.requests, a.bodies)
+	}
+}
+
+func TestTransportConcurrentReattest(t *testing.T) {
+	placementDir(t)
+	a := new(testAPI)
+	api := httptest.NewServer(a)
+	defer api.Close()
+	p := new(testPlace)
+	place := httptest.NewServer(p)
+	defer place.Close()
+
+	tr := &Transport{Client: newTestClient(place.URL)}
+	tr.token = "stale"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, _ := http.NewRequest(http.MethodGet, api.URL, nil)
+			res, err := tr.RoundTrip(r)
+			if err != nil {
+				t.Errorf("could not perform request: %v", err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p.placements != 1 {
+		t.Errorf("expected requests to share one placement, got %d", p.placements)
+	}
+}
+
+func TestTransportDropsRejectedToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func(url string) *http.Request
+	}{
+		{"not idempotent", func(url string) *http.Request {
+			r, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("body"))
+			return r
+		}},
+		{"body not replayable", func(url string) *http.Request {
+			r, _ := http.NewRequest(http.MethodPut, url, io.NopCloser(strings.NewReader("body")))
+			return r
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			placementDir(t)
+			a := new(testAPI)
+			api := httptest.NewServer(a)
+			defer api.Close()
+			place := httptest.NewServer(new(testPlace))
+			defer place.Close()
+
+			cache := &memCache{token: "stale"}
+			tr := &Transport{Client: newTestClient(place.URL), Cache: cache}
+
+			res, err := tr.RoundTrip(test.request(api.URL))
+			if err != nil {
+				t.Fatalf("could not perform request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected status %d, got %d", http.StatusUnauthorized, res.StatusCode)
+			}
+			if !cache.cleared {
+				t.Error("expected rejected token to be cleared from cache")
+			}
+
+			// the rejected token is never sent again
+			res, err = tr.RoundTrip(test.request(api.URL))
+			if err != nil {
+				t.Fatalf("could not perform second request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || strings.Join(a.requests, ",") != "stale,token-1" {
+				t.Errorf("expected second request to use a new token, got status %d, tokens %v", res.StatusCode, a.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/authorizer"
+)
+
+// Duration is a time.Duration that's unmarshaled from a string, e.g. "15m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string, e.g. \"15m\": %w", err)
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// TLSConfig configures the server's TLS listener
+type TLSConfig struct {
+	// Disabled serves plain HTTP, e.g. behind a TLS terminating proxy. URL must still be https, since devices only download payloads over https
+	Disabled bool   `json:"disabled"`
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	// MinVersion is the minimum TLS version, "1.2" or "1.3". Defaults to "1.2"
+	MinVersion string `json:"min_version"`
+}
+
+// IdentityConfig configures the "Apple Developer ID Installer" identity used to sign payloads. Either P12 or Cert and Key must be set
+type IdentityConfig struct {
+	P12         string `json:"p12"`
+	P12Password string `json:"p12_password"`
+	Cert        string `json:"cert"`
+	Key         string `json:"key"`
+}
+
+// MDMConfig configures a MicroMDM server
+type MDMConfig struct {
+	// Name identifies the MDM in logs when more than one is configured
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Token     string `json:"token"`
+	CacheSize int    `json:"cache_size"`
+}
+
+// TokenStoreConfig configures the TokenStore
+type TokenStoreConfig struct {
+	// Type is "jwt" or "mem". Defaults to "jwt"
+	Type string `json:"type"`
+	// HMACKey is the base64 encoded JWT signing key. It must be at least 32 bytes
+	HMACKey      string   `json:"hmac_key"`
+	Issuer       string   `json:"issuer"`
+	Audience     []string `json:"audience"`
+	TTL          Duration `json:"ttl"`
+	RefreshGrace Duration `json:"refresh_grace"`
+	// Size is the maximum number of tokens stored by the mem TokenStore
+	Size int `json:"size"`
+}
+
+// FileStoreConfig configures the in-memory FileStore
+type FileStoreConfig struct {
+	Size int      `json:"size"`
+	TTL  Duration `json:"ttl"`
+}
+
+// PlacementConfig configures token placement
+type PlacementConfig struct {
+	Dir            string   `json:"dir"`
+	PerIdentifier  bool     `json:"per_identifier"`
+	Timeout        Duration `json:"timeout"`
+	CoalesceWindow Duration `json:"coalesce_window"`
+}
+
+// RateConfig is a token bucket rate: Burst placements at once, and one more every Interval. A zero Burst is unlimited
+type RateConfig struct {
+	Burst    int      `json:"burst"`
+	Interval Duration `json:"interval"`
+}
+
+// RateLimitConfig configures how often placements can be requested. Remote IP and global limits are checked before MDMs are queried.
+// If attestd is behind a proxy, every request comes from the proxy's IP, so remote_ip should be disabled (burst 0)
+type RateLimitConfig struct {
+	// CacheSize is the maximum number of identifiers and IPs tracked
+	CacheSize  int        `json:"cache_size"`
+	Identifier RateConfig `json:"identifier"`
+	RemoteIP   RateConfig `json:"remote_ip"`
+	Global     RateConfig `json:"global"`
+	// Cooldown is how long a device must wait after a successful placement before another is allowed
+	Cooldown Duration `json:"cooldown"`
+}
+
+// AuthorizerConfig configures which devices can be attested. Lists and patterns match either the identifier sent by the client or the UDID it's transformed to.
+// If nothing is set, every device known to an MDM is allowed
+type AuthorizerConfig struct {
+	// IdentifierTypes are the identifier types clients can send, e.g. ["serial"]. If empty, all types are allowed.
+	// Lists and patterns of client identifiers should be used with a single type, so devices can't avoid them by sending another type of identifier
+	IdentifierTypes []string `json:"identifier_types"`
+	// AllowFile and DenyFile are files with one identifier per line. If AllowFile is set, only listed devices are allowed
+	AllowFile string `json:"allow_file"`
+	DenyFile  string `json:"deny_file"`
+	// AllowPatterns and DenyPatterns are unanchored regular expressions. If AllowPatterns is set, only matching devices are allowed
+	AllowPatterns []string `json:"allow_patterns"`
+	DenyPatterns  []string `json:"deny_patterns"`
+}
+
+// MetricsConfig configures metrics
+type MetricsConfig struct {
+	// Listen is the address Prometheus metrics are served on at /metrics over plain HTTP, e.g. "127.0.0.1:9090". It should only be reachable by your monitoring system.
+	// If empty, metrics are disabled
+	Listen string `json:"listen"`
+}
+
+// Config is the attestd configuration
+type Config struct {
+	Listen string `json:"listen"`
+	// URL is the public URL the API is mounted at, e.g. https://attest.example.com/v1/attest
+	URL                string           `json:"url"`
+	Realm              string           `json:"realm"`
+	RefreshMaxLifetime Duration         `json:"refresh_max_lifetime"`
+	Debug              bool             `json:"debug"`
+	TLS                TLSConfig        `json:"tls"`
+	Identity           IdentityConfig   `json:"identity"`
+	MDM                []*MDMConfig     `json:"mdm"`
+	TokenStore         TokenStoreConfig `json:"token_store"`
+	FileStore          FileStoreConfig  `json:"file_store"`
+	Placement          PlacementConfig  `json:"placement"`
+	RateLimit          RateLimitConfig  `json:"rate_limit"`
+	Authorizer         AuthorizerConfig `json:"authorizer"`
+	// Scopes are granted to every token
+	Scopes  []string      `json:"scopes"`
+	Metrics MetricsConfig `json:"metrics"`
+}
+
+// defaultConfig returns a Config with default values
+func defaultConfig() *Config {
+	return &Config{
+		Listen:             ":443",
+		RefreshMaxLifetime: Duration(24 * time.Hour),
+		TLS:                TLSConfig{MinVersion: "1.2"},
+		TokenStore: TokenStoreConfig{
+			Type: "jwt",
+			TTL:  Duration(15 * time.Minute),
+			Size: 10000,
+		},
+		FileStore: FileStoreConfig{Size: 100, TTL: Duration(5 * time.Minute)},
+		Placement: PlacementConfig{
+			Timeout:        Duration(5 * time.Minute),
+			CoalesceWindow: Duration(2 * time.Minute),
+		},
+		RateLimit: RateLimitConfig{
+			CacheSize:  10000,
+			Identifier: RateConfig{Burst: 2, Interval: Duration(5 * time.Minute)},
+			RemoteIP:   RateConfig{Burst: 10, Interval: Duration(time.Minute)},
+			Global:     RateConfig{Burst: 10, Interval: Duration(time.Second)},
+			Cooldown:   Duration(5 * time.Minute),
+		},
+	}
+}
+
+// env maps environment variables to the settings they override. Secrets should be set with environment variables instead of the config file
+func (c *Config) env() map[string]*string {
+	m := map[string]*string{
+		"ATTESTD_LISTEN":                &c.Listen,
+		"ATTESTD_URL":                   &c.URL,
+		"ATTESTD_TLS_CERT":              &c.TLS.Cert,
+		"ATTESTD_TLS_KEY":               &c.TLS.Key,
+		"ATTESTD_IDENTITY_P12":          &c.Identity.P12,
+		"ATTESTD_IDENTITY_P12_PASSWORD": &c.Identity.P12Password,
+		"ATTESTD_IDENTITY_CERT":         &c.Identity.Cert,
+		"ATTESTD_IDENTITY_KEY":          &c.Identity.Key,
+		"ATTESTD_HMAC_KEY":              &c.TokenStore.HMACKey,
+	}
+	if len(c.MDM) <= 1 {
+		if len(c.MDM) == 0 {
+			c.MDM = []*MDMConfig{{}}
+		}
+		m["ATTESTD_MDM_URL"] = &c.MDM[0].URL
+		m["ATTESTD_MDM_TOKEN"] = &c.MDM[0].Token
+		return m
+	}
+	for _, mc := range c.MDM {
+		if mc.Name != "" {
+			m[mc.tokenEnv()] = &mc.Token
+		}
+	}
+	return m
+}
+
+// tokenEnv returns the environment variable that overrides the token of an MDM when more than one is configured, e.g. ATTESTD_MDM_US_TOKEN for the MDM named "us"
+func (c *MDMConfig) tokenEnv() string {
+	return "ATTESTD_MDM_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, c.Name) + "_TOKEN"
+}
+
+// LoadConfig reads the JSON config file at path, if path isn't empty, and applies environment variable overrides
+func LoadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open config: %w", err)
+		}
+		defer f.Close()
+
+		d := json.NewDecoder(f)
+		d.DisallowUnknownFields()
+		if err = d.Decode(c); err != nil {
+			return nil, fmt.Errorf("could not parse config %s: %w", path, err)
+		}
+	}
+
+	for name, dst := range c.env() {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+
+	return c, nil
+}
+
+// ValidationError lists every problem found in a Config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate checks c for problems, including that referenced files exist. All problems are returned in a *ValidationError
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	checkFile := func(name, path, env string) {
+		if path == "" {
+			add("%s is required (or set %s)", name, env)
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			add("%s: could not read %s: %v", name, path, err)
+		}
+	}
+
+	if c.Listen == "" {
+		add("listen is required, e.g. \":443\" (or set ATTESTD_LISTEN)")
+	}
+
+	if c.URL == "" {
+		add("url is required: the public URL the API is mounted at, e.g. https://attest.example.com/v1/attest (or set ATTESTD_URL)")
+	} else if u, err := url.Parse(c.URL); err != nil {
+		add("url: could not parse %q: %v", c.URL, err)
+	} else if u.Scheme != "https" || u.Host == "" {
+		add("url must be an absolute https URL, since devices only install payloads downloaded over https: %q", c.URL)
+	} else if u.RawQuery != "" || u.Fragment != "" {
+		add("url must not have a query or fragment: %q", c.URL)
+	}
+
+	if !c.TLS.Disabled {
+		checkFile("tls.cert", c.TLS.Cert, "ATTESTD_TLS_CERT")
+		checkFile("tls.key", c.TLS.Key, "ATTESTD_TLS_KEY")
+		if c.TLS.MinVersion != "1.2" && c.TLS.MinVersion != "1.3" {
+			add("tls.min_version must be \"1.2\" or \"1.3\", got %q", c.TLS.MinVersion)
+		}
+	}
+
+	switch {
+	case c.Identity.P12 != "" && (c.Identity.Cert != "" || c.Identity.Key != ""):
+		add("identity: set either p12 or cert and key, not both")
+	case c.Identity.P12 != "":
+		checkFile("identity.p12", c.Identity.P12, "ATTESTD_IDENTITY_P12")
+	case c.Identity.Cert != "" || c.Identity.Key != "":
+		checkFile("identity.cert", c.Identity.Cert, "ATTESTD_IDENTITY_CERT")
+		checkFile("identity.key", c.Identity.Key, "ATTESTD_IDENTITY_KEY")
+	default:
+		add("identity is required: set identity.p12 (ATTESTD_IDENTITY_P12) or identity.cert and identity.key (ATTESTD_IDENTITY_CERT and ATTESTD_IDENTITY_KEY) to an \"Apple Developer ID Installer\" identity")
+	}
+
+	if len(c.MDM) == 0 {
+		add("mdm: at least one MDM is required (or set ATTESTD_MDM_URL and ATTESTD_MDM_TOKEN)")
+	}
+	names := make(map[string]bool)
+	// envs maps token environment variables to the first MDM name that uses them, since names like "us-east" and "us_east" share one
+	envs := make(map[string]string)
+	for i, m := range c.MDM {
+		if m.URL == "" && len(c.MDM) == 1 {
+			add("mdm[%d].url is required, e.g. https://mdm.example.com (or set ATTESTD_MDM_URL)", i)
+		} else if m.URL == "" {
+			add("mdm[%d].url is required, e.g. https://mdm.example.com", i)
+		} else if u, err := url.Parse(m.URL); err != nil || !u.IsAbs() || u.Host == "" {
+			add("mdm[%d].url must be an absolute URL, got %q", i, m.URL)
+		}
+		if m.Token == "" && len(c.MDM) == 1 {
+			add("mdm[%d].token is required (or set ATTESTD_MDM_TOKEN)", i)
+		} else if m.Token == "" && m.Name != "" {
+			add("mdm[%d].token is required (or set %s)", i, m.tokenEnv())
+		} else if m.Token == "" {
+			add("mdm[%d].token is required", i)
+		}
+		if m.CacheSize < 0 {
+			add("mdm[%d].cache_size must not be negative", i)
+		}
+		if len(c.MDM) > 1 {
+			if m.Name == "" {
+				add("mdm[%d].name is required when more than one MDM is configured", i)
+			} else if names[m.Name] {
+				add("mdm[%d].name %q is used more than once", i, m.Name)
+			} else if other, ok := envs[m.tokenEnv()]; ok {
+				add("mdm[%d].name %q has the same token environment variable %s as %q", i, m.Name, m.tokenEnv(), other)
+			} else {
+				envs[m.tokenEnv()] = m.Name
+			}
+			names[m.Name] = true
+		}
+	}
+
+	ts := c.TokenStore
+	switch ts.Type {
+	case "jwt":
+		if ts.HMACKey == "" {
+			add("token_store.hmac_key is required for the jwt token store: generate one with `openssl rand -base64 32` (or set ATTESTD_HMAC_KEY)")
+		} else if key, err := base64.StdEncoding.DecodeString(ts.HMACKey); err != nil {
+			add("token_store.hmac_key must be base64 encoded: %v", err)
+		} else if len(key) < 32 {
+			add("token_store.hmac_key must be at least 32 bytes, got %d", len(key))
+		}
+	case "mem":
+		if ts.Size <= 0 {
+			add("token_store.size must be positive")
+		}
+	default:
+		add("token_store.type must be \"jwt\" or \"mem\", got %q", ts.Type)
+	}
+	if ts.TTL <= 0 {
+		add("token_store.ttl must be positive")
+	}
+	if ts.RefreshGrace < 0 {
+		add("token_store.refresh_grace must not be negative")
+	}
+	if c.RefreshMaxLifetime < 0 {
+		add("refresh_max_lifetime must not be negative")
+	}
+
+	if c.FileStore.Size <= 0 {
+		add("file_store.size must be positive")
+	}
+	if c.FileStore.TTL <= 0 {
+		add("file_store.ttl must be positive")
+	}
+
+	if c.Placement.Dir != "" && (!filepath.IsAbs(c.Placement.Dir) || filepath.Clean(c.Placement.Dir) == "/") {
+		add("placement.dir must be an absolute path other than /, got %q", c.Placement.Dir)
+	}
+	if c.Placement.Timeout <= 0 {
+		add("placement.timeout must be positive")
+	}
+	if c.Placement.CoalesceWindow < 0 {
+		add("placement.coalesce_window must not be negative")
+	}
+
+	rl := c.RateLimit
+	if rl.CacheSize <= 0 {
+		add("rate_limit.cache_size must be positive")
+	}
+	for _, r := range []struct {
+		name string
+		rate RateConfig
+	}{{"identifier", rl.Identifier}, {"remote_ip", rl.RemoteIP}, {"global", rl.Global}} {
+		if r.rate.Burst < 0 {
+			add("rate_limit.%s.burst must not be negative", r.name)
+		} else if r.rate.Burst > 0 && r.rate.Interval <= 0 {
+			add("rate_limit.%s.interval must be positive", r.name)
+		}
+	}
+	if rl.Cooldown < 0 {
+		add("rate_limit.cooldown must not be negative")
+	}
+
+	a := c.Authorizer
+	for i, typ := range a.IdentifierTypes {
+		if typ == "" || strings.Trim(typ, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+			add("authorizer.identifier_types[%d] must be a lowercase identifier type, e.g. \"serial\", got %q", i, typ)
+		}
+	}
+	if a.AllowFile != "" {
+		checkFile("authorizer.allow_file", a.AllowFile, "")
+	}
+	if a.DenyFile != "" {
+		checkFile("authorizer.deny_file", a.DenyFile, "")
+	}
+	if _, err := authorizer.NewRegexp(a.AllowPatterns, a.DenyPatterns); err != nil {
+		add("authorizer: %v", err)
+	}
+
+	if c.Metrics.Listen != "" && c.Metrics.Listen == c.Listen {
+		add("metrics.listen must be different from listen, since metrics should only be reachable by your monitoring system")
+	}
+
+	for i, scope := range c.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \"\\") {
+			add("scopes[%d] must not be empty or contain spaces, quotes, or backslashes, got %q", i, scope)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigExample(t *testing.T) {
+	t.Setenv("ATTESTD_MDM_US_TOKEN", "us-token")
+	t.Setenv("ATTESTD_HMAC_KEY", "key")
+
+	c, err := LoadConfig("attestd.example.json")
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	if c.URL != "https://attest.example.com/v1/attest" || c.Listen != ":443" {
+		t.Errorf("expected url and listen from file, got %q and %q", c.URL, c.Listen)
+	}
+	if time.Duration(c.TokenStore.RefreshGrace) != 5*time.Minute {
+		t.Errorf("expected refresh grace 5m, got %v", time.Duration(c.TokenStore.RefreshGrace))
+	}
+	if len(c.MDM) != 2 || c.MDM[0].Token != "us-token" || c.MDM[1].Token != "" {
+		t.Errorf("expected us token from environment, got: %+v, %+v", c.MDM[0], c.MDM[1])
+	}
+	if c.TokenStore.HMACKey != "key" {
+		t.Errorf("expected hmac key from environment, got %q", c.TokenStore.HMACKey)
+	}
+	if c.RateLimit.Identifier.Burst != 2 || time.Duration(c.RateLimit.Cooldown) != 5*time.Minute {
+		t.Errorf("expected rate limits from file, got: %+v", c.RateLimit)
+	}
+	if len(c.Authorizer.IdentifierTypes) != 1 || len(c.Scopes) != 1 || c.Metrics.Listen != "127.0.0.1:9090" {
+		t.Errorf("expected authorizer, scopes, and metrics from file, got: %+v, %v, %+v", c.Authorizer, c.Scopes, c.Metrics)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("ATTESTD_URL", "https://env.example.com")
+	t.Setenv("ATTESTD_MDM_URL", "https://mdm.example.com")
+	t.Setenv("ATTESTD_MDM_TOKEN", "token")
+
+	c, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	if c.URL != "https://env.example.com" {
+		t.Errorf("expected url from environment, got %q", c.URL)
+	}
+	if len(c.MDM) != 1 || c.MDM[0].URL != "https://mdm.example.com" || c.MDM[0].Token != "token" {
+		t.Errorf("expected MDM from environment, got: %+v", c.MDM)
+	}
+	if c.TokenStore.Type != "jwt" || time.Duration(c.TokenStore.TTL) != 15*time.Minute {
+		t.Errorf("expected defaults, got: %+v", c.TokenStore)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"unknown field", `{"unknown": true}`},
+		{"invalid duration", `{"token_store": {"ttl": "15 minutes"}}`},
+		{"numeric duration", `{"token_store": {"ttl": 900}}`},
+		{"invalid json", `{`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "attestd.json")
+			if err := os.WriteFile(path, []byte(test.config), 0600); err != nil {
+				t.Fatalf("could not write config: %v", err)
+			}
+			if _, err := LoadConfig(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for missing config")
+	}
+}
+
+func TestTokenEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+	}{
+		{"us", "ATTESTD_MDM_US_TOKEN"},
+		{"us-east.1", "ATTESTD_MDM_US_EAST_1_TOKEN"},
+		{"EU2", "ATTESTD_MDM_EU2_TOKEN"},
+	}
+
+	for _, test := range tests {
+		if env := (&MDMConfig{Name: test.name}).tokenEnv(); env != test.env {
+			t.Errorf("%s: expected %s, got %s", test.name, test.env, env)
+		}
+	}
+}
+
+// validConfig returns a Config that passes Validate, with files in a temporary directory
+func validConfig(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	file := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatalf("could not write file: %v", err)
+		}
+		return path
+	}
+
+	c := defaultConfig()
+	c.URL = "https://attest.example.com/v1"
+	c.TLS.Cert, c.TLS.Key = file("tls.crt"), file("tls.key")
+	c.Identity.P12 = file("identity.p12")
+	c.MDM = []*MDMConfig{{URL: "https://mdm.example.com", Token: "token"}}
+	c.TokenStore.HMACKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(c *Config)
+		problems []string
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"tls disabled", func(c *Config) { c.TLS = TLSConfig{Disabled: true} }, nil},
+		{"http url", func(c *Config) { c.URL = "http://attest.example.com" }, []string{"url must be an absolute https URL"}},
+		{"relative url", func(c *Config) { c.URL = "/v1" }, []string{"url must be an absolute https URL"}},
+		{"url query", func(c *Config) { c.URL = "https://attest.example.com/?a=b" }, []string{"url must not have a query"}},
+		{"missing tls files", func(c *Config) { c.TLS.Cert, c.TLS.Key = "", "/nonexistent" }, []string{"tls.cert is required", "tls.key: could not read"}},
+		{"tls version", func(c *Config) { c.TLS.MinVersion = "1.1" }, []string{"tls.min_version"}},
+		{"p12 and cert", func(c *Config) { c.Identity.Cert = c.TLS.Cert }, []string{"identity: set either p12 or cert and key"}},
+		{"no identity", func(c *Config) { c.Identity = IdentityConfig{} }, []string{"identity is required"}},
+		{"no mdm", func(c *Config) { c.MDM = nil }, []string{"mdm: at least one MDM is required"}},
+		{"mdm", func(c *Config) { c.MDM[0] = &MDMConfig{URL: "mdm.example.com", CacheSize: -1} }, []string{
+			"mdm[0].url must be an absolute URL", "mdm[0].token is required (or set ATTESTD_MDM_TOKEN)", "mdm[0].cache_size",
+		}},
+		{"multiple mdms", func(c *Config) {
+			c.MDM = []*MDMConfig{{URL: "https://a.example.com", Token: "token"}, {Name: "b", URL: "https://b.example.com"}, {Name: "b", URL: "https://b.example.com", Token: "token"}}
+		}, []string{"mdm[0].name is required", "mdm[1].token is required (or set ATTESTD_MDM_B_TOKEN)", "mdm[2].name \"b\" is used more than once"}},
+		{"short hmac key", func(c *Config) { c.TokenStore.HMACKey = base64.StdEncoding.EncodeToString(make([]byte, 16)) }, []string{"at least 32 bytes"}},
+		{"invalid hmac key", func(c *Config) { c.TokenStore.HMACKey = "!" }, []string{"must be base64 encoded"}},
+		{"mem token store", func(c *Config) { c.TokenStore = TokenStoreConfig{Type: "mem", TTL: Duration(time.Minute)} }, []string{"token_store.size must be positive"}},
+		{"token store type", func(c *Config) { c.TokenStore.Type = "redis" }, []string{"token_store.type"}},
+		{"durations", func(c *Config) {
+			c.TokenStore.TTL, c.TokenStore.RefreshGrace, c.RefreshMaxLifetime = 0, -1, -1
+			c.FileStore.TTL, c.Placement.Timeout, c.Placement.CoalesceWindow = 0, 0, -1
+		}, []string{"token_store.ttl", "token_store.refresh_grace", "refresh_max_lifetime", "file_store.ttl", "placement.timeout", "placement.coalesce_window"}},
+		{"placement dir", func(c *Config) { c.Placement.Dir = "/" }, []string{"placement.dir"}},
+		{"colliding token envs", func(c *Config) {
+			c.MDM = []*MDMConfig{{Name: "us-east", URL: "https://a.example.com", Token: "token"}, {Name: "us_east", URL: "https://b.example.com", Token: "token"}}
+		}, []string{"mdm[1].name \"us_east\" has the same token environment variable ATTESTD_MDM_US_EAST_TOKEN as \"us-east\""}},
+		{"rate limits disabled", func(c *Config) {
+			c.RateLimit.Identifier, c.RateLimit.RemoteIP, c.RateLimit.Global = RateConfig{}, RateConfig{}, RateConfig{}
+		}, nil},
+		{"rate limits", func(c *Config) {
+			c.RateLimit.CacheSize, c.RateLimit.Cooldown = 0, -1
+			c.RateLimit.Identifier.Burst, c.RateLimit.Global.Interval = -1, 0
+		}, []string{"rate_limit.cache_size", "rate_limit.cooldown", "rate_limit.identifier.burst", "rate_limit.global.interval"}},
+		{"authorizer", func(c *Config) {
+			c.Authorizer = AuthorizerConfig{IdentifierTypes: []string{"Serial"}, AllowFile: "/nonexistent", AllowPatterns: []string{"("}}
+		}, []string{"authorizer.identifier_types[0]", "authorizer.allow_file: could not read", "authorizer: "}},
+		{"scopes", func(c *Config) { c.Scopes = []string{"read", "read write"} }, []string{"scopes[1]"}},
+		{"metrics listen", func(c *Config) { c.Metrics.Listen = c.Listen }, []string{"metrics.listen"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := validConfig(t)
+			test.modify(c)
+
+			err := c.Validate()
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got: %v", err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected *ValidationError, got %v", err)
+			}
+			if len(verr.Problems) != len(test.problems) {
+				t.Errorf("expected %d problems, got: %v", len(test.problems), err)
+			}
+			for _, p := range test.problems {
+				if !strings.Contains(err.Error(), p) {
+					t.Errorf("expected problem %q, got: %v", p, err)
+				}
+			}
+		})
+	}
+}
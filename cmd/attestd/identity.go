@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// loadIdentity loads the "Apple Developer ID Installer" certificate and RSA private key from a p12 file or PEM files
+func loadIdentity(c *IdentityConfig) (*x509.Certificate, *rsa.PrivateKey, error) {
+	var (
+		cert *x509.Certificate
+		key  interface{}
+	)
+
+	if c.P12 != "" {
+		buf, err := os.ReadFile(c.P12)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read p12: %w", err)
+		}
+		key, cert, err = pkcs12.Decode(buf, c.P12Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not decode p12 (check identity.p12_password): %w", err)
+		}
+	} else {
+		buf, err := os.ReadFile(c.Cert)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read certificate: %w", err)
+		}
+		block, _ := pem.Decode(buf)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, nil, fmt.Errorf("%s is not a PEM encoded CERTIFICATE", c.Cert)
+		}
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, nil, fmt.Errorf("could not parse certificate: %w", err)
+		}
+
+		if buf, err = os.ReadFile(c.Key); err != nil {
+			return nil, nil, fmt.Errorf("could not read key: %w", err)
+		}
+		block, _ = pem.Decode(buf)
+		if block == nil {
+			return nil, nil, fmt.Errorf("%s is not PEM encoded", c.Key)
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			return nil, nil, fmt.Errorf("%s: unsupported PEM block type %q: expected RSA PRIVATE KEY or PRIVATE KEY", c.Key, block.Type)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse key: %w", err)
+		}
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("identity key must be an RSA key")
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || pub.N.Cmp(rsaKey.N) != 0 || pub.E != rsaKey.E {
+		return nil, nil, errors.New("identity key doesn't match certificate")
+	}
+
+	return cert, rsaKey, nil
+}
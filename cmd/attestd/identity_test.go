@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes a PEM block of typ with der to a temporary file and returns its path
+func writePEM(t *testing.T, typ string, der []byte) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "*.pem")
+	if err != nil {
+		t.Fatalf("could not create file: %v", err)
+	}
+	defer f.Close()
+	if err = pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		t.Fatalf("could not write PEM: %v", err)
+	}
+	return f.Name()
+}
+
+// newIdentity returns a new RSA key and the path to a PEM encoded self-signed certificate for it
+func newIdentity(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Developer ID Installer: Test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	return key, writePEM(t, "CERTIFICATE", der)
+}
+
+func TestLoadIdentity(t *testing.T) {
+	key, certPath := newIdentity(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		cert  string
+		key   string
+		valid bool
+	}{
+		{"pkcs1", certPath, writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), true},
+		{"pkcs8", certPath, writePEM(t, "PRIVATE KEY", pkcs8), true},
+		{"mismatched key", certPath, writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(otherKey)), false},
+		{"ecdsa key", certPath, writePEM(t, "PRIVATE KEY", ecPKCS8), false},
+		{"unsupported key type", certPath, writePEM(t, "EC PRIVATE KEY", nil), false},
+		{"cert not certificate", writePEM(t, "PRIVATE KEY", pkcs8), writePEM(t, "PRIVATE KEY", pkcs8), false},
+		{"missing key", certPath, filepath.Join(t.TempDir(), "missing.pem"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cert, k, err := loadIdentity(&IdentityConfig{Cert: test.cert, Key: test.key})
+			if !test.valid {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not load identity: %v", err)
+			}
+			if cert.Subject.CommonName != "Developer ID Installer: Test" || k.N.Cmp(key.N) != 0 {
+				t.Errorf("expected test identity, got %s", cert.Subject.CommonName)
+			}
+		})
+	}
+
+	if _, _, err = loadIdentity(&IdentityConfig{P12: certPath}); err == nil {
+		t.Error("expected error for invalid p12")
+	}
+}
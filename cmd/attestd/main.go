@@ -0,0 +1,271 @@
+// Command attestd runs a macOS device attestation server configured from a JSON file and environment variables.
+//
+// Usage:
+//
+//	attestd [-config attestd.json] [-check]
+//
+// See attestd.example.json for an example config file. The config file is JSON only: YAML would add a dependency to the module for every library user,
+// and the file is small enough that JSON's lack of comments isn't a burden. Secrets can be set with environment variables instead of the config file:
+//
+//	ATTESTD_CONFIG                 path to the config file
+//	ATTESTD_LISTEN                 listen
+//	ATTESTD_URL                    url
+//	ATTESTD_TLS_CERT               tls.cert
+//	ATTESTD_TLS_KEY                tls.key
+//	ATTESTD_IDENTITY_P12           identity.p12
+//	ATTESTD_IDENTITY_P12_PASSWORD  identity.p12_password
+//	ATTESTD_IDENTITY_CERT          identity.cert
+//	ATTESTD_IDENTITY_KEY           identity.key
+//	ATTESTD_HMAC_KEY               token_store.hmac_key
+//	ATTESTD_MDM_URL                mdm[0].url, if at most one MDM is configured
+//	ATTESTD_MDM_TOKEN              mdm[0].token, if at most one MDM is configured
+//	ATTESTD_MDM_<NAME>_TOKEN       the token of the MDM named <name>, if more than one MDM is configured
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	attest "github.com/korylprince/macos-device-attestation"
+	"github.com/korylprince/macos-device-attestation/authorizer"
+	filestore "github.com/korylprince/macos-device-attestation/filestore/mem"
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/mdm"
+	"github.com/korylprince/macos-device-attestation/mdm/micromdm"
+	"github.com/korylprince/macos-device-attestation/mdm/multi"
+	"github.com/korylprince/macos-device-attestation/metrics"
+	ratelimit "github.com/korylprince/macos-device-attestation/ratelimit/mem"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+	"github.com/korylprince/macos-device-attestation/tokenstore/jwt"
+	tokenmem "github.com/korylprince/macos-device-attestation/tokenstore/mem"
+	mdmtransport "github.com/korylprince/macos-device-attestation/transport/mdm"
+)
+
+const defaultMDMCacheSize = 1000
+
+// newMDM returns an mdm.MDM for the configured MDMs. If more than one is configured, they're combined with a multi MDM
+func newMDM(c *Config, logger logging.Logger) (mdm.MDM, error) {
+	backends := make([]*multi.Backend, 0, len(c.MDM))
+	for _, mc := range c.MDM {
+		size := mc.CacheSize
+		if size == 0 {
+			size = defaultMDMCacheSize
+		}
+		m, err := micromdm.New(mc.URL, mc.Token, size)
+		if err != nil {
+			return nil, fmt.Errorf("could not create MDM %s: %w", mc.URL, err)
+		}
+		m.Logger = logger
+		backends = append(backends, &multi.Backend{Name: mc.Name, MDM: m})
+	}
+
+	if len(backends) == 1 {
+		return backends[0].MDM, nil
+	}
+
+	m, err := multi.New(defaultMDMCacheSize*len(backends), backends...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create multi MDM: %w", err)
+	}
+	m.Logger = logger
+	return m, nil
+}
+
+// newAuthorizer returns the configured Authorizer, or nil if every device is allowed
+func newAuthorizer(c *AuthorizerConfig) (authorizer.Authorizer, error) {
+	var authorizers []authorizer.Authorizer
+	if len(c.IdentifierTypes) > 0 {
+		authorizers = append(authorizers, authorizer.Types(c.IdentifierTypes...))
+	}
+	if c.AllowFile != "" || c.DenyFile != "" {
+		l, err := authorizer.LoadList(c.AllowFile, c.DenyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load authorizer lists: %w", err)
+		}
+		authorizers = append(authorizers, l)
+	}
+	if len(c.AllowPatterns) > 0 || len(c.DenyPatterns) > 0 {
+		r, err := authorizer.NewRegexp(c.AllowPatterns, c.DenyPatterns)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile authorizer patterns: %w", err)
+		}
+		authorizers = append(authorizers, r)
+	}
+
+	switch len(authorizers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return authorizers[0], nil
+	}
+	return authorizer.Chain(authorizers...), nil
+}
+
+// newLimiter returns the configured Limiter
+func newLimiter(c *RateLimitConfig) *ratelimit.Limiter {
+	rate := func(r RateConfig) ratelimit.Rate {
+		return ratelimit.Rate{Burst: r.Burst, Interval: time.Duration(r.Interval)}
+	}
+	return ratelimit.New(c.CacheSize, rate(c.Identifier), rate(c.RemoteIP), rate(c.Global), time.Duration(c.Cooldown))
+}
+
+// newTokenStore returns the configured TokenStore
+func newTokenStore(c *TokenStoreConfig, logger logging.Logger) tokenstore.TokenStore {
+	if c.Type == "mem" {
+		ts := tokenmem.New(c.Size, time.Duration(c.TTL))
+		ts.RefreshGrace = time.Duration(c.RefreshGrace)
+		ts.Logger = logger
+		return ts
+	}
+
+	// the key was validated by Config.Validate
+	key, _ := base64.StdEncoding.DecodeString(c.HMACKey)
+	ts := jwt.New(key, c.Issuer, c.Audience, time.Duration(c.TTL))
+	ts.RefreshGrace = time.Duration(c.RefreshGrace)
+	return ts
+}
+
+// newService assembles an AttestationService from c and returns it with its handler. If reg isn't nil, metrics are recorded to it
+func newService(c *Config, logger logging.Logger, reg *metrics.Registry) (*attest.AttestationService, http.Handler, error) {
+	cert, key, err := loadIdentity(&c.Identity)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load identity: %w", err)
+	}
+
+	m, err := newMDM(c, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reg != nil {
+		m = metrics.NewMDM(m, reg)
+	}
+
+	auth, err := newAuthorizer(&c.Authorizer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fs := filestore.New(c.FileStore.Size, time.Duration(c.FileStore.TTL))
+	fs.Logger = logger
+
+	// the file URL prefix is set by Handler
+	t := mdmtransport.New(m, "", fs, cert, key)
+	t.Logger = logger
+
+	as := attest.New(newTokenStore(&c.TokenStore, logger), t, fs, logger)
+	as.Realm = c.Realm
+	as.RefreshMaxLifetime = time.Duration(c.RefreshMaxLifetime)
+	as.PlaceTimeout = time.Duration(c.Placement.Timeout)
+	as.CoalesceWindow = time.Duration(c.Placement.CoalesceWindow)
+	if c.Placement.Dir != "" || c.Placement.PerIdentifier {
+		dir := c.Placement.Dir
+		if dir == "" {
+			dir = attest.DefaultPlacementDir
+		}
+		as.PathStrategy = &attest.DirPathStrategy{Dir: dir, PerIdentifier: c.Placement.PerIdentifier}
+	}
+	as.Limiter = newLimiter(&c.RateLimit)
+	if auth != nil {
+		as.Authorizer = auth
+	}
+	if len(c.Scopes) > 0 {
+		as.ScopePolicy = attest.StaticScopes(c.Scopes...)
+	}
+	if reg != nil {
+		as.Metrics = reg
+		reg.GaugeFunc("filestore_files", "Files in the FileStore", func() float64 { return float64(fs.Len()) })
+		reg.GaugeFunc("placements", "Placements tracked for StatusHandler", func() float64 { return float64(as.PlacementCount()) })
+	}
+
+	return as, as.Handler(c.URL), nil
+}
+
+func run() error {
+	configPath := flag.String("config", os.Getenv("ATTESTD_CONFIG"), "path to the JSON config file. Defaults to $ATTESTD_CONFIG. If empty, only environment variables are used")
+	check := flag.Bool("check", false, "validate the configuration and exit")
+	flag.Parse()
+
+	c, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err = c.Validate(); err != nil {
+		return err
+	}
+
+	logger := logging.NewStdLogger(log.Default())
+	logger.Verbose = c.Debug
+
+	var reg *metrics.Registry
+	if c.Metrics.Listen != "" {
+		reg = metrics.New(nil)
+	}
+
+	_, handler, err := newService(c, logger, reg)
+	if err != nil {
+		return err
+	}
+
+	if *check {
+		fmt.Println("configuration OK")
+		return nil
+	}
+
+	// the first server to fail stops attestd
+	errs := make(chan error, 2)
+
+	if reg != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", reg.Handler())
+		metricsServer := &http.Server{
+			Addr:              c.Metrics.Listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		logger.Info("serving metrics", "addr", c.Metrics.Listen)
+		go func() {
+			errs <- fmt.Errorf("could not serve metrics: %w", metricsServer.ListenAndServe())
+		}()
+	}
+
+	server := &http.Server{
+		Addr:              c.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	logger.Info("listening", "addr", c.Listen, "url", c.URL, "tls", !c.TLS.Disabled)
+
+	go func() {
+		if c.TLS.Disabled {
+			errs <- server.ListenAndServe()
+			return
+		}
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.TLS.MinVersion == "1.3" {
+			server.TLSConfig.MinVersion = tls.VersionTLS13
+		}
+		errs <- server.ListenAndServeTLS(c.TLS.Cert, c.TLS.Key)
+	}()
+
+	err = <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "attestd:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/metrics"
+	"github.com/korylprince/macos-device-attestation/tokenstore/jwt"
+	tokenmem "github.com/korylprince/macos-device-attestation/tokenstore/mem"
+)
+
+func TestNewService(t *testing.T) {
+	key, certPath := newIdentity(t)
+
+	c := validConfig(t)
+	c.Identity = IdentityConfig{Cert: certPath, Key: writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))}
+	c.MDM = []*MDMConfig{
+		{Name: "us", URL: "https://mdm-us.example.com", Token: "token"},
+		{Name: "eu", URL: "https://mdm-eu.example.com", Token: "token"},
+	}
+	c.Placement.CoalesceWindow = Duration(time.Minute)
+	c.Authorizer.IdentifierTypes = []string{"serial"}
+	c.Scopes = []string{"attested"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected valid config, got: %v", err)
+	}
+
+	reg := metrics.New(nil)
+	as, handler, err := newService(c, nil, reg)
+	if err != nil {
+		t.Fatalf("could not create service: %v", err)
+	}
+	if as.Limiter == nil || as.Authorizer == nil || as.ScopePolicy == nil || as.Metrics != reg {
+		t.Errorf("expected limiter, authorizer, scope policy, and metrics to be set, got: %+v", as)
+	}
+	if _, ok := as.TokenStore.(*jwt.TokenStore); !ok {
+		t.Errorf("expected jwt TokenStore, got %T", as.TokenStore)
+	}
+	if as.CoalesceWindow != time.Minute {
+		t.Errorf("expected coalesce window %v, got %v", time.Minute, as.CoalesceWindow)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestNewTokenStore(t *testing.T) {
+	ts := newTokenStore(&TokenStoreConfig{Type: "mem", Size: 10, TTL: Duration(time.Minute)}, nil)
+	if _, ok := ts.(*tokenmem.TokenStore); !ok {
+		t.Errorf("expected mem TokenStore, got %T", ts)
+	}
+}
+
+// mdmServer is a MicroMDM API that knows the serials in udids and records the UDIDs it's sent commands for
+type mdmServer struct {
+	udids map[string]string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func (s *mdmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := make(map[string]interface{})
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch r.URL.Path {
+	case "/v1/devices":
+		var devices []map[string]string
+		if serials, ok := body["filter_serial"].([]interface{}); ok && len(serials) == 1 {
+			if udid, ok := s.udids[fmt.Sprint(serials[0])]; ok {
+				devices = append(devices, map[string]string{"udid": udid})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": devices})
+	case "/v1/commands":
+		s.mu.Lock()
+		s.commands = append(s.commands, fmt.Sprint(body["udid"]))
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+	}
+}
+
+func (s *mdmServer) get() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func TestServicePlace(t *testing.T) {
+	key, certPath := newIdentity(t)
+	us := &mdmServer{udids: map[string]string{"serial": "udid"}}
+	eu := &mdmServer{}
+	usSrv, euSrv := httptest.NewServer(us), httptest.NewServer(eu)
+	defer usSrv.Close()
+	defer euSrv.Close()
+
+	c := validConfig(t)
+	c.Identity = IdentityConfig{Cert: certPath, Key: writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))}
+	c.MDM = []*MDMConfig{
+		{Name: "eu", URL: euSrv.URL, Token: "token"},
+		{Name: "us", URL: usSrv.URL, Token: "token"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected valid config, got: %v", err)
+	}
+
+	_, handler, err := newService(c, nil, nil)
+	if err != nil {
+		t.Fatalf("could not create service: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		identifier string
+		code       int
+	}{
+		{"known", "serial", http.StatusAccepted},
+		{"unknown", "unknown", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/place", strings.NewReader(`{"identifier":"`+test.identifier+`"}`))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// building the payload pkg requires xar
+	if _, err = exec.LookPath("xar"); err != nil {
+		t.Skip("xar is required to build payloads")
+	}
+
+	// the command is sent to the MDM that knows the device in the background
+	for deadline := time.Now().Add(5 * time.Second); len(us.get()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if commands := us.get(); fmt.Sprint(commands) != "[udid]" {
+		t.Errorf("expected command for udid, got %v", commands)
+	}
+	if commands := eu.get(); len(commands) != 0 {
+		t.Errorf("expected no commands for other MDM, got %v", commands)
+	}
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	allow := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(allow, []byte("C02OK\nC02TEST\n"), 0600); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		config     AuthorizerConfig
+		typ        string
+		identifier string
+		allowed    bool
+	}{
+		{"none", AuthorizerConfig{}, "udid", "anything", true},
+		{"type allowed", AuthorizerConfig{IdentifierTypes: []string{"serial"}}, "serial", "C02OK", true},
+		{"type denied", AuthorizerConfig{IdentifierTypes: []string{"serial"}}, "udid", "C02OK", false},
+		{"listed", AuthorizerConfig{AllowFile: allow}, "serial", "C02OK", true},
+		{"not listed", AuthorizerConfig{AllowFile: allow}, "serial", "C02OTHER", false},
+		{"listed but denied by pattern", AuthorizerConfig{AllowFile: allow, DenyPatterns: []string{"TEST"}}, "serial", "C02TEST", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := newAuthorizer(&test.config)
+			if err != nil {
+				t.Fatalf("could not create authorizer: %v", err)
+			}
+			if a == nil {
+				if !test.allowed {
+					t.Error("expected authorizer")
+				}
+				return
+			}
+			if err = a.Authorize(context.Background(), test.identifier, test.typ, "udid"); (err == nil) != test.allowed {
+				t.Errorf("expected allowed %t, got: %v", test.allowed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package attest
+
+import (
+	"context"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+// Device is the authenticated device that made a request. Middleware sets it in the request's context; use FromContext to retrieve it
+type Device struct {
+	// Identifier is the server-side identifier the token was issued for
+	Identifier string
+	// Serial is the serial number sent by the device when the token was placed, if known
+	Serial string
+	// UDID is the MDM UDID of the device, if known. It's set when the device attests with its UDID or the Transport transforms identifiers, e.g. mdm.Transport
+	UDID string
+	// Scopes are the scopes granted to the token
+	Scopes []string
+	// TokenID uniquely identifies the token, if the TokenStore supports it
+	TokenID string
+	// IssuedAt is when the token was issued, if known
+	IssuedAt time.Time
+	// ExpiresAt is when the token expires, if known
+	ExpiresAt time.Time
+}
+
+// newDevice returns a Device from the claims of an authenticated token
+func newDevice(c *tokenstore.Claims) *Device {
+	return &Device{
+		Identifier: c.Identifier,
+		Serial:     c.Serial,
+		UDID:       c.UDID,
+		Scopes:     c.Scopes,
+		TokenID:    c.ID,
+		IssuedAt:   c.IssuedAt,
+		ExpiresAt:  c.ExpiresAt,
+	}
+}
+
+// HasScopes returns true if the Device's token has been granted all of scopes
+func (d *Device) HasScopes(scopes ...string) bool {
+	return (&tokenstore.Claims{Scopes: d.Scopes}).HasScopes(scopes...)
+}
+
+// NewContext returns a copy of ctx with d. The identifier and scopes are also set with ContextKeyIdentifier and ContextKeyScopes for compatibility.
+// It's used by Middleware, and can be used by other authentication middleware, e.g. pki.Issuer.Middleware
+func NewContext(ctx context.Context, d *Device) context.Context {
+	ctx = context.WithValue(ctx, ContextKeyDevice, d)
+	ctx = context.WithValue(ctx, ContextKeyIdentifier, d.Identifier)
+	return context.WithValue(ctx, ContextKeyScopes, d.Scopes)
+}
+
+// FromContext returns the Device set in ctx by Middleware. If there isn't one, ok is false
+func FromContext(ctx context.Context) (d *Device, ok bool) {
+	d, ok = ctx.Value(ContextKeyDevice).(*Device)
+	return d, ok && d != nil
+}
+
+// MustFromContext is like FromContext, but panics if ctx doesn't have a Device. It should only be used by handlers that are always wrapped by Middleware
+func MustFromContext(ctx context.Context) *Device {
+	d, ok := FromContext(ctx)
+	if !ok {
+		panic("attest: Device not found in context")
+	}
+	return d
+}
@@ -0,0 +1,74 @@
+package attest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("expected no Device in empty context")
+	}
+	if _, ok := FromContext(context.WithValue(context.Background(), ContextKeyDevice, (*Device)(nil))); ok {
+		t.Error("expected nil Device not to be returned")
+	}
+
+	d := &Device{Identifier: "udid", Scopes: []string{"a"}}
+	ctx := NewContext(context.Background(), d)
+
+	if got, ok := FromContext(ctx); !ok || got != d {
+		t.Errorf("expected Device %+v, got %+v", d, got)
+	}
+	if got := MustFromContext(ctx); got != d {
+		t.Errorf("expected Device %+v, got %+v", d, got)
+	}
+	if identifier, _ := ctx.Value(ContextKeyIdentifier).(string); identifier != "udid" {
+		t.Errorf("expected identifier udid for compatibility, got %q", identifier)
+	}
+	if scopes, _ := ctx.Value(ContextKeyScopes).([]string); len(scopes) != 1 || scopes[0] != "a" {
+		t.Errorf("expected scopes [a] for compatibility, got %v", scopes)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected MustFromContext to panic without a Device")
+		}
+	}()
+	MustFromContext(context.Background())
+}
+
+func TestMiddlewareDevice(t *testing.T) {
+	s, tr := newTestService(t)
+	s.Transport = &transformingTransport{tr, map[string]string{"serial": "udid"}}
+	s.ScopePolicy = StaticScopes("read")
+
+	resp := place(t, s, "serial")
+	pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+	token, err := tr.fs.Get(pl.fsPath)
+	if err != nil {
+		t.Fatalf("could not get placed token: %v", err)
+	}
+
+	var d *Device
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d = MustFromContext(r.Context())
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+string(token))
+	s.JSONMiddleware(next).ServeHTTP(httptest.NewRecorder(), r)
+
+	if d == nil {
+		t.Fatal("expected Device in context")
+	}
+	if d.Identifier != "udid" || d.Serial != "serial" || d.UDID != "udid" || !d.HasScopes("read") {
+		t.Errorf("expected Device for serial and udid with scope read, got: %+v", d)
+	}
+	if d.TokenID == "" || time.Since(d.IssuedAt) > time.Minute || !d.ExpiresAt.After(d.IssuedAt) {
+		t.Errorf("expected token id and times to be set, got: %+v", d)
+	}
+}
@@ -0,0 +1,69 @@
+package attest
+
+import (
+	"context"
+	"time"
+)
+
+// EventType is the type of an Event
+type EventType string
+
+// Event types
+const (
+	// EventPlaceRequested is emitted when PlaceHandler finishes handling a request. Err is set if the placement wasn't started
+	EventPlaceRequested EventType = "place_requested"
+	// EventIdentifierTransformed is emitted after the Transport's Transformer is called
+	EventIdentifierTransformed EventType = "identifier_transformed"
+	// EventTokenIssued is emitted after the TokenStore creates a token for a placement
+	EventTokenIssued EventType = "token_issued"
+	// EventPkgServed is emitted when FileStoreHandler serves a file to a device
+	EventPkgServed EventType = "pkg_served"
+	// EventTokenAuthenticated is emitted when Middleware successfully authenticates a token
+	EventTokenAuthenticated EventType = "token_authenticated"
+	// EventAuthenticationFailed is emitted when Middleware rejects a request
+	EventAuthenticationFailed EventType = "authentication_failed"
+	// EventTokenRefreshed is emitted when RefreshHandler exchanges a token for a new one. Err is set if the token wasn't refreshed
+	EventTokenRefreshed EventType = "token_refreshed"
+)
+
+// Event describes attestation activity
+type Event struct {
+	Type EventType
+	// Identifier is the server-side identifier, if known. Otherwise it's the identifier sent by the client
+	Identifier string
+	// ClientIdentifier is the identifier sent by the client before it was transformed, if known
+	ClientIdentifier string
+	// PlacementID is the id of the related Placement, if any
+	PlacementID string
+	// RemoteAddr is the network address of the client that sent the request
+	RemoteAddr string
+	// Time is when the operation started
+	Time time.Time
+	// Duration is how long the operation took
+	Duration time.Duration
+	// Err is the error the operation failed with, if any
+	Err error
+}
+
+// EventHook is an interface to receive Events from an AttestationService.
+// HandleEvent is called synchronously while handling requests, so implementations should return quickly and hand off any slow work
+type EventHook interface {
+	HandleEvent(ctx context.Context, e *Event)
+}
+
+// EventHookFunc is an adapter to allow the use of ordinary functions as EventHooks
+type EventHookFunc func(ctx context.Context, e *Event)
+
+// HandleEvent calls f(ctx, e)
+func (f EventHookFunc) HandleEvent(ctx context.Context, e *Event) {
+	f(ctx, e)
+}
+
+// emit sends e to the EventHook, if any, setting e.Duration from e.Time
+func (s *AttestationService) emit(ctx context.Context, e *Event) {
+	if s.EventHook == nil {
+		return
+	}
+	e.Duration = time.Since(e.Time)
+	s.EventHook.HandleEvent(ctx, e)
+}
@@ -0,0 +1,156 @@
+package attest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+// transformingTransport is a testTransport that transforms identifiers with udids. Unknown identifiers are invalid
+type transformingTransport struct {
+	*testTransport
+	udids map[string]string
+}
+
+func (t *transformingTransport) Transform(identifier string) (string, error) {
+	udid, ok := t.udids[identifier]
+	if !ok {
+		return "", fmt.Errorf("unknown identifier %s: %w", identifier, ErrInvalidIdentifier)
+	}
+	return udid, nil
+}
+
+// recordHook is an EventHook that records the Events it receives
+type recordHook struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (h *recordHook) HandleEvent(ctx context.Context, e *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, *e)
+}
+
+// get returns the recorded Events of typ
+func (h *recordHook) get(typ EventType) []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var events []Event
+	for _, e := range h.events {
+		if e.Type == typ {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestPlaceEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		identifier  string
+		types       []EventType
+		placed      bool
+		transformed string
+	}{
+		{"placed", "serial", []EventType{EventIdentifierTransformed, EventTokenIssued, EventPlaceRequested}, true, "udid"},
+		{"invalid identifier", "unknown", []EventType{EventIdentifierTransformed, EventPlaceRequested}, false, "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, tr := newTestService(t)
+			s.Transport = &transformingTransport{tr, map[string]string{"serial": "udid"}}
+			hook := new(recordHook)
+			s.EventHook = hook
+
+			doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": test.identifier})
+
+			var types []EventType
+			for _, e := range hook.events {
+				types = append(types, e.Type)
+			}
+			if fmt.Sprint(types) != fmt.Sprint(test.types) {
+				t.Fatalf("expected events %v, got %v", test.types, types)
+			}
+
+			ev := hook.get(EventPlaceRequested)[0]
+			if ev.ClientIdentifier != test.identifier || ev.Identifier != test.transformed {
+				t.Errorf("expected identifiers %s -> %s, got %s -> %s", test.identifier, test.transformed, ev.ClientIdentifier, ev.Identifier)
+			}
+			if test.placed && (ev.Err != nil || ev.PlacementID == "") {
+				t.Errorf("expected placement without error, got id %q, err %v", ev.PlacementID, ev.Err)
+			}
+			if !test.placed && (ev.Err == nil || ev.PlacementID != "") {
+				t.Errorf("expected error without placement, got id %q, err %v", ev.PlacementID, ev.Err)
+			}
+			if tev := hook.get(EventIdentifierTransformed)[0]; (tev.Err == nil) != test.placed {
+				t.Errorf("expected transform error %t, got %v", !test.placed, tev.Err)
+			}
+		})
+	}
+}
+
+func TestPkgServedEvent(t *testing.T) {
+	s, _ := newTestService(t)
+	hook := new(recordHook)
+	s.EventHook = hook
+
+	resp := place(t, s, "serial")
+	pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+
+	doJSON(t, http.StripPrefix("/files/", s.FileStoreHandler()), http.MethodGet, "/files/"+pl.fsPath, nil)
+
+	events := hook.get(EventPkgServed)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 %s event, got %d", EventPkgServed, len(events))
+	}
+	if events[0].PlacementID != resp.ID || events[0].Identifier != "serial" {
+		t.Errorf("expected event for placement %s of serial, got: %+v", resp.ID, events[0])
+	}
+}
+
+func TestMiddlewareEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		header func(token string) string
+		typ    EventType
+	}{
+		{"authenticated", func(token string) string { return "Bearer " + token }, EventTokenAuthenticated},
+		{"missing header", func(token string) string { return "" }, EventAuthenticationFailed},
+		{"unknown token", func(token string) string { return "Bearer unknown" }, EventAuthenticationFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			hook := new(recordHook)
+			s.EventHook = hook
+
+			token, err := s.TokenStore.New("serial")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", test.header(token))
+			s.JSONMiddleware(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), r)
+
+			if len(hook.events) != 1 || hook.events[0].Type != test.typ {
+				t.Fatalf("expected one %s event, got: %+v", test.typ, hook.events)
+			}
+			ev := hook.events[0]
+			if test.typ == EventTokenAuthenticated && ev.Identifier != "serial" {
+				t.Errorf("expected identifier serial, got %q", ev.Identifier)
+			}
+			if test.typ == EventAuthenticationFailed && ev.Err == nil {
+				t.Error("expected error to be set")
+			}
+		})
+	}
+}
@@ -12,37 +12,35 @@ import (
 
 func main() {
 	type response struct {
-		Code    int    `json:"code"`
 		Message string `json:"msg"`
 	}
 
+	// the Transport gets a token on the first request, and a new one if the token is rejected.
 	// it really can take a couple minutes for the payload pkg to get installed
-	token, err := client.GetToken("https://mdm.example.com/v1/attest/place", 2*time.Minute)
-	if err != nil {
-		log.Fatalln("could not get token:", err)
-	}
-
-	r, err := http.NewRequest("GET", "https://mdm.example.com/v1/attest/hello", http.NoBody)
-	if err != nil {
-		log.Fatalln("could not create request:", err)
-	}
-	client.SetToken(r, token)
-
-	res, err := http.DefaultClient.Do(r)
+	t := &client.Transport{Client: &client.Client{
+		URL:       "https://mdm.example.com/v1/attest/place",
+		Timeout:   2 * time.Minute,
+		UserAgent: "example-agent/1.0",
+	}}
+	// reuse the token across restarts
+	t.Cache = &client.FileCache{}
+	c := &http.Client{Transport: t}
+
+	res, err := c.Get("https://mdm.example.com/v1/attest/hello")
 	if err != nil {
 		log.Fatalln("could not perform request:", err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		log.Fatalln("unexpected status:", res.Status)
+	}
+
 	resp := new(response)
 	d := json.NewDecoder(res.Body)
 	if err = d.Decode(resp); err != nil {
 		log.Fatalln("could not parse response:", err)
 	}
 
-	if resp.Code != 0 {
-		log.Fatalln("unexpected code:", resp.Code, http.StatusText(resp.Code))
-	}
-
 	fmt.Println("The server said:", resp.Message)
 }
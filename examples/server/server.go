@@ -13,7 +13,10 @@ import (
 	"github.com/gorilla/mux"
 	attest "github.com/korylprince/macos-device-attestation"
 	"github.com/korylprince/macos-device-attestation/filestore/mem"
+	"github.com/korylprince/macos-device-attestation/logging"
 	mdm "github.com/korylprince/macos-device-attestation/mdm/micromdm"
+	"github.com/korylprince/macos-device-attestation/metrics"
+	ratelimit "github.com/korylprince/macos-device-attestation/ratelimit/mem"
 	"github.com/korylprince/macos-device-attestation/tokenstore/jwt"
 	mdmtransport "github.com/korylprince/macos-device-attestation/transport/mdm"
 	"golang.org/x/crypto/pkcs12"
@@ -22,8 +25,8 @@ import (
 var hmackey, _ = base64.StdEncoding.DecodeString("SSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSSDinaQgTWljcm9NRE0gSQ==")
 
 func replyHandler(w http.ResponseWriter, r *http.Request) {
-	udid := r.Context().Value(attest.ContextKeyIdentifier)
-	j := map[string]string{"msg": fmt.Sprintf("Hello, %s!", udid)}
+	device := attest.MustFromContext(r.Context())
+	j := map[string]string{"msg": fmt.Sprintf("Hello, %s (%s)!", device.Serial, device.UDID)}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -49,16 +52,42 @@ func main() {
 
 	fs := mem.New(10, time.Minute)
 	ts := jwt.New(hmackey, "attest.example.com", []string{"attest.example.com"}, time.Minute*15)
+	ts.RefreshGrace = time.Minute * 5
 
-	t := mdmtransport.New(m, "https://mdm.example.com/v1/attest/files", fs, cert, key.(*rsa.PrivateKey))
+	reg := metrics.New(nil)
 
-	as := attest.New(ts, t, fs, log.Default())
+	// the file URL prefix is set by as.Handler below
+	t := mdmtransport.New(metrics.NewMDM(m, reg), "", fs, cert, key.(*rsa.PrivateKey))
+
+	as := attest.New(ts, t, fs, logging.NewStdLogger(log.Default()))
+	as.ScopePolicy = attest.StaticScopes("hello")
+	as.Realm = "attest.example.com"
+	as.Metrics = reg
+	reg.GaugeFunc("filestore_files", "Files in the FileStore", func() float64 { return float64(fs.Len()) })
+	reg.GaugeFunc("placements", "Placements tracked for StatusHandler", func() float64 { return float64(as.PlacementCount()) })
+	// allow bursts of 2 placements per device (one more every 5 minutes), 10 per IP address (one more every minute), and 10 overall (one more every second),
+	// and make devices wait 5 minutes after a successful placement before starting another
+	as.Limiter = ratelimit.New(1000,
+		ratelimit.Rate{Burst: 2, Interval: 5 * time.Minute},
+		ratelimit.Rate{Burst: 10, Interval: time.Minute},
+		ratelimit.Rate{Burst: 10, Interval: time.Second},
+		5*time.Minute,
+	)
 
 	r := mux.NewRouter()
-	r.Methods("HEAD", "GET").PathPrefix("/v1/attest/files/").Handler(http.StripPrefix("/v1/attest/files/", as.FileStoreHandler()))
-	// you should definitely rate-limit this handler
-	r.Methods("POST").Path("/v1/attest/place").Handler(as.PlaceHandler())
-	r.Methods("GET").Path("/v1/attest/hello").Handler(as.JSONMiddleware(http.HandlerFunc(replyHandler)))
+	// metrics should only be reachable by your monitoring system
+	r.Methods("GET").Path("/metrics").Handler(reg.Handler())
+	// serve an OpenAPI document that includes the hello endpoint instead of the one mounted by as.Handler
+	r.Methods("GET").Path("/v1/attest/openapi.json").Handler(as.OpenAPIHandler("/v1/attest", &attest.Endpoint{
+		Method:   "GET",
+		Path:     "/v1/attest/hello",
+		Summary:  "Say hello to the device",
+		Scopes:   []string{"hello"},
+		Response: map[string]string{},
+	}))
+	r.Methods("GET").Path("/v1/attest/hello").Handler(as.JSONMiddleware(as.RequireScopes("hello")(http.HandlerFunc(replyHandler))))
+	// mount place, status, files, and refresh endpoints, and set the transport's file URL prefix
+	r.PathPrefix("/v1/attest/").Handler(as.Handler("https://mdm.example.com/v1/attest"))
 
 	// tls is required for macOS to actually install transport pkg
 	http.ListenAndServeTLS(":443", "./cert.pem", "./key.pem", r)
@@ -1,6 +1,9 @@
 package filestore
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var ErrNotFound = errors.New("file not found")
 
@@ -17,3 +20,44 @@ type FileStore interface {
 	// The path can be used by Get to retrieve the file
 	Put(name string, data []byte) (string, error)
 }
+
+// ContextFileStore is an optional interface a FileStore can implement to accept a context.Context.
+// The methods behave like their FileStore counterparts
+type ContextFileStore interface {
+	PeekContext(ctx context.Context, path string) ([]byte, error)
+	GetContext(ctx context.Context, path string) ([]byte, error)
+	PutContext(ctx context.Context, name string, data []byte) (string, error)
+}
+
+type contextFileStore struct {
+	FileStore
+}
+
+func (f contextFileStore) PeekContext(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.Peek(path)
+}
+
+func (f contextFileStore) GetContext(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.Get(path)
+}
+
+func (f contextFileStore) PutContext(ctx context.Context, name string, data []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return f.Put(name, data)
+}
+
+// WithContext returns f as a ContextFileStore. If f doesn't implement ContextFileStore, it is wrapped so that the context is only checked before each call
+func WithContext(f FileStore) ContextFileStore {
+	if cf, ok := f.(ContextFileStore); ok {
+		return cf
+	}
+	return contextFileStore{f}
+}
@@ -1,6 +1,7 @@
 package mem
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/korylprince/macos-device-attestation/filestore"
+	"github.com/korylprince/macos-device-attestation/logging"
 )
 
 const pathSize = 16
@@ -16,6 +18,8 @@ const pathSize = 16
 // FileStore implements FileStore completely in memory and uses an LRU cache to limit memory usage
 type FileStore struct {
 	files *ttlcache.Cache
+	// Logger is an optional logging.Logger
+	Logger logging.Logger
 }
 
 // New returns a new FileStore with the given cache size (item count) and item ttl
@@ -26,7 +30,16 @@ func New(size int, ttl time.Duration) *FileStore {
 		panic(fmt.Errorf("could not set ttl on cache: %w", err))
 	}
 	c.SkipTTLExtensionOnHit(true)
-	return &FileStore{files: c}
+	m := &FileStore{files: c}
+	c.SetExpirationReasonCallback(func(path string, reason ttlcache.EvictionReason, _ interface{}) {
+		switch reason {
+		case ttlcache.Expired:
+			logging.OrDiscard(m.Logger).Debug("file expired", logging.KeyFileStorePath, path)
+		case ttlcache.EvictedSize:
+			logging.OrDiscard(m.Logger).Warn("file evicted because store is full", logging.KeyFileStorePath, path)
+		}
+	})
+	return m
 }
 
 // Peek returns the file at the given path without removing it
@@ -70,5 +83,35 @@ func (m *FileStore) Put(name string, data []byte) (string, error) {
 	if err := m.files.Set(path, data); err != nil {
 		return "", fmt.Errorf("could not set path: %w", err)
 	}
+	logging.OrDiscard(m.Logger).Debug("file stored", logging.KeyFileStorePath, path)
 	return path, nil
 }
+
+// PeekContext returns the file at the given path without removing it
+func (m *FileStore) PeekContext(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Peek(path)
+}
+
+// GetContext returns the file at the given path and removes it
+func (m *FileStore) GetContext(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Get(path)
+}
+
+// PutContext stores the data and returns a path with format "<random id>/<name>"
+func (m *FileStore) PutContext(ctx context.Context, name string, data []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return m.Put(name, data)
+}
+
+// Len returns the number of files currently stored
+func (m *FileStore) Len() int {
+	return m.files.Count()
+}
@@ -0,0 +1,85 @@
+package attest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+// FileURLPrefixSetter is an optional interface a Transport can implement to have Handler set the URL prefix that devices download payloads from
+type FileURLPrefixSetter interface {
+	// SetFileURLPrefix sets the URL prefix (without the trailing slash) that FileStore paths are appended to
+	SetFileURLPrefix(prefix string)
+}
+
+// allowMethods returns a handler that responds with 405 Method Not Allowed unless the request's method is one of methods
+func (s *AttestationService) allowMethods(next http.Handler, methods ...string) http.Handler {
+	allow := strings.Join(methods, ", ")
+	notAllowed := s.withJSONResponse(func(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+		w.Header().Set("Allow", allow)
+		return http.StatusMethodNotAllowed, fmt.Errorf("attest: method not allowed: %s", r.Method)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		notAllowed.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns an http.Handler that mounts the AttestationService's handlers under prefix at the Path constants:
+// PlaceHandler (POST), StatusHandler (GET), FileStoreHandler (GET and HEAD), RefreshHandler (POST, if the TokenStore implements tokenstore.Refresher), and OpenAPIHandler (GET).
+// RevokeHandler is not mounted since it must be protected by your own authentication.
+//
+// prefix can be a path, e.g. /v1/attest, or an absolute URL, e.g. https://attest.example.com/v1/attest. If the Transport implements FileURLPrefixSetter, prefix must be an absolute URL,
+// and the Transport's file URL prefix is set to the URL of FileStoreHandler so it can't get out of sync. Handler should be called before the AttestationService is used.
+// Like http.ServeMux.Handle, Handler panics if prefix is invalid
+func (s *AttestationService) Handler(prefix string) http.Handler {
+	u, err := url.Parse(prefix)
+	if err != nil {
+		panic(fmt.Errorf("attest: could not parse prefix: %w", err))
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		panic(errors.New("attest: prefix must not have a query or fragment"))
+	}
+	if u.IsAbs() && u.Scheme != "https" && u.Scheme != "http" {
+		panic(fmt.Errorf("attest: invalid prefix scheme: %s", u.Scheme))
+	}
+	path := "/" + strings.Trim(u.Path, "/")
+	if path == "/" {
+		path = ""
+	}
+
+	if setter, ok := s.Transport.(FileURLPrefixSetter); ok {
+		// the Transport would otherwise send devices a download URL without a host
+		if !u.IsAbs() || u.Host == "" {
+			panic(errors.New("attest: prefix must be an absolute URL if the Transport implements FileURLPrefixSetter"))
+		}
+		files := *u
+		files.Path = path + strings.TrimSuffix(PathFiles, "/")
+		files.RawPath = ""
+		setter.SetFileURLPrefix(files.String())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path+PathPlace, s.allowMethods(s.PlaceHandler(), http.MethodPost))
+	mux.Handle(path+PathStatus, s.allowMethods(http.StripPrefix(path+PathStatus, s.StatusHandler()), http.MethodGet))
+	mux.Handle(path+PathFiles, s.allowMethods(http.StripPrefix(path+PathFiles, s.FileStoreHandler()), http.MethodGet, http.MethodHead))
+	if _, ok := s.TokenStore.(tokenstore.Refresher); ok {
+		mux.Handle(path+PathRefresh, s.allowMethods(s.RefreshHandler(), http.MethodPost))
+	}
+	mux.Handle(path+PathOpenAPI, s.allowMethods(s.OpenAPIHandler(path), http.MethodGet, http.MethodHead))
+	mux.Handle(path+"/", s.withJSONResponse(func(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+		return http.StatusNotFound, fmt.Errorf("attest: not found: %s", r.URL.Path)
+	}))
+
+	return mux
+}
@@ -0,0 +1,149 @@
+package attest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+		allow  string
+	}{
+		{"place", http.MethodPost, "/v1" + PathPlace, http.StatusBadRequest, ""},
+		{"place wrong method", http.MethodGet, "/v1" + PathPlace, http.StatusMethodNotAllowed, "POST"},
+		{"status", http.MethodGet, "/v1" + PathStatus + "unknown", http.StatusNotFound, ""},
+		{"status wrong method", http.MethodDelete, "/v1" + PathStatus + "unknown", http.StatusMethodNotAllowed, "GET"},
+		{"files", http.MethodHead, "/v1" + PathFiles + "unknown", http.StatusNotFound, ""},
+		{"files wrong method", http.MethodPut, "/v1" + PathFiles + "unknown", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"refresh", http.MethodPost, "/v1" + PathRefresh, http.StatusUnauthorized, ""},
+		{"refresh wrong method", http.MethodGet, "/v1" + PathRefresh, http.StatusMethodNotAllowed, "POST"},
+		{"openapi", http.MethodGet, "/v1" + PathOpenAPI, http.StatusOK, ""},
+		{"not found", http.MethodGet, "/v1/unknown", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			w := doJSON(t, s.Handler("/v1/"), test.method, test.path, nil)
+
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if allow := w.Header().Get("Allow"); allow != test.allow {
+				t.Errorf("expected Allow %q, got %q", test.allow, allow)
+			}
+			if test.code >= 400 && test.method != http.MethodHead {
+				if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+					t.Errorf("expected problem response, got Content-Type %q", ct)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerWithoutRefresh(t *testing.T) {
+	s, _ := newTestService(t)
+	s.TokenStore = basicStore{}
+
+	if w := doJSON(t, s.Handler(""), http.MethodPost, PathRefresh, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHandlerPlacement(t *testing.T) {
+	s, _ := newTestService(t)
+	h := s.Handler("/v1")
+
+	w := doJSON(t, h, http.MethodPost, "/v1"+PathPlace, map[string]string{"identifier": "serial"})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	resp := new(testPlaceResponse)
+	decode(t, w, resp)
+
+	pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+	if w = doJSON(t, h, http.MethodGet, "/v1"+PathFiles+pl.fsPath, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if w = doJSON(t, h, http.MethodGet, "/v1"+PathStatus+resp.ID, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	status := new(Placement)
+	decode(t, w, status)
+	if status.Status != transport.StatusDownloaded {
+		t.Errorf("expected status %s, got %s", transport.StatusDownloaded, status.Status)
+	}
+}
+
+// prefixTransport is a testTransport that records the file URL prefix set by Handler
+type prefixTransport struct {
+	*testTransport
+	prefix string
+}
+
+func (t *prefixTransport) SetFileURLPrefix(prefix string) {
+	t.prefix = prefix
+}
+
+func TestHandlerFileURLPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		files  string
+	}{
+		{"https://attest.example.com", "https://attest.example.com/files"},
+		{"https://attest.example.com/v1/attest/", "https://attest.example.com/v1/attest/files"},
+		{"http://localhost:8080/v1", "http://localhost:8080/v1/files"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			s, tr := newTestService(t)
+			pt := &prefixTransport{testTransport: tr}
+			s.Transport = pt
+
+			s.Handler(test.prefix)
+			if pt.prefix != test.files {
+				t.Errorf("expected file URL prefix %q, got %q", test.files, pt.prefix)
+			}
+		})
+	}
+}
+
+func TestHandlerInvalidPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		// setter is true if the Transport implements FileURLPrefixSetter
+		setter bool
+	}{
+		{"https://attest.example.com/v1?query", false},
+		{"https://attest.example.com/v1#fragment", false},
+		{"ftp://attest.example.com/v1", false},
+		{"https://attest.example.com/%zz", false},
+		{"/v1", true},
+		{"", true},
+		{"https:///v1", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil || !strings.HasPrefix(r.(error).Error(), "attest: ") {
+					t.Errorf("expected attest panic, got %v", r)
+				}
+			}()
+			s, tr := newTestService(t)
+			if test.setter {
+				s.Transport = &prefixTransport{testTransport: tr}
+			}
+			s.Handler(test.prefix)
+		})
+	}
+}
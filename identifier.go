@@ -0,0 +1,38 @@
+package attest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Identifier types a client can send with its identifier. Transformers can support other types
+const (
+	// IdentifierTypeSerial is a device serial number. It's the default for clients that don't send a type
+	IdentifierTypeSerial = "serial"
+	// IdentifierTypeUDID is a device's MDM UDID, e.g. the provisioning UDID
+	IdentifierTypeUDID = "udid"
+	// IdentifierTypeHardwareUUID is a device's hardware UUID
+	IdentifierTypeHardwareUUID = "hardware_uuid"
+)
+
+// WithIdentifierType returns a copy of ctx with the type of the client-given identifier. PlaceHandler sets it before calling the Transformer
+func WithIdentifierType(ctx context.Context, typ string) context.Context {
+	return context.WithValue(ctx, ContextKeyIdentifierType, typ)
+}
+
+// IdentifierType returns the type of the client-given identifier set in ctx. If it isn't set, IdentifierTypeSerial is returned
+func IdentifierType(ctx context.Context) string {
+	if typ, ok := ctx.Value(ContextKeyIdentifierType).(string); ok && typ != "" {
+		return typ
+	}
+	return IdentifierTypeSerial
+}
+
+// validateIdentifierType returns an error if typ isn't a lowercase name made of letters, digits, and underscores
+func validateIdentifierType(typ string) error {
+	if typ == "" || len(typ) > 64 || strings.Trim(typ, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+		return fmt.Errorf("invalid identifier type: %q", typ)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package attest
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+func TestIdentifierType(t *testing.T) {
+	if typ := IdentifierType(context.Background()); typ != IdentifierTypeSerial {
+		t.Errorf("expected default type %s, got %s", IdentifierTypeSerial, typ)
+	}
+	if typ := IdentifierType(WithIdentifierType(context.Background(), IdentifierTypeUDID)); typ != IdentifierTypeUDID {
+		t.Errorf("expected type %s, got %s", IdentifierTypeUDID, typ)
+	}
+}
+
+func TestValidateIdentifierType(t *testing.T) {
+	tests := []struct {
+		typ   string
+		valid bool
+	}{
+		{IdentifierTypeSerial, true},
+		{IdentifierTypeHardwareUUID, true},
+		{"custom2", true},
+		{"", false},
+		{"Serial", false},
+		{"hardware-uuid", false},
+		{string(make([]byte, 65)), false},
+	}
+
+	for _, test := range tests {
+		if err := validateIdentifierType(test.typ); (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %t, got: %v", test.typ, test.valid, err)
+		}
+	}
+}
+
+// typedTransport is a testTransport that transforms every identifier to "udid" and records the identifier types it's given
+type typedTransport struct {
+	*testTransport
+
+	mu    sync.Mutex
+	types []string
+}
+
+func (t *typedTransport) TransformContext(ctx context.Context, identifier string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.types = append(t.types, IdentifierType(ctx))
+	return "udid", nil
+}
+
+func TestPlaceIdentifierType(t *testing.T) {
+	tests := []struct {
+		name   string
+		typ    string
+		code   int
+		serial string
+		udid   string
+	}{
+		{"default", "", http.StatusAccepted, "client", "udid"},
+		{"serial", IdentifierTypeSerial, http.StatusAccepted, "client", "udid"},
+		{"udid", IdentifierTypeUDID, http.StatusAccepted, "", "client"},
+		{"hardware uuid", IdentifierTypeHardwareUUID, http.StatusAccepted, "", "udid"},
+		{"invalid", "Serial Number", http.StatusBadRequest, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, tr := newTestService(t)
+			typed := &typedTransport{testTransport: tr}
+			s.Transport = typed
+
+			w := doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": "client", "identifier_type": test.typ})
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if test.code != http.StatusAccepted {
+				return
+			}
+			resp := new(testPlaceResponse)
+			decode(t, w, resp)
+
+			typ := test.typ
+			if typ == "" {
+				typ = IdentifierTypeSerial
+			}
+			if len(typed.types) != 1 || typed.types[0] != typ {
+				t.Errorf("expected Transformer to be given type %s, got %v", typ, typed.types)
+			}
+
+			pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+			token, err := s.FileStore.Get(pl.fsPath)
+			if err != nil {
+				t.Fatalf("could not get token: %v", err)
+			}
+			c, err := tokenstore.AuthenticateClaims(s.TokenStore, string(token))
+			if err != nil {
+				t.Fatalf("could not authenticate token: %v", err)
+			}
+			if c.Identifier != "udid" || c.Serial != test.serial || c.UDID != test.udid {
+				t.Errorf("expected claims for udid with serial %q and UDID %q, got: %+v", test.serial, test.udid, c)
+			}
+		})
+	}
+}
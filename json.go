@@ -4,10 +4,48 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"mime"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/logging"
 )
 
+// RequestIDHeader is the header a request ID is read from. If a request doesn't have one, a request ID is generated. The request ID is returned to the client in the same header
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// withRequestID returns r with a request ID in its context and sets the RequestIDHeader header on w. If r's context already has a request ID, r is returned unchanged
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if logging.RequestID(r.Context()) != "" {
+		return r
+	}
+
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		var err error
+		if id, err = randomString(pathSize); err != nil {
+			return r
+		}
+	}
+
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(logging.WithRequestID(r.Context(), id))
+}
+
+// detailError is implemented by errors that carry a description that's safe to return to the client, e.g. *authorizer.DeniedError
+type detailError interface {
+	Detail() string
+}
+
+// retryAfterError is implemented by errors that tell the client when to retry, e.g. *ratelimit.LimitError
+type retryAfterError interface {
+	RetryAfter() time.Duration
+}
+
 func parseJSON(r *http.Request, v interface{}) error {
 	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
@@ -34,21 +72,33 @@ func (s *AttestationService) withJSONResponse(next ReturnHandlerFunc) http.Handl
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
 		code, body := next(w, r)
 		if code == StatusCodeSkip {
 			return
 		}
 
-		if err, ok := body.(error); ok || body == nil {
-			resp := response{Code: code, Description: http.StatusText(code)}
-			body = resp
-			if err != nil && s.Logger != nil {
-				typ := "INFO"
+		if err, ok := body.(error); ok || (body == nil && code >= http.StatusBadRequest) {
+			p := newProblem(r, code, err)
+			var rerr retryAfterError
+			if errors.As(err, &rerr) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rerr.RetryAfter().Seconds()))))
+			}
+			s.setWWWAuthenticate(w, p)
+			if err != nil {
+				args := logging.ContextArgs(r.Context(), logging.KeyStatus, code, logging.KeyError, err)
 				if code >= http.StatusInternalServerError {
-					typ = "ERROR"
+					s.logger().Error("request failed", args...)
+				} else {
+					s.logger().Info("request failed", args...)
 				}
-				s.Logger.Printf("%s: %v\n", typ, err)
 			}
+			s.errorRenderer().RenderError(w, r, p)
+			return
+		}
+
+		if body == nil {
+			body = &response{Code: code, Description: http.StatusText(code)}
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -58,7 +108,12 @@ func (s *AttestationService) withJSONResponse(next ReturnHandlerFunc) http.Handl
 		err := e.Encode(body)
 
 		if err != nil {
-			s.Logger.Println("ERROR: could not encode response:", err)
+			s.logger().Error("could not encode response", logging.ContextArgs(r.Context(), logging.KeyError, err)...)
 		}
 	})
 }
+
+// JSONHandler is a wrapper for a ReturnHandlerFunc that writes the returned body to the client in JSON format. Returned errors are written with the AttestationService's ErrorRenderer
+func (s *AttestationService) JSONHandler(next ReturnHandlerFunc) http.Handler {
+	return s.withJSONResponse(next)
+}
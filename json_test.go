@@ -0,0 +1,51 @@
+package attest
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/korylprince/macos-device-attestation/logging"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"generated", "", false},
+		{"from client", "client-id", true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			buf := new(bytes.Buffer)
+			s.Logger = logging.NewStdLogger(log.New(buf, "", 0))
+
+			// a failed request is logged without starting a placement in the background
+			r := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+			if test.header != "" {
+				r.Header.Set(RequestIDHeader, test.header)
+			}
+			w := httptest.NewRecorder()
+			s.StatusHandler().ServeHTTP(w, r)
+
+			id := w.Header().Get(RequestIDHeader)
+			if id == "" {
+				t.Fatal("expected request id header")
+			}
+			if (id == test.header) != test.keep {
+				t.Errorf("expected client request id kept: %t, got %q", test.keep, id)
+			}
+			if !strings.Contains(buf.String(), `request_id="`+id+`"`) {
+				t.Errorf("expected request id %s in log, got:\n%s", id, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Keys for fields used consistently across log messages
+const (
+	KeyIdentifier       = "identifier"
+	KeyClientIdentifier = "client_identifier"
+	KeyIdentifierType   = "identifier_type"
+	KeyUDID             = "udid"
+	KeySerial           = "serial"
+	KeyPlacementID      = "placement_id"
+	KeyPlacementPath    = "placement_path"
+	KeyFileStorePath    = "filestore_path"
+	KeyRequestID        = "request_id"
+	KeyRemoteAddr       = "remote_addr"
+	KeyStatus           = "status"
+	KeyTransport        = "transport"
+	KeyBackend          = "backend"
+	KeyError            = "error"
+)
+
+// Logger is a structured, leveled logger. args are alternating keys and values, e.g. logger.Info("token placed", logging.KeyIdentifier, udid).
+// *slog.Logger implements Logger
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type discard struct{}
+
+func (discard) Debug(msg string, args ...interface{}) {}
+func (discard) Info(msg string, args ...interface{})  {}
+func (discard) Warn(msg string, args ...interface{})  {}
+func (discard) Error(msg string, args ...interface{}) {}
+
+// Discard is a Logger that discards all messages
+var Discard Logger = discard{}
+
+// OrDiscard returns l, or Discard if l is nil
+func OrDiscard(l Logger) Logger {
+	if l == nil {
+		return Discard
+	}
+	return l
+}
+
+// StdLogger adapts a *log.Logger to Logger. Messages are written as "LEVEL: msg key=value ..."
+type StdLogger struct {
+	*log.Logger
+	// Verbose enables debug messages
+	Verbose bool
+}
+
+// NewStdLogger returns a new StdLogger that writes to l. Debug messages are discarded
+func NewStdLogger(l *log.Logger) *StdLogger {
+	return &StdLogger{Logger: l}
+}
+
+func (l *StdLogger) log(level, msg string, args []interface{}) {
+	b := new(strings.Builder)
+	b.WriteString(level)
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(b, " !BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(b, " %v=%q", args[i], fmt.Sprint(args[i+1]))
+	}
+	l.Logger.Println(b.String())
+}
+
+// Debug logs msg at the DEBUG level if l.Verbose is true
+func (l *StdLogger) Debug(msg string, args ...interface{}) {
+	if l.Verbose {
+		l.log("DEBUG", msg, args)
+	}
+}
+
+// Info logs msg at the INFO level
+func (l *StdLogger) Info(msg string, args ...interface{}) {
+	l.log("INFO", msg, args)
+}
+
+// Warn logs msg at the WARN level
+func (l *StdLogger) Warn(msg string, args ...interface{}) {
+	l.log("WARN", msg, args)
+}
+
+// Error logs msg at the ERROR level
+func (l *StdLogger) Error(msg string, args ...interface{}) {
+	l.log("ERROR", msg, args)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries the request ID id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or an empty string if there isn't one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ContextArgs returns args prefixed with the request ID carried by ctx, if any
+func ContextArgs(ctx context.Context, args ...interface{}) []interface{} {
+	id := RequestID(ctx)
+	if id == "" {
+		return args
+	}
+	return append([]interface{}{KeyRequestID, id}, args...)
+}
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		verbose bool
+		log     func(l Logger)
+		output  string
+	}{
+		{"info", false, func(l Logger) { l.Info("placed", KeyIdentifier, "serial") }, "INFO: placed identifier=\"serial\"\n"},
+		{"quoted values", false, func(l Logger) { l.Warn("failed", KeyError, fmt.Errorf("bad \"thing\"")) }, "WARN: failed error=\"bad \\\"thing\\\"\"\n"},
+		{"odd args", false, func(l Logger) { l.Error("failed", KeyStatus, 500, "dangling") }, "ERROR: failed status=\"500\" !BADKEY=dangling\n"},
+		{"debug discarded", false, func(l Logger) { l.Debug("authenticated") }, ""},
+		{"debug verbose", true, func(l Logger) { l.Debug("authenticated") }, "DEBUG: authenticated\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			l := NewStdLogger(log.New(buf, "", 0))
+			l.Verbose = test.verbose
+			test.log(l)
+			if buf.String() != test.output {
+				t.Errorf("expected %q, got %q", test.output, buf.String())
+			}
+		})
+	}
+}
+
+func TestContextArgs(t *testing.T) {
+	if args := ContextArgs(context.Background(), KeyIdentifier, "serial"); fmt.Sprint(args) != "[identifier serial]" {
+		t.Errorf("expected args unchanged, got %v", args)
+	}
+
+	ctx := WithRequestID(context.Background(), "id")
+	if args := ContextArgs(ctx, KeyIdentifier, "serial"); fmt.Sprint(args) != "[request_id id identifier serial]" {
+		t.Errorf("expected request id prefixed, got %v", args)
+	}
+}
+
+func TestOrDiscard(t *testing.T) {
+	if OrDiscard(nil) != Discard {
+		t.Error("expected Discard for nil Logger")
+	}
+	l := NewStdLogger(log.Default())
+	if OrDiscard(l) != l {
+		t.Error("expected Logger to be returned unchanged")
+	}
+}
@@ -1,6 +1,8 @@
 package mdm
 
 import (
+	"context"
+
 	macospkg "github.com/korylprince/go-macos-pkg"
 )
 
@@ -11,3 +13,38 @@ type MDM interface {
 	// Transform returns the UDID for the given serial. If the serial is not found, attest.ErrInvalidIdentifier is returned
 	Transform(serial string) (udid string, err error)
 }
+
+// ContextMDM is an optional interface an MDM can implement to accept a context.Context.
+// Implementers should abort any requests to the MDM server when ctx is canceled
+type ContextMDM interface {
+	// InstallEnterpriseApplicationContext runs the InstallEnterpriseApplication command with the given udid and manifest
+	InstallEnterpriseApplicationContext(ctx context.Context, udid string, manifest *macospkg.Manifest) error
+	// TransformContext returns the UDID for the given serial. If the serial is not found, attest.ErrInvalidIdentifier is returned
+	TransformContext(ctx context.Context, serial string) (udid string, err error)
+}
+
+type contextMDM struct {
+	MDM
+}
+
+func (m contextMDM) InstallEnterpriseApplicationContext(ctx context.Context, udid string, manifest *macospkg.Manifest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.InstallEnterpriseApplication(udid, manifest)
+}
+
+func (m contextMDM) TransformContext(ctx context.Context, serial string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return m.Transform(serial)
+}
+
+// WithContext returns m as a ContextMDM. If m doesn't implement ContextMDM, it is wrapped so that the context is only checked before each call
+func WithContext(m MDM) ContextMDM {
+	if cm, ok := m.(ContextMDM); ok {
+		return cm
+	}
+	return contextMDM{m}
+}
@@ -2,6 +2,7 @@ package micromdm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 	macospkg "github.com/korylprince/go-macos-pkg"
 	attest "github.com/korylprince/macos-device-attestation"
+	"github.com/korylprince/macos-device-attestation/logging"
 )
 
 // MDM implements the MDM interface. The interface has a configurable cache for serial-to-UDID lookups
@@ -16,7 +18,9 @@ type MDM struct {
 	// URLPrefix is the prefix for MDM without the trailing slash, e.g. https://mdm.example.com
 	URLPrefix string
 	Token     string
-	cache     *lru.TwoQueueCache
+	// Logger is an optional logging.Logger
+	Logger logging.Logger
+	cache  *lru.TwoQueueCache
 }
 
 // New returns new MDM with the given parameters. size is the size (number of items) of the cache.
@@ -31,6 +35,12 @@ func New(prefix, token string, size int) (*MDM, error) {
 
 // Transform returns the UDID for the given serial. If the serial is not found, attest.ErrInvalidIdentifier is returned
 func (m *MDM) Transform(serial string) (string, error) {
+	return m.TransformContext(context.Background(), serial)
+}
+
+// TransformContext returns the UDID for the given serial. If attest.IdentifierType(ctx) is attest.IdentifierTypeUDID, serial is a UDID that's looked up instead.
+// If the device is not found or the identifier type isn't supported, attest.ErrInvalidIdentifier is returned
+func (m *MDM) TransformContext(ctx context.Context, serial string) (string, error) {
 	type response struct {
 		Devices []struct {
 			UDID string `json:"udid"`
@@ -38,12 +48,24 @@ func (m *MDM) Transform(serial string) (string, error) {
 		Error string `json:"error"`
 	}
 
-	if udid, ok := m.cache.Get(serial); ok {
+	typ := attest.IdentifierType(ctx)
+	filter, key := "filter_serial", serial
+	switch typ {
+	case attest.IdentifierTypeSerial:
+	case attest.IdentifierTypeUDID:
+		filter, key = "filter_udid", "udid:"+serial
+	default:
+		logging.OrDiscard(m.Logger).Info("unsupported identifier type", logging.ContextArgs(ctx, logging.KeyIdentifier, serial, logging.KeyIdentifierType, typ)...)
+		return "", fmt.Errorf("unsupported identifier type %q: %w", typ, attest.ErrInvalidIdentifier)
+	}
+
+	if udid, ok := m.cache.Get(key); ok {
+		logging.OrDiscard(m.Logger).Debug("serial found in cache", logging.ContextArgs(ctx, logging.KeySerial, serial, logging.KeyIdentifierType, typ, logging.KeyUDID, udid)...)
 		return udid.(string), nil
 	}
 
 	q := map[string]interface{}{
-		"filter_serial": []string{serial},
+		filter: []string{serial},
 	}
 
 	j, err := json.Marshal(q)
@@ -51,7 +73,7 @@ func (m *MDM) Transform(serial string) (string, error) {
 		return "", fmt.Errorf("could not marshal query: %w", err)
 	}
 
-	r, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/devices", m.URLPrefix), bytes.NewBuffer(j))
+	r, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/v1/devices", m.URLPrefix), bytes.NewBuffer(j))
 	if err != nil {
 		return "", fmt.Errorf("could not create request: %w", err)
 	}
@@ -74,16 +96,23 @@ func (m *MDM) Transform(serial string) (string, error) {
 	}
 
 	if len(resp.Devices) != 1 || resp.Devices[0].UDID == "" {
+		logging.OrDiscard(m.Logger).Info("serial not found", logging.ContextArgs(ctx, logging.KeySerial, serial, logging.KeyIdentifierType, typ, "devices", len(resp.Devices))...)
 		return "", attest.ErrInvalidIdentifier
 	}
 
-	m.cache.Add(serial, resp.Devices[0].UDID)
+	m.cache.Add(key, resp.Devices[0].UDID)
+	logging.OrDiscard(m.Logger).Debug("serial found", logging.ContextArgs(ctx, logging.KeySerial, serial, logging.KeyIdentifierType, typ, logging.KeyUDID, resp.Devices[0].UDID)...)
 
 	return resp.Devices[0].UDID, nil
 }
 
 // InstallEnterpriseApplication runs the InstallEnterpriseApplication command with the given udid and manifest
 func (m *MDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) error {
+	return m.InstallEnterpriseApplicationContext(context.Background(), udid, manifest)
+}
+
+// InstallEnterpriseApplicationContext runs the InstallEnterpriseApplication command with the given udid and manifest
+func (m *MDM) InstallEnterpriseApplicationContext(ctx context.Context, udid string, manifest *macospkg.Manifest) error {
 	type response struct {
 		Error string `json:"error"`
 	}
@@ -99,7 +128,7 @@ func (m *MDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manif
 		return fmt.Errorf("could not marshal command: %w", err)
 	}
 
-	r, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/commands", m.URLPrefix), bytes.NewBuffer(j))
+	r, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/v1/commands", m.URLPrefix), bytes.NewBuffer(j))
 	if err != nil {
 		return fmt.Errorf("could not create request: %w", err)
 	}
@@ -121,5 +150,7 @@ func (m *MDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manif
 		return fmt.Errorf("could not execute command: %s", resp.Error)
 	}
 
+	logging.OrDiscard(m.Logger).Debug("command queued", logging.ContextArgs(ctx, logging.KeyUDID, udid, "request_type", "InstallEnterpriseApplication")...)
+
 	return nil
 }
@@ -0,0 +1,92 @@
+package micromdm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	attest "github.com/korylprince/macos-device-attestation"
+)
+
+// testServer is a MicroMDM devices API that knows one device and counts its queries
+type testServer struct {
+	mu      sync.Mutex
+	queries []map[string][]string
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, token, ok := r.BasicAuth(); !ok || token != "token" || r.URL.Path != "/v1/devices" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	q := make(map[string][]string)
+	json.NewDecoder(r.Body).Decode(&q)
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+
+	var devices []map[string]string
+	if (len(q["filter_serial"]) == 1 && q["filter_serial"][0] == "serial") || (len(q["filter_udid"]) == 1 && q["filter_udid"][0] == "udid") {
+		devices = append(devices, map[string]string{"udid": "udid"})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"devices": devices})
+}
+
+func TestTransformContext(t *testing.T) {
+	tests := []struct {
+		name       string
+		typ        string
+		identifier string
+		udid       string
+		err        error
+		queries    int
+	}{
+		{"serial", attest.IdentifierTypeSerial, "serial", "udid", nil, 1},
+		{"udid", attest.IdentifierTypeUDID, "udid", "udid", nil, 1},
+		{"serial not found", attest.IdentifierTypeSerial, "udid", "", attest.ErrInvalidIdentifier, 2},
+		{"unsupported type", attest.IdentifierTypeHardwareUUID, "serial", "", attest.ErrInvalidIdentifier, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := new(testServer)
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			m, err := New(srv.URL, "token", 10)
+			if err != nil {
+				t.Fatalf("could not create mdm: %v", err)
+			}
+
+			ctx := attest.WithIdentifierType(context.Background(), test.typ)
+			// the second lookup is cached if the device is found
+			for i := 0; i < 2; i++ {
+				udid, err := m.TransformContext(ctx, test.identifier)
+				if !errors.Is(err, test.err) || udid != test.udid {
+					t.Fatalf("expected %q, %v, got %q, %v", test.udid, test.err, udid, err)
+				}
+			}
+			if len(s.queries) != test.queries {
+				t.Errorf("expected %d queries, got %d: %v", test.queries, len(s.queries), s.queries)
+			}
+		})
+	}
+}
+
+func TestTransformError(t *testing.T) {
+	srv := httptest.NewServer(new(testServer))
+	defer srv.Close()
+	m, err := New(srv.URL, "wrong", 10)
+	if err != nil {
+		t.Fatalf("could not create mdm: %v", err)
+	}
+
+	if _, err = m.Transform("serial"); err == nil || errors.Is(err, attest.ErrInvalidIdentifier) {
+		t.Errorf("expected query error, got %v", err)
+	}
+}
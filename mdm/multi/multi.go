@@ -0,0 +1,162 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	macospkg "github.com/korylprince/go-macos-pkg"
+	attest "github.com/korylprince/macos-device-attestation"
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/mdm"
+)
+
+// ErrUnknownOwner is returned by InstallEnterpriseApplication when the backend that owns a UDID isn't known, because it wasn't returned by Transform or was evicted from the cache
+var ErrUnknownOwner = errors.New("owner of udid unknown")
+
+// Backend is an mdm.MDM used by a multi MDM
+type Backend struct {
+	// Name identifies the backend in logs and errors
+	Name string
+	mdm.MDM
+}
+
+// DuplicateError is returned by Transform when RejectDuplicates is set and a serial is found in more than one backend. It wraps attest.ErrInvalidIdentifier
+type DuplicateError struct {
+	Serial   string
+	Backends []string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("serial %s found in multiple backends: %s", e.Serial, strings.Join(e.Backends, ", "))
+}
+
+func (e *DuplicateError) Unwrap() error {
+	return attest.ErrInvalidIdentifier
+}
+
+// MDM implements mdm.MDM by routing to several backends. Transform queries all backends concurrently and remembers which backend owns the returned UDID,
+// and InstallEnterpriseApplication is sent to that backend. If a serial is found in more than one backend, the first in the order given to New wins
+type MDM struct {
+	backends []*Backend
+	owners   *lru.TwoQueueCache
+	// RejectDuplicates causes Transform to return a *DuplicateError instead of using the first backend when a serial is found in more than one backend.
+	// Since a backend that fails to respond might also know the serial, Transform returns an error if any backend fails, not only one before the owner
+	RejectDuplicates bool
+	// Logger is an optional logging.Logger
+	Logger logging.Logger
+}
+
+// New returns a new MDM that routes to backends. size is the size (number of items) of the cache of UDID owners
+func New(size int, backends ...*Backend) (*MDM, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no backends given")
+	}
+
+	owners, err := lru.New2Q(size)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cache: %w", err)
+	}
+
+	return &MDM{backends: backends, owners: owners}, nil
+}
+
+// Transform returns the UDID for the given serial. If the serial is not found, attest.ErrInvalidIdentifier is returned
+func (m *MDM) Transform(serial string) (string, error) {
+	return m.TransformContext(context.Background(), serial)
+}
+
+// TransformContext queries all backends concurrently and returns the UDID for the given serial from the first backend, in order, that knows it.
+// If a backend before it (or any backend, if RejectDuplicates is set) returns an error other than attest.ErrInvalidIdentifier, the error is returned so that devices are never routed to the wrong backend.
+// If the serial is not found, attest.ErrInvalidIdentifier is returned
+func (m *MDM) TransformContext(ctx context.Context, serial string) (string, error) {
+	type result struct {
+		udid string
+		err  error
+	}
+
+	results := make([]result, len(m.backends))
+	var wg sync.WaitGroup
+	for i, b := range m.backends {
+		wg.Add(1)
+		go func(i int, b *Backend) {
+			defer wg.Done()
+			udid, err := mdm.WithContext(b.MDM).TransformContext(ctx, serial)
+			results[i] = result{udid: udid, err: err}
+		}(i, b)
+	}
+	wg.Wait()
+
+	owner := -1
+	var found []string
+	for i, r := range results {
+		b := m.backends[i]
+		if errors.Is(r.err, attest.ErrInvalidIdentifier) {
+			continue
+		}
+		if r.err != nil {
+			// with RejectDuplicates, a failed backend could be hiding a duplicate
+			if owner == -1 || m.RejectDuplicates {
+				return "", fmt.Errorf("could not query %s: %w", b.Name, r.err)
+			}
+			logging.OrDiscard(m.Logger).Warn("could not query backend", logging.ContextArgs(ctx,
+				logging.KeyBackend, b.Name,
+				logging.KeySerial, serial,
+				logging.KeyError, r.err,
+			)...)
+			continue
+		}
+		if owner == -1 {
+			owner = i
+		}
+		found = append(found, b.Name)
+	}
+
+	if owner == -1 {
+		return "", attest.ErrInvalidIdentifier
+	}
+
+	if len(found) > 1 {
+		if m.RejectDuplicates {
+			return "", &DuplicateError{Serial: serial, Backends: found}
+		}
+		logging.OrDiscard(m.Logger).Warn("serial found in multiple backends", logging.ContextArgs(ctx,
+			logging.KeySerial, serial,
+			"backends", strings.Join(found, ","),
+			logging.KeyBackend, m.backends[owner].Name,
+		)...)
+	}
+
+	udid := results[owner].udid
+	m.owners.Add(udid, owner)
+	logging.OrDiscard(m.Logger).Debug("serial owner found", logging.ContextArgs(ctx,
+		logging.KeySerial, serial,
+		logging.KeyUDID, udid,
+		logging.KeyBackend, m.backends[owner].Name,
+	)...)
+
+	return udid, nil
+}
+
+// InstallEnterpriseApplication runs the InstallEnterpriseApplication command with the given udid and manifest
+func (m *MDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) error {
+	return m.InstallEnterpriseApplicationContext(context.Background(), udid, manifest)
+}
+
+// InstallEnterpriseApplicationContext runs the InstallEnterpriseApplication command on the backend that owns udid.
+// If the owner isn't known, ErrUnknownOwner is returned
+func (m *MDM) InstallEnterpriseApplicationContext(ctx context.Context, udid string, manifest *macospkg.Manifest) error {
+	owner, ok := m.owners.Get(udid)
+	if !ok {
+		return ErrUnknownOwner
+	}
+	b := m.backends[owner.(int)]
+
+	if err := mdm.WithContext(b.MDM).InstallEnterpriseApplicationContext(ctx, udid, manifest); err != nil {
+		return fmt.Errorf("could not run command on %s: %w", b.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package multi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	macospkg "github.com/korylprince/go-macos-pkg"
+	attest "github.com/korylprince/macos-device-attestation"
+	"github.com/korylprince/macos-device-attestation/mdm/micromdm"
+)
+
+// testMDM is an mdm.MDM that knows the serials in udids. If err is set, Transform returns it
+type testMDM struct {
+	udids map[string]string
+	err   error
+
+	mu        sync.Mutex
+	installed []string
+}
+
+func (m *testMDM) Transform(serial string) (string, error) {
+	if m.err != nil {
+		return "", m.err
+	}
+	udid, ok := m.udids[serial]
+	if !ok {
+		return "", attest.ErrInvalidIdentifier
+	}
+	return udid, nil
+}
+
+func (m *testMDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.installed = append(m.installed, udid)
+	return nil
+}
+
+func newTestMDM(t *testing.T, rejectDuplicates bool, mdms ...*testMDM) *MDM {
+	t.Helper()
+	var backends []*Backend
+	for idx, m := range mdms {
+		backends = append(backends, &Backend{Name: fmt.Sprint(idx), MDM: m})
+	}
+	m, err := New(100, backends...)
+	if err != nil {
+		t.Fatalf("could not create mdm: %v", err)
+	}
+	m.RejectDuplicates = rejectDuplicates
+	return m
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(100); err == nil {
+		t.Error("expected error for no backends")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	errFailed := errors.New("failed")
+	known := func(udid string) *testMDM { return &testMDM{udids: map[string]string{"serial": udid}} }
+	unknown := func() *testMDM { return &testMDM{} }
+	failing := func() *testMDM { return &testMDM{err: errFailed} }
+
+	tests := []struct {
+		name             string
+		mdms             []*testMDM
+		rejectDuplicates bool
+		udid             string
+		owner            int
+		err              error
+	}{
+		{"found", []*testMDM{unknown(), known("udid1")}, false, "udid1", 1, nil},
+		{"not found", []*testMDM{unknown(), unknown()}, false, "", -1, attest.ErrInvalidIdentifier},
+		{"first wins", []*testMDM{known("udid0"), known("udid1")}, false, "udid0", 0, nil},
+		{"duplicate rejected", []*testMDM{known("udid0"), known("udid1")}, true, "", -1, attest.ErrInvalidIdentifier},
+		{"failed before owner", []*testMDM{failing(), known("udid1")}, false, "", -1, errFailed},
+		{"failed after owner", []*testMDM{known("udid0"), failing()}, false, "udid0", 0, nil},
+		{"failed after owner with duplicates rejected", []*testMDM{known("udid0"), failing()}, true, "", -1, errFailed},
+		{"found with duplicates rejected", []*testMDM{unknown(), known("udid1")}, true, "udid1", 1, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestMDM(t, test.rejectDuplicates, test.mdms...)
+
+			udid, err := m.Transform("serial")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if udid != test.udid {
+				t.Fatalf("expected udid %q, got %q", test.udid, udid)
+			}
+			if test.err != nil {
+				return
+			}
+
+			if err = m.InstallEnterpriseApplication(udid, nil); err != nil {
+				t.Fatalf("could not install: %v", err)
+			}
+			for idx, b := range test.mdms {
+				if installed := len(b.installed) == 1; installed != (idx == test.owner) {
+					t.Errorf("backend %d: expected installed %t, got %v", idx, idx == test.owner, b.installed)
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicateError(t *testing.T) {
+	m := newTestMDM(t, true, &testMDM{udids: map[string]string{"serial": "a"}}, &testMDM{}, &testMDM{udids: map[string]string{"serial": "b"}})
+
+	_, err := m.Transform("serial")
+	var derr *DuplicateError
+	if !errors.As(err, &derr) {
+		t.Fatalf("expected *DuplicateError, got %v", err)
+	}
+	if derr.Serial != "serial" || fmt.Sprint(derr.Backends) != "[0 2]" {
+		t.Errorf("expected serial found in backends 0 and 2, got: %+v", derr)
+	}
+}
+
+func TestInstallUnknownOwner(t *testing.T) {
+	m := newTestMDM(t, false, &testMDM{})
+	if err := m.InstallEnterpriseApplicationContext(context.Background(), "udid", nil); !errors.Is(err, ErrUnknownOwner) {
+		t.Errorf("expected ErrUnknownOwner, got %v", err)
+	}
+}
+
+// mdmServer is a MicroMDM API that knows the serials in udids and records the UDIDs it's sent commands for
+type mdmServer struct {
+	udids map[string]string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func (s *mdmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := make(map[string]interface{})
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch r.URL.Path {
+	case "/v1/devices":
+		var devices []map[string]string
+		if serials, ok := body["filter_serial"].([]interface{}); ok && len(serials) == 1 {
+			if udid, ok := s.udids[fmt.Sprint(serials[0])]; ok {
+				devices = append(devices, map[string]string{"udid": udid})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": devices})
+	case "/v1/commands":
+		s.mu.Lock()
+		s.commands = append(s.commands, fmt.Sprint(body["udid"]))
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+	}
+}
+
+func TestMicroMDMBackends(t *testing.T) {
+	servers := []*mdmServer{
+		{udids: map[string]string{"serial0": "udid0"}},
+		{udids: map[string]string{"serial1": "udid1"}},
+	}
+	var backends []*Backend
+	for idx, s := range servers {
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		m, err := micromdm.New(srv.URL, "token", 10)
+		if err != nil {
+			t.Fatalf("could not create MDM: %v", err)
+		}
+		backends = append(backends, &Backend{Name: fmt.Sprint(idx), MDM: m})
+	}
+
+	m, err := New(10, backends...)
+	if err != nil {
+		t.Fatalf("could not create MDM: %v", err)
+	}
+
+	for idx := range servers {
+		udid, err := m.Transform(fmt.Sprintf("serial%d", idx))
+		if err != nil {
+			t.Fatalf("could not transform serial%d: %v", idx, err)
+		}
+		if err = m.InstallEnterpriseApplication(udid, nil); err != nil {
+			t.Fatalf("could not install: %v", err)
+		}
+	}
+	if _, err = m.Transform("unknown"); !errors.Is(err, attest.ErrInvalidIdentifier) {
+		t.Errorf("expected ErrInvalidIdentifier, got %v", err)
+	}
+
+	for idx, s := range servers {
+		if expected := fmt.Sprintf("[udid%d]", idx); fmt.Sprint(s.commands) != expected {
+			t.Errorf("server %d: expected commands for %s, got %v", idx, expected, s.commands)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package attest
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/authorizer"
+	"github.com/korylprince/macos-device-attestation/filestore"
+	"github.com/korylprince/macos-device-attestation/ratelimit"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+// Operations observed by an AttestationService's Metrics
+const (
+	OpPlace          = "place"
+	OpFileStore      = "filestore"
+	OpMiddleware     = "middleware"
+	OpTransform      = "transform"
+	OpTransportPlace = "transport_place"
+	OpRefresh        = "refresh"
+)
+
+// Metrics is an interface to record metrics about attestation operations. See the metrics package for an implementation
+type Metrics interface {
+	// Observe records that the operation op took d. cause is empty if the operation succeeded, otherwise it's a short, low-cardinality description of why it failed. See Cause
+	Observe(op string, d time.Duration, cause string)
+}
+
+// Cause returns a short, low-cardinality label describing err, suitable for use as a Metrics cause. If err is nil, Cause returns an empty string
+func Cause(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.Is(err, ErrInvalidIdentifier):
+		return "invalid_identifier"
+	case errors.Is(err, ErrMissingToken):
+		return "missing_token"
+	case errors.Is(err, filestore.ErrNotFound):
+		return "not_found"
+	case errors.As(err, new(*tokenstore.InvalidTokenError)):
+		return "invalid_token"
+	case errors.As(err, new(*ratelimit.LimitError)):
+		return "rate_limited"
+	case errors.As(err, new(*authorizer.DeniedError)):
+		return "denied"
+	case errors.As(err, new(*InsufficientScopeError)):
+		return "insufficient_scope"
+	}
+	return "error"
+}
+
+// observe records op to the Metrics, if any. Unclassified errors with a client error code are recorded as "bad_request"
+func (s *AttestationService) observe(op string, start time.Time, code int, err error) {
+	if s.Metrics == nil {
+		return
+	}
+	cause := Cause(err)
+	if cause == "error" && code >= 400 && code < 500 {
+		cause = "bad_request"
+	}
+	s.Metrics.Observe(op, time.Since(start), cause)
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	macospkg "github.com/korylprince/go-macos-pkg"
+	attest "github.com/korylprince/macos-device-attestation"
+	"github.com/korylprince/macos-device-attestation/mdm"
+)
+
+// Operations observed by MDM
+const (
+	OpMDMTransform                    = "mdm_transform"
+	OpMDMInstallEnterpriseApplication = "mdm_install_enterprise_application"
+)
+
+// MDM wraps an mdm.MDM and records the duration and outcome of its calls
+type MDM struct {
+	mdm     mdm.ContextMDM
+	metrics attest.Metrics
+}
+
+// NewMDM returns a new MDM that wraps m and records to metrics
+func NewMDM(m mdm.MDM, metrics attest.Metrics) *MDM {
+	return &MDM{mdm: mdm.WithContext(m), metrics: metrics}
+}
+
+// InstallEnterpriseApplication runs the InstallEnterpriseApplication command with the given udid and manifest
+func (m *MDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) error {
+	return m.InstallEnterpriseApplicationContext(context.Background(), udid, manifest)
+}
+
+// InstallEnterpriseApplicationContext runs the InstallEnterpriseApplication command with the given udid and manifest
+func (m *MDM) InstallEnterpriseApplicationContext(ctx context.Context, udid string, manifest *macospkg.Manifest) error {
+	start := time.Now()
+	err := m.mdm.InstallEnterpriseApplicationContext(ctx, udid, manifest)
+	m.metrics.Observe(OpMDMInstallEnterpriseApplication, time.Since(start), attest.Cause(err))
+	return err
+}
+
+// Transform returns the UDID for the given serial. If the serial is not found, attest.ErrInvalidIdentifier is returned
+func (m *MDM) Transform(serial string) (string, error) {
+	return m.TransformContext(context.Background(), serial)
+}
+
+// TransformContext returns the UDID for the given serial. If the serial is not found, attest.ErrInvalidIdentifier is returned
+func (m *MDM) TransformContext(ctx context.Context, serial string) (string, error) {
+	start := time.Now()
+	udid, err := m.mdm.TransformContext(ctx, serial)
+	m.metrics.Observe(OpMDMTransform, time.Since(start), attest.Cause(err))
+	return udid, err
+}
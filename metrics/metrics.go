@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Namespace prefixes all metric names
+const Namespace = "attest"
+
+// DefaultBuckets are the default histogram buckets, in seconds. They cover fast local operations up to slow MDM placements
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type errorKey struct {
+	op    string
+	cause string
+}
+
+type gauge struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// Registry implements attest.Metrics in memory with latency histograms and error counters labelled by operation and cause.
+// Registry can be exposed in the Prometheus text format with Handler, or with expvar with Publish
+type Registry struct {
+	buckets []float64
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+	errors     map[errorKey]uint64
+	gauges     []*gauge
+}
+
+// New returns a new Registry with the given histogram buckets (in seconds). If buckets is nil, DefaultBuckets is used
+func New(buckets []float64) *Registry {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Registry{buckets: b, histograms: make(map[string]*histogram), errors: make(map[errorKey]uint64)}
+}
+
+// Observe records that the operation op took d. If cause is not empty, the operation is counted as an error with that cause
+func (r *Registry) Observe(op string, d time.Duration, cause string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.histograms[op]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(r.buckets))}
+		r.histograms[op] = h
+	}
+
+	secs := d.Seconds()
+	for i, b := range r.buckets {
+		if secs <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += secs
+	h.count++
+
+	if cause != "" {
+		r.errors[errorKey{op: op, cause: cause}]++
+	}
+}
+
+// GaugeFunc registers a gauge with the given name and help text whose value is read from f when the metrics are exported, e.g. the Len of a store.
+// name should be in snake_case and will be prefixed with Namespace. f is called while the Registry is locked, so it must not call the Registry
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges = append(r.gauges, &gauge{name: name, help: help, f: f})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (r *Registry) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ops := make([]string, 0, len(r.histograms))
+	for op := range r.histograms {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	name := Namespace + "_operation_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of attestation operations\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, op := range ops {
+		h := r.histograms[op]
+		for i, b := range r.buckets {
+			fmt.Fprintf(w, "%s_bucket{op=%q,le=%q} %d\n", name, op, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{op=%q,le=\"+Inf\"} %d\n", name, op, h.count)
+		fmt.Fprintf(w, "%s_sum{op=%q} %s\n", name, op, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{op=%q} %d\n", name, op, h.count)
+	}
+
+	keys := make([]errorKey, 0, len(r.errors))
+	for k := range r.errors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].cause < keys[j].cause
+	})
+
+	name = Namespace + "_operation_errors_total"
+	fmt.Fprintf(w, "# HELP %s Failed attestation operations by cause\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{op=%q,cause=%q} %d\n", name, k.op, k.cause, r.errors[k])
+	}
+
+	for _, g := range r.gauges {
+		name = Namespace + "_" + g.name
+		fmt.Fprintf(w, "# HELP %s %s\n", name, g.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(g.f()))
+	}
+}
+
+// Handler is an http.Handler that serves the metrics in the Prometheus text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf := new(bytes.Buffer)
+		r.WritePrometheus(buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+// Snapshot returns the current metrics as a JSON-compatible map
+func (r *Registry) Snapshot() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type histogramSnapshot struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Sum     float64           `json:"sum"`
+		Count   uint64            `json:"count"`
+	}
+
+	durations := make(map[string]*histogramSnapshot, len(r.histograms))
+	for op, h := range r.histograms {
+		hs := &histogramSnapshot{Buckets: make(map[string]uint64, len(r.buckets)), Sum: h.sum, Count: h.count}
+		for i, b := range r.buckets {
+			hs.Buckets[formatFloat(b)] = h.counts[i]
+		}
+		durations[op] = hs
+	}
+
+	errs := make(map[string]map[string]uint64)
+	for k, v := range r.errors {
+		if errs[k.op] == nil {
+			errs[k.op] = make(map[string]uint64)
+		}
+		errs[k.op][k.cause] = v
+	}
+
+	gauges := make(map[string]float64, len(r.gauges))
+	for _, g := range r.gauges {
+		gauges[g.name] = g.f()
+	}
+
+	return map[string]interface{}{
+		"durations": durations,
+		"errors":    errs,
+		"gauges":    gauges,
+	}
+}
+
+// Publish publishes the metrics with expvar under name. They are then served by expvar.Handler. Like expvar.Publish, Publish panics if name is already registered
+func (r *Registry) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return r.Snapshot() }))
+}
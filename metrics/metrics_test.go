@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := New([]float64{1, 0.1})
+	r.Observe("place", 50*time.Millisecond, "")
+	r.Observe("place", 500*time.Millisecond, "rate_limited")
+	r.Observe("place", 2*time.Second, "rate_limited")
+	r.Observe("filestore", time.Millisecond, "not_found")
+	r.GaugeFunc("placements", "Placements tracked", func() float64 { return 3 })
+
+	buf := new(bytes.Buffer)
+	r.WritePrometheus(buf)
+
+	expected := `# HELP attest_operation_duration_seconds Duration of attestation operations
+# TYPE attest_operation_duration_seconds histogram
+attest_operation_duration_seconds_bucket{op="filestore",le="0.1"} 1
+attest_operation_duration_seconds_bucket{op="filestore",le="1"} 1
+attest_operation_duration_seconds_bucket{op="filestore",le="+Inf"} 1
+attest_operation_duration_seconds_sum{op="filestore"} 0.001
+attest_operation_duration_seconds_count{op="filestore"} 1
+attest_operation_duration_seconds_bucket{op="place",le="0.1"} 1
+attest_operation_duration_seconds_bucket{op="place",le="1"} 2
+attest_operation_duration_seconds_bucket{op="place",le="+Inf"} 3
+attest_operation_duration_seconds_sum{op="place"} 2.55
+attest_operation_duration_seconds_count{op="place"} 3
+# HELP attest_operation_errors_total Failed attestation operations by cause
+# TYPE attest_operation_errors_total counter
+attest_operation_errors_total{op="filestore",cause="not_found"} 1
+attest_operation_errors_total{op="place",cause="rate_limited"} 2
+# HELP attest_placements Placements tracked
+# TYPE attest_placements gauge
+attest_placements 3
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := New(nil)
+	r.Observe("place", time.Millisecond, "")
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected Prometheus content type, got %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), `attest_operation_duration_seconds_count{op="place"} 1`) {
+		t.Errorf("expected place count in body, got:\n%s", w.Body.String())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r := New([]float64{1})
+	r.Observe("place", 500*time.Millisecond, "")
+	r.Observe("place", 2*time.Second, "error")
+	r.GaugeFunc("files", "Files", func() float64 { return 5 })
+
+	// the snapshot is served as JSON by expvar
+	buf, err := json.Marshal(r.Snapshot())
+	if err != nil {
+		t.Fatalf("could not marshal snapshot: %v", err)
+	}
+	snap := new(struct {
+		Durations map[string]struct {
+			Buckets map[string]uint64 `json:"buckets"`
+			Sum     float64           `json:"sum"`
+			Count   uint64            `json:"count"`
+		} `json:"durations"`
+		Errors map[string]map[string]uint64 `json:"errors"`
+		Gauges map[string]float64           `json:"gauges"`
+	})
+	if err = json.Unmarshal(buf, snap); err != nil {
+		t.Fatalf("could not parse snapshot: %v", err)
+	}
+
+	if h := snap.Durations["place"]; h.Count != 2 || h.Sum != 2.5 || h.Buckets["1"] != 1 {
+		t.Errorf("expected 2 place durations with 1 under 1s, got: %+v", h)
+	}
+	if snap.Errors["place"]["error"] != 1 {
+		t.Errorf("expected 1 place error, got %v", snap.Errors)
+	}
+	if snap.Gauges["files"] != 5 {
+		t.Errorf("expected files gauge 5, got %v", snap.Gauges)
+	}
+}
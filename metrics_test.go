@@ -0,0 +1,89 @@
+package attest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/filestore"
+	"github.com/korylprince/macos-device-attestation/ratelimit"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+func TestCause(t *testing.T) {
+	tests := []struct {
+		err   error
+		cause string
+	}{
+		{nil, ""},
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), "deadline_exceeded"},
+		{fmt.Errorf("wrapped: %w", ErrInvalidIdentifier), "invalid_identifier"},
+		{filestore.ErrNotFound, "not_found"},
+		{&tokenstore.InvalidTokenError{Err: errors.New("expired")}, "invalid_token"},
+		{fmt.Errorf("wrapped: %w", &ratelimit.LimitError{Kind: ratelimit.KindGlobal}), "rate_limited"},
+		{errors.New("other"), "error"},
+	}
+
+	for _, test := range tests {
+		if cause := Cause(test.err); cause != test.cause {
+			t.Errorf("%v: expected cause %q, got %q", test.err, test.cause, cause)
+		}
+	}
+}
+
+// recordMetrics is a Metrics that records the causes observed for each operation
+type recordMetrics struct {
+	mu     sync.Mutex
+	causes map[string][]string
+}
+
+func (m *recordMetrics) Observe(op string, d time.Duration, cause string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.causes == nil {
+		m.causes = make(map[string][]string)
+	}
+	m.causes[op] = append(m.causes[op], cause)
+}
+
+func (m *recordMetrics) get(op string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.causes[op]...)
+}
+
+func TestPlaceMetrics(t *testing.T) {
+	s, tr := newTestService(t)
+	s.Transport = &transformingTransport{tr, map[string]string{"serial": "udid"}}
+	m := new(recordMetrics)
+	s.Metrics = m
+
+	place(t, s, "serial")
+	doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": "unknown"})
+	doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": ""})
+
+	// the transport place is observed in the background
+	for deadline := time.Now().Add(2 * time.Second); len(m.get(OpTransportPlace)) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		op     string
+		causes []string
+	}{
+		{OpPlace, []string{"", "invalid_identifier", "bad_request"}},
+		{OpTransform, []string{"", "invalid_identifier"}},
+		{OpTransportPlace, []string{""}},
+	}
+
+	for _, test := range tests {
+		if causes := m.get(test.op); fmt.Sprint(causes) != fmt.Sprint(test.causes) {
+			t.Errorf("%s: expected causes %q, got %q", test.op, test.causes, causes)
+		}
+	}
+}
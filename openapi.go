@@ -0,0 +1,299 @@
+package attest
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+// Paths of the AttestationService's handlers relative to the prefix given to OpenAPI
+const (
+	PathPlace   = "/place"
+	PathStatus  = "/status/"
+	PathFiles   = "/files/"
+	PathRefresh = "/refresh"
+	PathOpenAPI = "/openapi.json"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification documents are generated for
+const OpenAPIVersion = "3.0.3"
+
+// Endpoint describes an endpoint protected by Middleware to include in the OpenAPI document
+type Endpoint struct {
+	// Method is the HTTP method, e.g. GET
+	Method string
+	// Path is the full path of the endpoint, including any prefix
+	Path    string
+	Summary string
+	// Scopes are the scopes required by the endpoint, if any. See RequireScopes
+	Scopes []string
+	// Request is a value of the type of the JSON request body, or nil if the endpoint doesn't take one
+	Request interface{}
+	// Response is a value of the type of the JSON response body, or nil if the endpoint doesn't return one
+	Response interface{}
+}
+
+// enums are the allowed values of string types
+var enums = map[reflect.Type][]string{
+	reflect.TypeOf(ErrorCode("")): {
+		string(ErrorCodeInvalidRequest), string(ErrorCodeInvalidToken), string(ErrorCodeInsufficientScope), string(ErrorCodeTokenChainExpired),
+		string(ErrorCodeInvalidIdentifier), string(ErrorCodeAccessDenied), string(ErrorCodeRateLimited), string(ErrorCodeNotFound),
+		string(ErrorCodeNotImplemented), string(ErrorCodeServiceUnavailable), string(ErrorCodeInternal),
+	},
+	reflect.TypeOf(transport.Status("")): {
+		string(transport.StatusQueued), string(transport.StatusPkgGenerated), string(transport.StatusCommandSent),
+		string(transport.StatusDownloaded), string(transport.StatusExpired), string(transport.StatusFailed),
+	},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the JSON schema of values of t when marshaled with encoding/json
+func schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		s := map[string]interface{}{"type": "string"}
+		if enum, ok := enums[t]; ok {
+			s["enum"] = enum
+		}
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name, opts := f.Name, ""
+			if tag, ok := f.Tag.Lookup("json"); ok {
+				if tag == "-" {
+					continue
+				}
+				name, opts = tag, ""
+				if idx := strings.Index(tag, ","); idx != -1 {
+					name, opts = tag[:idx], tag[idx:]
+				}
+				if name == "" {
+					name = f.Name
+				}
+			}
+			props[name] = schema(f.Type)
+			if !strings.Contains(opts, ",omitempty") {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
+
+func jsonContent(v interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema(reflect.TypeOf(v))},
+	}
+}
+
+func problemResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/problem+json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"},
+			},
+		},
+	}
+}
+
+func textResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		},
+	}
+}
+
+// OpenAPI returns an OpenAPI 3 document describing the AttestationService's handlers mounted under prefix (see the Path constants), and endpoints.
+// Request and response schemas are generated from the types used by the handlers. Error responses are described in the format written by ProblemRenderer,
+// except FileStoreHandler's, which are plain text
+func (s *AttestationService) OpenAPI(prefix string, endpoints ...*Endpoint) map[string]interface{} {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	paths := map[string]interface{}{
+		prefix + PathPlace: map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": "place",
+				"summary":     "Place a token on the device",
+				"description": "Queues a placement of a token at the returned path on the device with the given identifier, e.g. its serial number",
+				"requestBody": map[string]interface{}{"required": true, "content": jsonContent(placeRequest{})},
+				"responses": map[string]interface{}{
+					"202": map[string]interface{}{"description": "Placement queued", "content": jsonContent(placeResponse{})},
+					"400": problemResponse("Invalid request or identifier"),
+					"403": problemResponse("Identifier denied"),
+					"429": problemResponse("Rate limited. The Retry-After header is set"),
+					"500": problemResponse("Server error"),
+				},
+			},
+		},
+		prefix + PathStatus + "{id}": map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": "status",
+				"summary":     "Get the status of a placement",
+				"parameters": []interface{}{
+					map[string]interface{}{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Placement. error is a coarse error code, e.g. invalid_identifier, if the placement failed", "content": jsonContent(Placement{})},
+					"400": problemResponse("Empty id"),
+					"404": problemResponse("Placement not found"),
+					"500": problemResponse("Server error"),
+				},
+			},
+		},
+		prefix + PathFiles + "{path}": map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": "file",
+				"summary":     "Download a payload from the FileStore. Used by the device's MDM agent",
+				"parameters": []interface{}{
+					map[string]interface{}{"name": "path", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "Payload",
+						"content": map[string]interface{}{
+							"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+						},
+					},
+					"404": textResponse("Payload not found"),
+					"500": textResponse("Server error"),
+				},
+			},
+		},
+		prefix + PathOpenAPI: map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": "openapi",
+				"summary":     "Get this document",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "OpenAPI document", "content": map[string]interface{}{"application/json": map[string]interface{}{}}},
+				},
+			},
+		},
+	}
+
+	authResponses := func() map[string]interface{} {
+		return map[string]interface{}{
+			"400": problemResponse("Invalid Authorization header"),
+			"401": problemResponse("Missing or invalid token. The WWW-Authenticate header is set"),
+			"500": problemResponse("Server error"),
+		}
+	}
+
+	if _, ok := s.TokenStore.(tokenstore.Refresher); ok {
+		responses := authResponses()
+		responses["200"] = map[string]interface{}{"description": "New token", "content": jsonContent(refreshResponse{})}
+		paths[prefix+PathRefresh] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": "refresh",
+				"summary":     "Exchange a token for a new one without a new placement",
+				"description": "Recently expired tokens may be refreshed. Once the chain of refreshed tokens is too old, the token_chain_expired error is returned and a new placement is required",
+				"security":    []interface{}{map[string]interface{}{"bearer": []string{}}},
+				"responses":   responses,
+			},
+		}
+	}
+
+	// Handler only allows each operation's method (and HEAD for the file store and this document)
+	for _, item := range paths {
+		for _, op := range item.(map[string]interface{}) {
+			op.(map[string]interface{})["responses"].(map[string]interface{})["405"] = problemResponse("Method not allowed. The Allow header is set")
+		}
+	}
+
+	for _, e := range endpoints {
+		responses := authResponses()
+		if len(e.Scopes) > 0 {
+			responses["403"] = problemResponse("Token is missing required scopes: " + strings.Join(e.Scopes, " "))
+		}
+		success := map[string]interface{}{"description": "Success"}
+		if e.Response != nil {
+			success["content"] = jsonContent(e.Response)
+		}
+		responses["200"] = success
+
+		op := map[string]interface{}{
+			"summary":   e.Summary,
+			"security":  []interface{}{map[string]interface{}{"bearer": append([]string{}, e.Scopes...)}},
+			"responses": responses,
+		}
+		if e.Request != nil {
+			op["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(e.Request)}
+		}
+
+		item, ok := paths[e.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[e.Path] = item
+		}
+		item[strings.ToLower(e.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "macOS Device Attestation",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Problem": schema(reflect.TypeOf(Problem{})),
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// OpenAPIHandler is an http.Handler that serves the OpenAPI document returned by OpenAPI as JSON
+func (s *AttestationService) OpenAPIHandler(prefix string, endpoints ...*Endpoint) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.OpenAPI(prefix, endpoints...)); err != nil {
+			s.logger().Error("could not encode response", logging.ContextArgs(r.Context(), logging.KeyError, err)...)
+		}
+	})
+}
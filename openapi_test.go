@@ -0,0 +1,152 @@
+package attest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+func TestSchema(t *testing.T) {
+	type inner struct {
+		N int `json:"n"`
+	}
+	type value struct {
+		Name     string `json:"name"`
+		Optional string `json:"optional,omitempty"`
+		Untagged bool
+		Hidden   string `json:"-"`
+		hidden   string
+		Status   transport.Status  `json:"status"`
+		Time     time.Time         `json:"time"`
+		Bytes    []byte            `json:"bytes"`
+		List     []*inner          `json:"list"`
+		Map      map[string]string `json:"map"`
+		Float    float64           `json:"float"`
+	}
+
+	buf, err := json.Marshal(schema(reflect.TypeOf(&value{})))
+	if err != nil {
+		t.Fatalf("could not marshal schema: %v", err)
+	}
+
+	expected := `{"properties":{` +
+		`"Untagged":{"type":"boolean"},` +
+		`"bytes":{"format":"byte","type":"string"},` +
+		`"float":{"type":"number"},` +
+		`"list":{"items":{"properties":{"n":{"type":"integer"}},"required":["n"],"type":"object"},"type":"array"},` +
+		`"map":{"additionalProperties":{"type":"string"},"type":"object"},` +
+		`"name":{"type":"string"},` +
+		`"optional":{"type":"string"},` +
+		`"status":{"enum":["queued","pkg_generated","command_sent","downloaded","expired","failed"],"type":"string"},` +
+		`"time":{"format":"date-time","type":"string"}},` +
+		`"required":["name","Untagged","status","time","bytes","list","map","float"],"type":"object"}`
+	if string(buf) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf)
+	}
+}
+
+// openAPIDoc is the part of an OpenAPI document checked by tests
+type openAPIDoc struct {
+	OpenAPI string `json:"openapi"`
+	Paths   map[string]map[string]struct {
+		Security  []map[string][]string `json:"security"`
+		Responses map[string]struct {
+			Content map[string]struct {
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"content"`
+		} `json:"responses"`
+	} `json:"paths"`
+	Components struct {
+		Schemas map[string]interface{} `json:"schemas"`
+	} `json:"components"`
+}
+
+func getOpenAPI(t *testing.T, s *AttestationService, prefix string, endpoints ...*Endpoint) *openAPIDoc {
+	t.Helper()
+	w := doJSON(t, s.OpenAPIHandler(prefix, endpoints...), http.MethodGet, "/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", ct)
+	}
+	doc := new(openAPIDoc)
+	decode(t, w, doc)
+	return doc
+}
+
+func TestOpenAPI(t *testing.T) {
+	s, _ := newTestService(t)
+	doc := getOpenAPI(t, s, "/api/", &Endpoint{
+		Method:   http.MethodGet,
+		Path:     "/api/secret",
+		Summary:  "Get a secret",
+		Scopes:   []string{"secret:read"},
+		Response: map[string]string{},
+	})
+
+	if doc.OpenAPI != OpenAPIVersion {
+		t.Errorf("expected openapi %s, got %s", OpenAPIVersion, doc.OpenAPI)
+	}
+
+	tests := []struct {
+		path   string
+		method string
+		codes  []string
+	}{
+		{"/api" + PathPlace, "post", []string{"202", "400", "403", "405", "429", "500"}},
+		{"/api" + PathStatus + "{id}", "get", []string{"200", "400", "404", "405", "500"}},
+		{"/api" + PathFiles + "{path}", "get", []string{"200", "404", "405", "500"}},
+		{"/api" + PathRefresh, "post", []string{"200", "400", "401", "405", "500"}},
+		{"/api" + PathOpenAPI, "get", []string{"200", "405"}},
+		{"/api/secret", "get", []string{"200", "400", "401", "403", "500"}},
+	}
+
+	for _, test := range tests {
+		op, ok := doc.Paths[test.path][test.method]
+		if !ok {
+			t.Errorf("expected %s %s to be documented", test.method, test.path)
+			continue
+		}
+		for _, code := range test.codes {
+			resp, ok := op.Responses[code]
+			if !ok {
+				t.Errorf("%s %s: expected %s response", test.method, test.path, code)
+				continue
+			}
+			// error responses reference the Problem schema
+			if c, ok := resp.Content["application/problem+json"]; ok && c.Schema["$ref"] != "#/components/schemas/Problem" {
+				t.Errorf("%s %s: expected %s response to reference Problem, got %v", test.method, test.path, code, c.Schema)
+			}
+		}
+		if len(op.Responses) != len(test.codes) {
+			t.Errorf("%s %s: expected responses %v, got %d", test.method, test.path, test.codes, len(op.Responses))
+		}
+	}
+
+	// FileStoreHandler writes errors as plain text
+	if _, ok := doc.Paths["/api"+PathFiles+"{path}"]["get"].Responses["404"].Content["text/plain"]; !ok {
+		t.Errorf("expected plain text file store 404, got %v", doc.Paths["/api"+PathFiles+"{path}"]["get"].Responses["404"])
+	}
+
+	if sec := doc.Paths["/api/secret"]["get"].Security; fmt.Sprint(sec) != "[map[bearer:[secret:read]]]" {
+		t.Errorf("expected bearer security with secret:read scope, got %v", sec)
+	}
+	if _, ok := doc.Components.Schemas["Problem"]; !ok {
+		t.Error("expected Problem schema")
+	}
+}
+
+func TestOpenAPIWithoutRefresh(t *testing.T) {
+	s, _ := newTestService(t)
+	s.TokenStore = basicStore{}
+
+	if _, ok := getOpenAPI(t, s, "").Paths[PathRefresh]; ok {
+		t.Error("expected refresh not to be documented for TokenStore without Refresher")
+	}
+}
@@ -0,0 +1,67 @@
+package attest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"regexp"
+)
+
+// DefaultPlacementDir is the directory DefaultPathStrategy places tokens in.
+// The mdm Transport's postinstall script creates it owned by root with mode 0700 if it doesn't exist
+const DefaultPlacementDir = "/var/run/macos-device-attestation"
+
+// DefaultPathStrategy is the PathStrategy used if AttestationService.PathStrategy is nil
+var DefaultPathStrategy PathStrategy = &DirPathStrategy{Dir: DefaultPlacementDir}
+
+// PathStrategy is an interface to choose where on a device a token is placed
+type PathStrategy interface {
+	// Path returns a new, unique, absolute path to place a token at for the device with identifier.
+	// The directory containing the path should be one that the Transport can create and lock down to root, and that the client expects tokens to be placed in
+	Path(identifier string) (string, error)
+}
+
+var safeName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DirPathStrategy is a PathStrategy that places tokens at random file names in Dir.
+// Every ancestor of Dir should be owned by root and not writable by other users
+type DirPathStrategy struct {
+	// Dir is the absolute path of the directory to place tokens in
+	Dir string
+	// PerIdentifier places tokens in a subdirectory of Dir named after the identifier.
+	// Identifiers containing characters other than letters, digits, '_', and '-' are hashed to create the name
+	PerIdentifier bool
+}
+
+// Path returns a random path in Dir, or a subdirectory of Dir if PerIdentifier is true
+func (d *DirPathStrategy) Path(identifier string) (string, error) {
+	if !filepath.IsAbs(d.Dir) || filepath.Clean(d.Dir) == "/" {
+		return "", errors.New("directory must be an absolute path other than /")
+	}
+
+	dir := filepath.Clean(d.Dir)
+	if d.PerIdentifier {
+		name := identifier
+		if !safeName.MatchString(name) {
+			sum := sha256.Sum256([]byte(identifier))
+			name = hex.EncodeToString(sum[:16])
+		}
+		dir = filepath.Join(dir, name)
+	}
+
+	name, err := randomString(pathSize)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// pathStrategy returns the AttestationService's PathStrategy, or DefaultPathStrategy if it's nil
+func (s *AttestationService) pathStrategy() PathStrategy {
+	if s.PathStrategy == nil {
+		return DefaultPathStrategy
+	}
+	return s.PathStrategy
+}
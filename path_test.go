@@ -0,0 +1,54 @@
+package attest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirPathStrategy(t *testing.T) {
+	sum := sha256.Sum256([]byte("../../etc"))
+	hashed := hex.EncodeToString(sum[:16])
+
+	tests := []struct {
+		name       string
+		strategy   *DirPathStrategy
+		identifier string
+		dir        string
+	}{
+		{"default", &DirPathStrategy{Dir: DefaultPlacementDir}, "serial", DefaultPlacementDir},
+		{"unclean dir", &DirPathStrategy{Dir: "/var/run/attest/"}, "serial", "/var/run/attest"},
+		{"per identifier", &DirPathStrategy{Dir: "/var/run/attest", PerIdentifier: true}, "C02-serial_1", "/var/run/attest/C02-serial_1"},
+		{"per identifier hashed", &DirPathStrategy{Dir: "/var/run/attest", PerIdentifier: true}, "../../etc", "/var/run/attest/" + hashed},
+		{"relative dir", &DirPathStrategy{Dir: "attest"}, "serial", ""},
+		{"root dir", &DirPathStrategy{Dir: "/"}, "serial", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := test.strategy.Path(test.identifier)
+			if test.dir == "" {
+				if err == nil {
+					t.Errorf("expected error, got path %s", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected path, got error: %v", err)
+			}
+
+			dir, name := filepath.Split(path)
+			if filepath.Clean(dir) != test.dir {
+				t.Errorf("expected directory %s, got %s", test.dir, dir)
+			}
+			if !safeName.MatchString(name) {
+				t.Errorf("expected random file name, got %q", name)
+			}
+
+			if other, _ := test.strategy.Path(test.identifier); other == path {
+				t.Errorf("expected unique paths, got %s twice", path)
+			}
+		})
+	}
+}
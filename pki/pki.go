@@ -0,0 +1,239 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	attest "github.com/korylprince/macos-device-attestation"
+)
+
+// URIScheme is the scheme of the URI SAN that carries the identifier in issued certificates, e.g. attest:<identifier>
+const URIScheme = "attest"
+
+const serialBits = 128
+
+// ErrExpired is returned by Issuer.Issue if the certificate would already be expired
+var ErrExpired = errors.New("token has expired")
+
+// ErrInvalidSignature is wrapped by the error returned by Issuer.Issue if the CSR's signature is invalid
+var ErrInvalidSignature = errors.New("invalid csr signature")
+
+// IdentifierURI returns the URI SAN for identifier
+func IdentifierURI(identifier string) *url.URL {
+	return &url.URL{Scheme: URIScheme, Opaque: url.PathEscape(identifier)}
+}
+
+// Issuer issues short-lived X.509 client certificates to attested devices in exchange for an attestation token, and authenticates mTLS requests made with those certificates.
+// Certificates expire no later than the token they were issued for, but revoking the token doesn't revoke certificates already issued for it
+type Issuer struct {
+	as   *attest.AttestationService
+	cert *x509.Certificate
+	key  crypto.Signer
+	dur  time.Duration
+}
+
+// New returns a new Issuer that uses as to authenticate tokens and signs certificates valid for dur with the CA cert and key
+func New(as *attest.AttestationService, cert *x509.Certificate, key crypto.Signer, dur time.Duration) *Issuer {
+	return &Issuer{as: as, cert: cert, key: key, dur: dur}
+}
+
+// ClientCAs returns a pool containing the CA certificate, suitable for tls.Config.ClientCAs
+func (i *Issuer) ClientCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(i.cert)
+	return pool
+}
+
+// Issue signs csr into a client certificate for identifier. The subject of csr is ignored; the certificate's common name and URI SAN are set from identifier.
+// The certificate is valid for the Issuer's duration, but never after expires (e.g. the expiry of the token it was issued for) unless expires is zero
+func (i *Issuer) Issue(csr *x509.CertificateRequest, identifier string, expires time.Time) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialBits))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(i.dur)
+	if !expires.IsZero() && expires.Before(notAfter) {
+		notAfter = expires
+	}
+	if !notAfter.After(now) {
+		return nil, ErrExpired
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identifier},
+		URIs:         []*url.URL{IdentifierURI(identifier)},
+		NotBefore:    now.Add(-time.Second * 15), // allow small time drift
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, i.cert, csr.PublicKey, i.key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// issueRequest is the request body of Handler
+type issueRequest struct {
+	CSR string `json:"csr"`
+}
+
+// issueResponse is the response body of Handler
+type issueResponse struct {
+	Certificate string    `json:"certificate"`
+	CA          string    `json:"ca"`
+	Expires     time.Time `json:"expires"`
+}
+
+func (i *Issuer) issueReturnHandlerFunc(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+	device, ok := attest.FromContext(r.Context())
+	if !ok || device.Identifier == "" {
+		return http.StatusInternalServerError, errors.New("pki issue: device not found in context")
+	}
+	identifier := device.Identifier
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return http.StatusBadRequest, errors.New("pki issue: Content-Type not application/json")
+	}
+
+	req := new(issueRequest)
+	if err = json.NewDecoder(r.Body).Decode(req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("pki issue: could not parse request body: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return http.StatusBadRequest, errors.New("pki issue: csr is not a PEM encoded CERTIFICATE REQUEST")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("pki issue: could not parse csr: %w", err)
+	}
+
+	// the certificate can't outlive the token it was exchanged for
+	cert, err := i.Issue(csr, identifier, device.ExpiresAt)
+	if err != nil {
+		e := fmt.Errorf("pki issue: could not issue certificate: %w", err)
+		if errors.Is(err, ErrInvalidSignature) {
+			return http.StatusBadRequest, e
+		}
+		if errors.Is(err, ErrExpired) {
+			return http.StatusUnauthorized, e
+		}
+		return http.StatusInternalServerError, e
+	}
+
+	return http.StatusOK, &issueResponse{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		CA:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.cert.Raw})),
+		Expires:     cert.NotAfter,
+	}
+}
+
+// Handler is an http.Handler that accepts a PEM encoded CSR in JSON format, e.g. {"csr":"-----BEGIN CERTIFICATE REQUEST-----..."},
+// and returns a signed client certificate for the device's identifier. The certificate expires no later than the token used to request it. Handler is protected by the AttestationService's JSONMiddleware, so the request must carry a valid attestation token
+func (i *Issuer) Handler() http.Handler {
+	return i.as.JSONMiddleware(i.as.JSONHandler(i.issueReturnHandlerFunc))
+}
+
+// Endpoint describes Handler mounted at path for AttestationService.OpenAPI
+func (i *Issuer) Endpoint(path string) *attest.Endpoint {
+	return &attest.Endpoint{
+		Method:   http.MethodPost,
+		Path:     path,
+		Summary:  "Exchange a token and a PEM encoded CSR for a client certificate",
+		Request:  issueRequest{},
+		Response: issueResponse{},
+	}
+}
+
+// Authenticate verifies cert was issued by the Issuer for client authentication and returns the identifier it was issued for
+func (i *Issuer) Authenticate(cert *x509.Certificate, intermediates []*x509.Certificate) (string, error) {
+	pool := x509.NewCertPool()
+	for _, c := range intermediates {
+		pool.AddCert(c)
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         i.ClientCAs(),
+		Intermediates: pool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return "", fmt.Errorf("could not verify certificate: %w", err)
+	}
+
+	for _, u := range cert.URIs {
+		if u.Scheme != URIScheme {
+			continue
+		}
+		identifier, err := url.PathUnescape(u.Opaque)
+		if err != nil {
+			return "", fmt.Errorf("could not parse identifier: %w", err)
+		}
+		if identifier != "" {
+			return identifier, nil
+		}
+	}
+
+	return "", errors.New("identifier not found in certificate")
+}
+
+// Middleware is a middleware that checks that the client authenticated the TLS connection with a certificate issued by Handler, and sets the corresponding attest.Device in the request's context.
+// The server's tls.Config should set ClientAuth to tls.RequestClientCert or stricter, and ClientCAs to ClientCAs().
+// Like attest.AttestationService.Middleware, Middleware returns a ReturnHandlerFunc; JSONMiddleware is a pre-built handler that marshals the code and error as JSON
+func (i *Issuer) Middleware(next http.Handler) attest.ReturnHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return http.StatusUnauthorized, errors.New("pki middleware: client certificate not found")
+		}
+
+		identifier, err := i.Authenticate(r.TLS.PeerCertificates[0], r.TLS.PeerCertificates[1:])
+		if err != nil {
+			return http.StatusUnauthorized, fmt.Errorf("pki middleware: could not authenticate certificate: %w", err)
+		}
+
+		cert := r.TLS.PeerCertificates[0]
+		ctx := attest.NewContext(r.Context(), &attest.Device{
+			Identifier: identifier,
+			TokenID:    cert.SerialNumber.String(),
+			IssuedAt:   cert.NotBefore,
+			ExpiresAt:  cert.NotAfter,
+		})
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+		return attest.StatusCodeSkip, nil
+	}
+}
+
+// JSONMiddleware is a wrapper for Middleware that returns errors encountered back to the client in JSON format
+func (i *Issuer) JSONMiddleware(next http.Handler) http.Handler {
+	return i.as.JSONHandler(i.Middleware(next))
+}
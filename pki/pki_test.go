@@ -0,0 +1,358 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	attest "github.com/korylprince/macos-device-attestation"
+	"github.com/korylprince/macos-device-attestation/tokenstore/mem"
+)
+
+const testDuration = time.Hour
+
+// newCA returns a self-signed CA certificate and its key
+func newCA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+// newTestIssuer returns an Issuer backed by an in-memory TokenStore
+func newTestIssuer(t *testing.T) (*Issuer, *mem.TokenStore) {
+	t.Helper()
+	ts := mem.New(100, time.Hour)
+	cert, key := newCA(t)
+	return New(attest.New(ts, nil, nil, nil), cert, key, testDuration), ts
+}
+
+// newCSR returns a CSR signed by a new key
+func newCSR(t *testing.T) *x509.CertificateRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "ignored"}}, key)
+	if err != nil {
+		t.Fatalf("could not create csr: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("could not parse csr: %v", err)
+	}
+	return csr
+}
+
+// badSignature returns a copy of csr with an invalid signature
+func badSignature(t *testing.T, csr *x509.CertificateRequest) *x509.CertificateRequest {
+	t.Helper()
+	// the signature is the last field of the DER encoding
+	raw := append([]byte(nil), csr.Raw...)
+	raw[len(raw)-1] ^= 0xff
+	bad, err := x509.ParseCertificateRequest(raw)
+	if err != nil {
+		t.Fatalf("could not parse csr: %v", err)
+	}
+	return bad
+}
+
+func TestIssue(t *testing.T) {
+	i, _ := newTestIssuer(t)
+	identifier := "serial/with spaces"
+
+	cert, err := i.Issue(newCSR(t), identifier, time.Time{})
+	if err != nil {
+		t.Fatalf("could not issue certificate: %v", err)
+	}
+
+	if cert.Subject.CommonName != identifier {
+		t.Errorf("expected common name %q, got %q", identifier, cert.Subject.CommonName)
+	}
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != IdentifierURI(identifier).String() {
+		t.Errorf("expected URI SAN %s, got %v", IdentifierURI(identifier), cert.URIs)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("expected client auth key usage, got %v", cert.ExtKeyUsage)
+	}
+	if d := time.Until(cert.NotAfter); d > testDuration || d < testDuration-time.Minute {
+		t.Errorf("expected certificate to expire in %v, got %v", testDuration, d)
+	}
+
+	if _, err = i.Issue(badSignature(t, newCSR(t)), identifier, time.Time{}); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got: %v", err)
+	}
+}
+
+func TestIssueExpires(t *testing.T) {
+	i, _ := newTestIssuer(t)
+	now := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		expires  time.Time
+		notAfter time.Time
+		err      error
+	}{
+		{"after duration", now.Add(2 * testDuration), time.Time{}, nil},
+		{"before duration", now.Add(time.Minute), now.Add(time.Minute), nil},
+		{"expired", now.Add(-time.Minute), time.Time{}, ErrExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cert, err := i.Issue(newCSR(t), "serial", test.expires)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Errorf("expected %v, got: %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not issue certificate: %v", err)
+			}
+			if test.notAfter.IsZero() {
+				if d := time.Until(cert.NotAfter); d > testDuration || d < testDuration-time.Minute {
+					t.Errorf("expected certificate to expire in %v, got %v", testDuration, d)
+				}
+				return
+			}
+			if !cert.NotAfter.Equal(test.notAfter) {
+				t.Errorf("expected certificate to expire at %v, got %v", test.notAfter, cert.NotAfter)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	i, _ := newTestIssuer(t)
+	other, _ := newTestIssuer(t)
+
+	issued, err := i.Issue(newCSR(t), "serial", time.Time{})
+	if err != nil {
+		t.Fatalf("could not issue certificate: %v", err)
+	}
+	foreign, err := other.Issue(newCSR(t), "serial", time.Time{})
+	if err != nil {
+		t.Fatalf("could not issue certificate: %v", err)
+	}
+
+	// sign certificates with the Issuer's CA that it wouldn't issue itself
+	sign := func(tmpl *x509.Certificate) *x509.Certificate {
+		tmpl.SerialNumber = big.NewInt(2)
+		tmpl.NotBefore = time.Now().Add(-time.Minute)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+		csr := newCSR(t)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, i.cert, csr.PublicKey, i.key)
+		if err != nil {
+			t.Fatalf("could not create certificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("could not parse certificate: %v", err)
+		}
+		return cert
+	}
+	serverAuth := sign(&x509.Certificate{
+		URIs:        []*url.URL{IdentifierURI("serial")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	noURI := sign(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "serial"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	otherScheme := sign(&x509.Certificate{
+		URIs:        []*url.URL{{Scheme: "https", Host: "serial"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	tests := []struct {
+		name       string
+		cert       *x509.Certificate
+		identifier string
+	}{
+		{"issued", issued, "serial"},
+		{"other CA", foreign, ""},
+		{"server auth", serverAuth, ""},
+		{"no URI", noURI, ""},
+		{"other URI scheme", otherScheme, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identifier, err := i.Authenticate(test.cert, nil)
+			if test.identifier == "" {
+				if err == nil {
+					t.Errorf("expected error, got identifier %q", identifier)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected identifier, got error: %v", err)
+			}
+			if identifier != test.identifier {
+				t.Errorf("expected identifier %q, got %q", test.identifier, identifier)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	pemCSR := func(csr *x509.CertificateRequest) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	}
+	validCSR := pemCSR(newCSR(t))
+
+	tests := []struct {
+		name        string
+		auth        bool
+		contentType string
+		csr         string
+		code        int
+	}{
+		{"valid", true, "application/json", validCSR, http.StatusOK},
+		{"no token", false, "application/json", validCSR, http.StatusUnauthorized},
+		{"wrong content type", true, "text/plain", validCSR, http.StatusBadRequest},
+		{"not PEM", true, "application/json", "not a csr", http.StatusBadRequest},
+		{"wrong PEM type", true, "application/json", strings.Replace(validCSR, "CERTIFICATE REQUEST", "CERTIFICATE", -1), http.StatusBadRequest},
+		{"bad signature", true, "application/json", pemCSR(badSignature(t, newCSR(t))), http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i, ts := newTestIssuer(t)
+			body, err := json.Marshal(map[string]string{"csr": test.csr})
+			if err != nil {
+				t.Fatalf("could not marshal body: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+			r.Header.Set("Content-Type", test.contentType)
+			if test.auth {
+				token, err := ts.New("serial")
+				if err != nil {
+					t.Fatalf("could not create token: %v", err)
+				}
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			i.Handler().ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+
+			resp := new(struct {
+				Certificate string    `json:"certificate"`
+				CA          string    `json:"ca"`
+				Expires     time.Time `json:"expires"`
+			})
+			if err = json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+				t.Fatalf("could not parse response: %v", err)
+			}
+			block, _ := pem.Decode([]byte(resp.Certificate))
+			if block == nil {
+				t.Fatalf("expected PEM certificate, got %q", resp.Certificate)
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatalf("could not parse certificate: %v", err)
+			}
+			if !cert.NotAfter.Equal(resp.Expires) {
+				t.Errorf("expected expires %v, got %v", cert.NotAfter, resp.Expires)
+			}
+			if identifier, err := i.Authenticate(cert, nil); err != nil || identifier != "serial" {
+				t.Errorf("expected certificate for serial, got %q, %v", identifier, err)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	i, _ := newTestIssuer(t)
+	other, _ := newTestIssuer(t)
+
+	issued, err := i.Issue(newCSR(t), "serial", time.Time{})
+	if err != nil {
+		t.Fatalf("could not issue certificate: %v", err)
+	}
+	foreign, err := other.Issue(newCSR(t), "serial", time.Time{})
+	if err != nil {
+		t.Fatalf("could not issue certificate: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		code  int
+	}{
+		{"valid", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{issued}}, http.StatusOK},
+		{"no TLS", nil, http.StatusUnauthorized},
+		{"no certificate", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"other CA", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{foreign}}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var device *attest.Device
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				device, _ = attest.FromContext(r.Context())
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.TLS = test.state
+			w := httptest.NewRecorder()
+			i.JSONMiddleware(next).ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if test.code != http.StatusOK {
+				if device != nil {
+					t.Errorf("expected next not to be called, got device: %+v", device)
+				}
+				return
+			}
+			if device == nil || device.Identifier != "serial" || device.TokenID != issued.SerialNumber.String() || !device.ExpiresAt.Equal(issued.NotAfter) {
+				t.Errorf("expected device for serial from certificate, got: %+v", device)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package attest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/korylprince/macos-device-attestation/filestore"
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+// DefaultPlaceTimeout is the default value for AttestationService.PlaceTimeout
+const DefaultPlaceTimeout = 5 * time.Minute
+
+// DefaultCoalesceWindow is the default value for AttestationService.CoalesceWindow
+const DefaultCoalesceWindow = 2 * time.Minute
+
+const (
+	placementCacheSize = 10000
+	placementTTL       = time.Hour
+)
+
+// Placement is the state of a token placement started by PlaceHandler. Transport is the name of the Transport placing the token, if reported (see transport.ReportTransport).
+// StatusHandler isn't authenticated, so a Placement doesn't include the device's identifier, and Error is only a coarse error code (see Cause). The full error is logged
+type Placement struct {
+	ID        string           `json:"id"`
+	Path      string           `json:"path"`
+	Status    transport.Status `json:"status"`
+	Transport string           `json:"transport,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Created   time.Time        `json:"created"`
+	Updated   time.Time        `json:"updated"`
+
+	// identifier is the transformed identifier the token is placed for
+	identifier string
+	// fsPath is the FileStore path of the payload reported by the Transport
+	fsPath string
+	// expiresAt is when the placed token expires, if known
+	expiresAt time.Time
+}
+
+// outstanding returns true if the Placement hasn't finished
+func (pl *Placement) outstanding() bool {
+	switch pl.Status {
+	case transport.StatusQueued, transport.StatusPkgGenerated, transport.StatusCommandSent:
+		return true
+	}
+	return false
+}
+
+// placements tracks Placements by ID, by the FileStore path of their payload, and by identifier
+type placements struct {
+	mu           sync.Mutex
+	byID         *ttlcache.Cache
+	byFile       *ttlcache.Cache
+	byIdentifier *ttlcache.Cache
+}
+
+func newPlacements() *placements {
+	newCache := func() *ttlcache.Cache {
+		c := ttlcache.NewCache()
+		c.SetCacheSizeLimit(placementCacheSize)
+		if err := c.SetTTL(placementTTL); err != nil {
+			panic(fmt.Errorf("could not set ttl on cache: %w", err))
+		}
+		c.SkipTTLExtensionOnHit(true)
+		return c
+	}
+	return &placements{byID: newCache(), byFile: newCache(), byIdentifier: newCache()}
+}
+
+// latest returns the ID of the most recent Placement for identifier, or an empty string if there isn't one
+func (p *placements) latest(identifier string) string {
+	id, err := p.byIdentifier.Get(identifier)
+	if err != nil {
+		return ""
+	}
+	return id.(string)
+}
+
+// pending returns a copy of the most recent Placement for identifier if it was created less than window ago and is still outstanding, or nil. p.mu must be held
+func (p *placements) pending(identifier string, window time.Duration) *Placement {
+	if window <= 0 {
+		return nil
+	}
+	id, err := p.byIdentifier.Get(identifier)
+	if err != nil {
+		return nil
+	}
+	v, err := p.byID.Get(id.(string))
+	if err != nil {
+		return nil
+	}
+	if pl := v.(*Placement); pl.outstanding() && time.Since(pl.Created) < window {
+		cp := *pl
+		return &cp
+	}
+	return nil
+}
+
+// outstanding is like pending, but locks p
+func (p *placements) outstanding(identifier string, window time.Duration) *Placement {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending(identifier, window)
+}
+
+// reserve returns a copy of the most recent Placement for identifier if it was created less than window ago and is still outstanding.
+// Otherwise a new queued Placement is stored and a copy of it is returned with created set to true
+func (p *placements) reserve(identifier, path string, window time.Duration) (pl *Placement, created bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pl := p.pending(identifier, window); pl != nil {
+		return pl, false, nil
+	}
+
+	id, err := randomString(pathSize)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not generate placement id: %w", err)
+	}
+
+	now := time.Now()
+	pl = &Placement{
+		ID:         id,
+		identifier: identifier,
+		Path:       path,
+		Status:     transport.StatusQueued,
+		Created:    now,
+		Updated:    now,
+	}
+	if err = p.byID.Set(id, pl); err != nil {
+		return nil, false, fmt.Errorf("could not set placement: %w", err)
+	}
+	if err = p.byIdentifier.Set(identifier, id); err != nil {
+		return nil, false, fmt.Errorf("could not set placement: %w", err)
+	}
+
+	cp := *pl
+	return &cp, true, nil
+}
+
+// get returns a copy of the Placement with id, or nil if it doesn't exist
+func (p *placements) get(id string) *Placement {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pl, err := p.byID.Get(id)
+	if err != nil {
+		return nil
+	}
+	cp := *(pl.(*Placement))
+	return &cp
+}
+
+// update sets the status of the Placement with id. A placement can't move backwards except to StatusDownloaded, and failed placements are never updated
+func (p *placements) update(id string, status transport.Status, fsPath string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, e := p.byID.Get(id)
+	if e != nil {
+		return
+	}
+	pl := v.(*Placement)
+
+	switch {
+	case pl.Status == transport.StatusFailed:
+		return
+	case pl.Status == transport.StatusDownloaded:
+		return
+	case pl.Status == transport.StatusExpired && status != transport.StatusDownloaded:
+		return
+	case pl.Status == transport.StatusCommandSent && status == transport.StatusPkgGenerated:
+		return
+	}
+
+	pl.Status = status
+	pl.Updated = time.Now()
+	if err != nil {
+		pl.Error = Cause(err)
+	}
+	if fsPath != "" && pl.fsPath == "" {
+		pl.fsPath = fsPath
+		p.byFile.Set(fsPath, id)
+	}
+}
+
+// setExpiry sets when the token placed by the Placement with id expires
+func (p *placements) setExpiry(id string, expiresAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if v, err := p.byID.Get(id); err == nil {
+		v.(*Placement).expiresAt = expiresAt
+	}
+}
+
+// attempt records that the Transport named name started placing the token for the Placement with id. The Placement is queued again unless it's failed or downloaded
+func (p *placements) attempt(id, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, err := p.byID.Get(id)
+	if err != nil {
+		return
+	}
+	pl := v.(*Placement)
+
+	if pl.Status == transport.StatusFailed || pl.Status == transport.StatusDownloaded {
+		return
+	}
+
+	pl.Transport = name
+	pl.Status = transport.StatusQueued
+	pl.Updated = time.Now()
+	pl.fsPath = ""
+}
+
+// downloaded marks the Placement whose payload is at fsPath as downloaded and returns a copy of it, or nil if it doesn't exist
+func (p *placements) downloaded(fsPath string) *Placement {
+	id, err := p.byFile.Get(fsPath)
+	if err != nil {
+		return nil
+	}
+	p.update(id.(string), transport.StatusDownloaded, "", nil)
+	return p.get(id.(string))
+}
+
+// reporter implements transport.Reporter for a single Placement
+type reporter struct {
+	p  *placements
+	id string
+}
+
+func (r reporter) ReportStatus(status transport.Status, path string) {
+	r.p.update(r.id, status, path, nil)
+}
+
+func (r reporter) ReportTransport(name string) {
+	r.p.attempt(r.id, name)
+}
+
+// place runs the Transport for a queued Placement and records the outcome. reqCtx is the context of the request that queued the Placement
+func (s *AttestationService) place(reqCtx context.Context, id, token, identifier, path string) {
+	timeout := s.PlaceTimeout
+	if timeout == 0 {
+		timeout = DefaultPlaceTimeout
+	}
+	// the placement outlives the request, so only carry over the request ID and identifier type
+	ctx := WithIdentifierType(logging.WithRequestID(context.Background(), logging.RequestID(reqCtx)), IdentifierType(reqCtx))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx = transport.WithReporter(ctx, reporter{p: s.placements, id: id})
+
+	start := time.Now()
+	err := transport.WithContext(s.Transport).PlaceContext(ctx, token, identifier, path)
+	s.observe(OpTransportPlace, start, 0, err)
+	if err != nil {
+		err = fmt.Errorf("attest place: could not place token: %w", err)
+		s.placements.update(id, transport.StatusFailed, "", err)
+		s.logger().Error("placement failed", logging.ContextArgs(ctx,
+			logging.KeyPlacementID, id,
+			logging.KeyIdentifier, identifier,
+			logging.KeyPlacementPath, path,
+			logging.KeyError, err,
+		)...)
+		return
+	}
+
+	s.logger().Info("placement sent", logging.ContextArgs(ctx,
+		logging.KeyPlacementID, id,
+		logging.KeyIdentifier, identifier,
+		logging.KeyPlacementPath, path,
+	)...)
+
+	if s.Limiter != nil {
+		s.Limiter.Placed(ctx, identifier)
+	}
+
+	// Transports that don't report progress are considered sent once Place returns
+	if pl := s.placements.get(id); pl != nil && pl.Status == transport.StatusQueued {
+		s.placements.update(id, transport.StatusCommandSent, "", nil)
+	}
+}
+
+// PlacementCount returns the number of Placements currently tracked by the AttestationService
+func (s *AttestationService) PlacementCount() int {
+	return s.placements.byID.Count()
+}
+
+// coalesced returns the outstanding Placement for identifier if there's one within CoalesceWindow, or nil
+func (s *AttestationService) coalesced(ctx context.Context, identifier string) (*Placement, error) {
+	if s.CoalesceWindow <= 0 {
+		return nil, nil
+	}
+	// check if the latest placement's payload has expired so it isn't reused
+	if id := s.placements.latest(identifier); id != "" {
+		if _, err := s.status(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return s.placements.outstanding(identifier, s.CoalesceWindow), nil
+}
+
+// reserve returns the outstanding Placement for identifier if there's one within CoalesceWindow. Otherwise it queues a new Placement with path and returns it with created set to true.
+// A placement for identifier may have been reserved by a concurrent request since coalesced was called, so it's checked again
+func (s *AttestationService) reserve(identifier, path string) (pl *Placement, created bool, err error) {
+	return s.placements.reserve(identifier, path, s.CoalesceWindow)
+}
+
+// status returns the Placement with id, marking it expired if its payload is no longer in the FileStore. If the Placement doesn't exist, nil is returned
+func (s *AttestationService) status(ctx context.Context, id string) (*Placement, error) {
+	pl := s.placements.get(id)
+	if pl == nil {
+		return nil, nil
+	}
+
+	if pl.fsPath == "" || (pl.Status != transport.StatusPkgGenerated && pl.Status != transport.StatusCommandSent) {
+		return pl, nil
+	}
+
+	if _, err := filestore.WithContext(s.FileStore).PeekContext(ctx, pl.fsPath); err != nil {
+		if !errors.Is(err, filestore.ErrNotFound) {
+			return nil, fmt.Errorf("could not query file store: %w", err)
+		}
+		s.placements.update(id, transport.StatusExpired, "", nil)
+		pl = s.placements.get(id)
+	}
+
+	return pl, nil
+}
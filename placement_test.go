@@ -0,0 +1,165 @@
+package attest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		// between is called between the two requests with the first placement
+		between    func(t *testing.T, s *AttestationService, tr *testTransport, first *testPlaceResponse)
+		identifier string
+		coalesced  bool
+	}{
+		{"queued", DefaultCoalesceWindow, nil, "serial", true},
+		{"command sent", DefaultCoalesceWindow, func(t *testing.T, s *AttestationService, tr *testTransport, first *testPlaceResponse) {
+			close(tr.release)
+			waitStatus(t, s, first.ID, transport.StatusCommandSent)
+		}, "serial", true},
+		{"other identifier", DefaultCoalesceWindow, nil, "other", false},
+		{"disabled", 0, nil, "serial", false},
+		{"window elapsed", 10 * time.Millisecond, func(t *testing.T, s *AttestationService, tr *testTransport, first *testPlaceResponse) {
+			time.Sleep(20 * time.Millisecond)
+		}, "serial", false},
+		{"downloaded", DefaultCoalesceWindow, func(t *testing.T, s *AttestationService, tr *testTransport, first *testPlaceResponse) {
+			close(tr.release)
+			pl := waitStatus(t, s, first.ID, transport.StatusCommandSent)
+			doJSON(t, http.StripPrefix("/files/", s.FileStoreHandler()), http.MethodGet, "/files/"+pl.fsPath, nil)
+		}, "serial", false},
+		{"expired", DefaultCoalesceWindow, func(t *testing.T, s *AttestationService, tr *testTransport, first *testPlaceResponse) {
+			close(tr.release)
+			pl := waitStatus(t, s, first.ID, transport.StatusCommandSent)
+			if _, err := tr.fs.Get(pl.fsPath); err != nil {
+				t.Fatalf("could not remove payload: %v", err)
+			}
+		}, "serial", false},
+		{"failed", DefaultCoalesceWindow, func(t *testing.T, s *AttestationService, tr *testTransport, first *testPlaceResponse) {
+			tr.err = errors.New("transport failed")
+			close(tr.release)
+			waitStatus(t, s, first.ID, transport.StatusFailed)
+		}, "serial", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, tr := newTestService(t)
+			s.CoalesceWindow = test.window
+			tr.release = make(chan struct{})
+			defer func() {
+				select {
+				case <-tr.release:
+				default:
+					close(tr.release)
+				}
+			}()
+
+			first := place(t, s, "serial")
+			if test.between != nil {
+				test.between(t, s, tr, first)
+			}
+			second := place(t, s, test.identifier)
+
+			if coalesced := second.ID == first.ID; coalesced != test.coalesced {
+				t.Fatalf("expected coalesced: %t, got placements %s and %s", test.coalesced, first.ID, second.ID)
+			}
+			if test.coalesced && second.Path != first.Path {
+				t.Errorf("expected coalesced placement path %s, got %s", first.Path, second.Path)
+			}
+		})
+	}
+}
+
+func TestCoalesceConcurrent(t *testing.T) {
+	s, tr := newTestService(t)
+	tr.release = make(chan struct{})
+
+	const n = 10
+	responses := make(chan *testPlaceResponse, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			w := doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": "serial"})
+			resp := new(testPlaceResponse)
+			if w.Code == http.StatusAccepted {
+				decode(t, w, resp)
+			}
+			responses <- resp
+		}()
+	}
+
+	var id string
+	for i := 0; i < n; i++ {
+		resp := <-responses
+		if resp.ID == "" {
+			t.Fatal("expected placement to be accepted")
+		}
+		if id != "" && resp.ID != id {
+			t.Errorf("expected all requests to be coalesced into %s, got %s", id, resp.ID)
+		}
+		id = resp.ID
+	}
+
+	close(tr.release)
+	waitStatus(t, s, id, transport.StatusCommandSent)
+	if placed := tr.placements(); len(placed) != 1 {
+		t.Errorf("expected one placement, got %v", placed)
+	}
+}
+
+// namedTransport is a testTransport that reports name before placing
+type namedTransport struct {
+	*testTransport
+	name string
+}
+
+func (t *namedTransport) PlaceContext(ctx context.Context, token, identifier, path string) error {
+	transport.ReportTransport(ctx, t.name)
+	return t.testTransport.PlaceContext(ctx, token, identifier, path)
+}
+
+func TestPlacementTransport(t *testing.T) {
+	s, tr := newTestService(t)
+	s.Transport = &namedTransport{tr, "mdm"}
+
+	resp := place(t, s, "serial")
+	if pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent); pl.Transport != "mdm" {
+		t.Errorf("expected transport mdm, got %q", pl.Transport)
+	}
+}
+
+func TestPlaceExpiresAt(t *testing.T) {
+	s, tr := newTestService(t)
+	tr.release = make(chan struct{})
+	defer close(tr.release)
+
+	place := func() *time.Time {
+		w := doJSON(t, s.PlaceHandler(), http.MethodPost, "/", map[string]string{"identifier": "serial"})
+		resp := new(struct {
+			ExpiresAt *time.Time `json:"expires_at"`
+		})
+		decode(t, w, resp)
+		return resp.ExpiresAt
+	}
+
+	expires := place()
+	if expires == nil || time.Until(*expires) > time.Hour || time.Until(*expires) < time.Hour-time.Minute {
+		t.Fatalf("expected token to expire in an hour, got %v", expires)
+	}
+	if coalesced := place(); coalesced == nil || !coalesced.Equal(*expires) {
+		t.Errorf("expected coalesced placement to expire at %v, got %v", expires, coalesced)
+	}
+
+	// the expiry isn't known for TokenStores without claims
+	s, _ = newTestService(t)
+	s.TokenStore = basicStore{}
+	if expires = place(); expires != nil {
+		t.Errorf("expected unknown expiry, got %v", expires)
+	}
+}
@@ -0,0 +1,194 @@
+package attest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/korylprince/macos-device-attestation/authorizer"
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/ratelimit"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+// ErrorCode is a machine-readable error code returned to clients. The codes used by RFC 6750 are reused where they apply
+type ErrorCode string
+
+// Error codes
+const (
+	ErrorCodeInvalidRequest     ErrorCode = "invalid_request"
+	ErrorCodeInvalidToken       ErrorCode = "invalid_token"
+	ErrorCodeInsufficientScope  ErrorCode = "insufficient_scope"
+	ErrorCodeTokenChainExpired  ErrorCode = "token_chain_expired"
+	ErrorCodeInvalidIdentifier  ErrorCode = "invalid_identifier"
+	ErrorCodeAccessDenied       ErrorCode = "access_denied"
+	ErrorCodeRateLimited        ErrorCode = "rate_limited"
+	ErrorCodeNotFound           ErrorCode = "not_found"
+	ErrorCodeNotImplemented     ErrorCode = "not_implemented"
+	ErrorCodeServiceUnavailable ErrorCode = "service_unavailable"
+	ErrorCodeInternal           ErrorCode = "internal_error"
+)
+
+// ErrMissingToken is returned by Middleware when a request doesn't have an Authorization header
+var ErrMissingToken = errors.New("missing bearer token")
+
+// errInvalidHeader is returned when a request's Authorization header isn't a valid Bearer header
+var errInvalidHeader = errors.New("invalid Authorization header")
+
+// errorCode classifies err, returned with the HTTP status code status, as an ErrorCode. If err is unclassified, the code is derived from status
+func errorCode(status int, err error) ErrorCode {
+	switch {
+	case errors.Is(err, tokenstore.ErrChainExpired):
+		return ErrorCodeTokenChainExpired
+	case errors.Is(err, ErrMissingToken), errors.As(err, new(*tokenstore.InvalidTokenError)):
+		return ErrorCodeInvalidToken
+	case errors.As(err, new(*InsufficientScopeError)):
+		return ErrorCodeInsufficientScope
+	case errors.Is(err, ErrInvalidIdentifier):
+		return ErrorCodeInvalidIdentifier
+	case errors.As(err, new(*authorizer.DeniedError)):
+		return ErrorCodeAccessDenied
+	case errors.As(err, new(*ratelimit.LimitError)):
+		return ErrorCodeRateLimited
+	}
+
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrorCodeInvalidToken
+	case status == http.StatusForbidden:
+		return ErrorCodeAccessDenied
+	case status == http.StatusNotFound:
+		return ErrorCodeNotFound
+	case status == http.StatusTooManyRequests:
+		return ErrorCodeRateLimited
+	case status == http.StatusNotImplemented:
+		return ErrorCodeNotImplemented
+	case status == http.StatusServiceUnavailable:
+		return ErrorCodeServiceUnavailable
+	case status >= 400 && status < 500:
+		return ErrorCodeInvalidRequest
+	}
+	return ErrorCodeInternal
+}
+
+// Problem is an error response. It's rendered as an RFC 7807 problem details object by ProblemRenderer
+type Problem struct {
+	// Type is a URI reference identifying the problem type. Problems are identified by Code, so this is always "about:blank"
+	Type string `json:"type"`
+	// Title is the text of the HTTP status code
+	Title string `json:"title"`
+	// Status is the HTTP status code
+	Status int `json:"status"`
+	// Detail is a description of this occurrence of the problem that's safe to return to the client, if any
+	Detail string `json:"detail,omitempty"`
+	// Code is a machine-readable error code
+	Code ErrorCode `json:"error"`
+	// RequestID is the ID of the request, if any
+	RequestID string `json:"request_id,omitempty"`
+
+	// Err is the error returned by the handler. It may contain sensitive information and should not be returned to the client
+	Err error `json:"-"`
+}
+
+// newProblem returns a Problem for err, returned with the HTTP status code status
+func newProblem(r *http.Request, status int, err error) *Problem {
+	p := &Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      errorCode(status, err),
+		RequestID: logging.RequestID(r.Context()),
+		Err:       err,
+	}
+	var derr detailError
+	if errors.As(err, &derr) {
+		p.Detail = derr.Detail()
+	}
+	return p
+}
+
+// ErrorRenderer writes an error response to the client. Status codes and the WWW-Authenticate and Retry-After headers are set before RenderError is called
+type ErrorRenderer interface {
+	RenderError(w http.ResponseWriter, r *http.Request, p *Problem)
+}
+
+// ErrorRendererFunc is a func that implements ErrorRenderer
+type ErrorRendererFunc func(w http.ResponseWriter, r *http.Request, p *Problem)
+
+// RenderError calls f
+func (f ErrorRendererFunc) RenderError(w http.ResponseWriter, r *http.Request, p *Problem) {
+	f(w, r, p)
+}
+
+// ProblemRenderer renders errors as RFC 7807 application/problem+json. It's the default ErrorRenderer.
+// e.g. {"type":"about:blank","title":"Unauthorized","status":401,"error":"invalid_token","request_id":"..."}
+var ProblemRenderer ErrorRenderer = ErrorRendererFunc(func(w http.ResponseWriter, r *http.Request, p *Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+})
+
+// LegacyRenderer renders errors in the format used by earlier versions, e.g. {"code":401,"description":"Unauthorized"}
+var LegacyRenderer ErrorRenderer = ErrorRendererFunc(func(w http.ResponseWriter, r *http.Request, p *Problem) {
+	type response struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+		Detail      string `json:"detail,omitempty"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(&response{Code: p.Status, Description: p.Title, Detail: p.Detail})
+})
+
+func (s *AttestationService) errorRenderer() ErrorRenderer {
+	if s.ErrorRenderer == nil {
+		return ProblemRenderer
+	}
+	return s.ErrorRenderer
+}
+
+// quoteAuthParam returns v as an RFC 6750 auth-param quoted string. Characters that aren't allowed are removed
+func quoteAuthParam(v string) string {
+	return `"` + strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, v) + `"`
+}
+
+// setWWWAuthenticate sets the RFC 6750 WWW-Authenticate header if p was caused by a missing, invalid, or insufficiently scoped bearer token
+func (s *AttestationService) setWWWAuthenticate(w http.ResponseWriter, p *Problem) {
+	var params []string
+	if s.Realm != "" {
+		params = append(params, "realm="+quoteAuthParam(s.Realm))
+	}
+
+	var serr *InsufficientScopeError
+	switch {
+	case errors.Is(p.Err, ErrMissingToken):
+		// RFC 6750 3.1: a request without authentication information gets no error code
+	case errors.Is(p.Err, errInvalidHeader):
+		params = append(params, "error="+quoteAuthParam(string(ErrorCodeInvalidRequest)))
+	case errors.As(p.Err, new(*tokenstore.InvalidTokenError)):
+		params = append(params, "error="+quoteAuthParam(string(ErrorCodeInvalidToken)))
+	case errors.As(p.Err, &serr):
+		params = append(params,
+			"error="+quoteAuthParam(string(ErrorCodeInsufficientScope)),
+			"scope="+quoteAuthParam(strings.Join(serr.Required, " ")),
+		)
+	default:
+		return
+	}
+
+	if p.Detail != "" {
+		params = append(params, "error_description="+quoteAuthParam(p.Detail))
+	}
+
+	if len(params) == 0 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer "+strings.Join(params, ", "))
+}
@@ -0,0 +1,154 @@
+package attest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/korylprince/macos-device-attestation/authorizer"
+	"github.com/korylprince/macos-device-attestation/ratelimit"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+		code   ErrorCode
+	}{
+		{http.StatusUnauthorized, &tokenstore.InvalidTokenError{Err: tokenstore.ErrChainExpired}, ErrorCodeTokenChainExpired},
+		{http.StatusUnauthorized, fmt.Errorf("wrapped: %w", ErrMissingToken), ErrorCodeInvalidToken},
+		{http.StatusUnauthorized, &tokenstore.InvalidTokenError{Err: errors.New("expired")}, ErrorCodeInvalidToken},
+		{http.StatusForbidden, &InsufficientScopeError{Missing: []string{"a"}}, ErrorCodeInsufficientScope},
+		{http.StatusBadRequest, ErrInvalidIdentifier, ErrorCodeInvalidIdentifier},
+		{http.StatusForbidden, &authorizer.DeniedError{Reason: "denied"}, ErrorCodeAccessDenied},
+		{http.StatusTooManyRequests, &ratelimit.LimitError{Kind: ratelimit.KindGlobal}, ErrorCodeRateLimited},
+		{http.StatusUnauthorized, errors.New("other"), ErrorCodeInvalidToken},
+		{http.StatusForbidden, errors.New("other"), ErrorCodeAccessDenied},
+		{http.StatusNotFound, errors.New("other"), ErrorCodeNotFound},
+		{http.StatusTooManyRequests, nil, ErrorCodeRateLimited},
+		{http.StatusNotImplemented, errors.New("other"), ErrorCodeNotImplemented},
+		{http.StatusServiceUnavailable, errors.New("other"), ErrorCodeServiceUnavailable},
+		{http.StatusBadRequest, errors.New("other"), ErrorCodeInvalidRequest},
+		{http.StatusInternalServerError, errors.New("other"), ErrorCodeInternal},
+	}
+
+	for _, test := range tests {
+		if code := errorCode(test.status, test.err); code != test.code {
+			t.Errorf("errorCode(%d, %v): expected %s, got %s", test.status, test.err, test.code, code)
+		}
+	}
+}
+
+func TestMiddlewareErrors(t *testing.T) {
+	tests := []struct {
+		name            string
+		realm           string
+		header          string
+		code            int
+		errorCode       ErrorCode
+		wwwAuthenticate string
+	}{
+		{"missing token", "", "", http.StatusUnauthorized, ErrorCodeInvalidToken, "Bearer"},
+		{"missing token with realm", "attest", "", http.StatusUnauthorized, ErrorCodeInvalidToken, `Bearer realm="attest"`},
+		{"invalid header", "", "Basic dXNlcjpwYXNz", http.StatusBadRequest, ErrorCodeInvalidRequest, `Bearer error="invalid_request"`},
+		{"empty token", "", "Bearer ", http.StatusBadRequest, ErrorCodeInvalidRequest, `Bearer error="invalid_request"`},
+		{"unknown token", "at\"test", "Bearer unknown", http.StatusUnauthorized, ErrorCodeInvalidToken, `Bearer realm="attest", error="invalid_token"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			s.Realm = test.realm
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			s.JSONMiddleware(http.NotFoundHandler()).ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if h := w.Header().Get("WWW-Authenticate"); h != test.wwwAuthenticate {
+				t.Errorf("expected WWW-Authenticate %q, got %q", test.wwwAuthenticate, h)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("expected problem content type, got %q", ct)
+			}
+
+			p := new(Problem)
+			decode(t, w, p)
+			if p.Type != "about:blank" || p.Status != test.code || p.Title != http.StatusText(test.code) || p.Code != test.errorCode {
+				t.Errorf("expected %d %s problem, got: %+v", test.code, test.errorCode, p)
+			}
+			if p.RequestID == "" || p.RequestID != w.Header().Get(RequestIDHeader) {
+				t.Errorf("expected request id %q, got %q", w.Header().Get(RequestIDHeader), p.RequestID)
+			}
+		})
+	}
+}
+
+func TestInsufficientScopeWWWAuthenticate(t *testing.T) {
+	s, _ := newTestService(t)
+	token, err := s.TokenStore.New("udid")
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.JSONMiddleware(s.RequireScopes("read", "write")(http.NotFoundHandler())).ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	expected := `Bearer error="insufficient_scope", scope="read write", error_description="token is missing required scopes: read write"`
+	if h := w.Header().Get("WWW-Authenticate"); h != expected {
+		t.Errorf("expected WWW-Authenticate %q, got %q", expected, h)
+	}
+}
+
+func TestErrorRenderer(t *testing.T) {
+	tests := []struct {
+		name     string
+		renderer ErrorRenderer
+		body     string
+	}{
+		{"legacy", LegacyRenderer, `{"code":404,"description":"Not Found"}`},
+		{"custom", ErrorRendererFunc(func(w http.ResponseWriter, r *http.Request, p *Problem) {
+			w.WriteHeader(p.Status)
+			json.NewEncoder(w).Encode(map[string]string{"err": p.Err.Error()})
+		}), `{"err":"attest status: placement not found: unknown"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			s.ErrorRenderer = test.renderer
+
+			w := doJSON(t, s.StatusHandler(), http.MethodGet, "/unknown", nil)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+			}
+			if body := w.Body.String(); body != test.body+"\n" {
+				t.Errorf("expected body %s, got %s", test.body, body)
+			}
+		})
+	}
+}
+
+func TestProblemHidesError(t *testing.T) {
+	s, _ := newTestService(t)
+	w := doJSON(t, s.StatusHandler(), http.MethodGet, "/unknown", nil)
+
+	if strings.Contains(w.Body.String(), "placement not found") {
+		t.Errorf("expected internal error not to be returned, got: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,173 @@
+package mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/korylprince/macos-device-attestation/ratelimit"
+)
+
+// Rate is a token bucket rate. A zero Rate is unlimited
+type Rate struct {
+	// Burst is the maximum number of requests allowed at once
+	Burst int
+	// Interval is the time it takes to allow one more request, up to Burst
+	Interval time.Duration
+}
+
+func (r Rate) unlimited() bool {
+	return r.Burst <= 0 || r.Interval <= 0
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait refills the bucket and returns how long until a request is allowed
+func (b *bucket) wait(r Rate, now time.Time) time.Duration {
+	b.tokens += float64(now.Sub(b.last)) / float64(r.Interval)
+	if b.tokens > float64(r.Burst) {
+		b.tokens = float64(r.Burst)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(r.Interval))
+}
+
+// Limiter implements Limiter completely in memory with token buckets, and uses an LRU cache to limit memory usage
+type Limiter struct {
+	identifier Rate
+	remoteIP   Rate
+	global     Rate
+	cooldown   time.Duration
+
+	mu           sync.Mutex
+	buckets      *ttlcache.Cache
+	cooldowns    *ttlcache.Cache
+	globalBucket *bucket
+}
+
+// New returns a new Limiter with the given cache size (item count), per-identifier, per-remote IP, and global rates,
+// and the cooldown an identifier must wait after a successful placement before another is allowed
+func New(size int, identifier, remoteIP, global Rate, cooldown time.Duration) *Limiter {
+	newCache := func(skipExtension bool) *ttlcache.Cache {
+		c := ttlcache.NewCache()
+		c.SetCacheSizeLimit(size)
+		c.SkipTTLExtensionOnHit(skipExtension)
+		return c
+	}
+	return &Limiter{
+		identifier: identifier,
+		remoteIP:   remoteIP,
+		global:     global,
+		cooldown:   cooldown,
+		// a bucket's TTL is extended every time it's used, so it's only evicted once it's idle long enough to refill
+		buckets:      newCache(false),
+		cooldowns:    newCache(true),
+		globalBucket: &bucket{tokens: float64(global.Burst), last: time.Now()},
+	}
+}
+
+// getBucket returns the bucket for key, creating a full one if it doesn't exist
+func (l *Limiter) getBucket(key string, r Rate, now time.Time) (*bucket, error) {
+	b, err := l.buckets.Get(key)
+	if err == nil {
+		return b.(*bucket), nil
+	}
+	if !errors.Is(err, ttlcache.ErrNotFound) {
+		return nil, fmt.Errorf("could not query cache: %w", err)
+	}
+
+	nb := &bucket{tokens: float64(r.Burst), last: now}
+	// a bucket that's been idle long enough to refill is the same as a new one. Its TTL is extended on every Get
+	if err = l.buckets.SetWithTTL(key, nb, time.Duration(r.Burst)*r.Interval); err != nil {
+		return nil, fmt.Errorf("could not set bucket: %w", err)
+	}
+	return nb, nil
+}
+
+// check is a rate and the bucket it's checked against
+type check struct {
+	kind   ratelimit.Kind
+	rate   Rate
+	bucket *bucket
+}
+
+// allow returns a *ratelimit.LimitError if any of checks would be exceeded. A request is only counted against the rates if it's allowed by all of them
+func allow(checks []check, now time.Time) error {
+	for _, c := range checks {
+		if wait := c.bucket.wait(c.rate, now); wait > 0 {
+			return &ratelimit.LimitError{Kind: c.kind, After: wait}
+		}
+	}
+
+	for _, c := range checks {
+		c.bucket.tokens--
+	}
+
+	return nil
+}
+
+// AllowRemote returns nil if a placement requested from remoteIP is allowed by the per-remote IP and global rates.
+// A request is only counted against the rates if it's allowed by both of them
+func (l *Limiter) AllowRemote(ctx context.Context, remoteIP string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var checks []check
+
+	if !l.remoteIP.unlimited() {
+		b, err := l.getBucket("ip:"+remoteIP, l.remoteIP, now)
+		if err != nil {
+			return fmt.Errorf("could not get %s bucket: %w", ratelimit.KindRemoteIP, err)
+		}
+		checks = append(checks, check{ratelimit.KindRemoteIP, l.remoteIP, b})
+	}
+
+	if !l.global.unlimited() {
+		checks = append(checks, check{ratelimit.KindGlobal, l.global, l.globalBucket})
+	}
+
+	return allow(checks, now)
+}
+
+// AllowIdentifier returns nil if a placement for identifier is allowed by its cooldown and the per-identifier rate
+func (l *Limiter) AllowIdentifier(ctx context.Context, identifier string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if until, err := l.cooldowns.Get(identifier); err == nil {
+		if wait := until.(time.Time).Sub(now); wait > 0 {
+			return &ratelimit.LimitError{Kind: ratelimit.KindCooldown, After: wait}
+		}
+	}
+
+	if l.identifier.unlimited() {
+		return nil
+	}
+
+	b, err := l.getBucket("id:"+identifier, l.identifier, now)
+	if err != nil {
+		return fmt.Errorf("could not get %s bucket: %w", ratelimit.KindIdentifier, err)
+	}
+
+	return allow([]check{{ratelimit.KindIdentifier, l.identifier, b}}, now)
+}
+
+// Placed starts the cooldown for identifier
+func (l *Limiter) Placed(ctx context.Context, identifier string) {
+	if l.cooldown <= 0 {
+		return
+	}
+	l.cooldowns.SetWithTTL(identifier, time.Now().Add(l.cooldown), l.cooldown)
+}
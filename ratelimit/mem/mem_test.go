@@ -0,0 +1,129 @@
+package mem
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/ratelimit"
+)
+
+func TestBucketWait(t *testing.T) {
+	r := Rate{Burst: 2, Interval: time.Second}
+	start := time.Now()
+
+	tests := []struct {
+		name   string
+		tokens float64
+		after  time.Duration
+		wait   time.Duration
+	}{
+		{"full", 2, 0, 0},
+		{"one left", 1, 0, 0},
+		{"empty", 0, 0, time.Second},
+		{"partly refilled", 0, 250 * time.Millisecond, 750 * time.Millisecond},
+		{"refilled", 0, time.Second, 0},
+		{"capped at burst", 0, time.Hour, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &bucket{tokens: test.tokens, last: start}
+			if wait := b.wait(r, start.Add(test.after)); wait != test.wait {
+				t.Errorf("expected wait %v, got %v", test.wait, wait)
+			}
+			if b.tokens > float64(r.Burst) {
+				t.Errorf("expected at most %d tokens, got %v", r.Burst, b.tokens)
+			}
+		})
+	}
+}
+
+// allowBoth checks both of l's limits, like AttestationService.PlaceHandler
+func allowBoth(l *Limiter, identifier, remoteIP string) error {
+	if err := l.AllowRemote(context.Background(), remoteIP); err != nil {
+		return err
+	}
+	return l.AllowIdentifier(context.Background(), identifier)
+}
+
+func TestAllow(t *testing.T) {
+	// requests are identifier, remote IP pairs
+	tests := []struct {
+		name                 string
+		identifier, remoteIP Rate
+		global               Rate
+		requests             [][2]string
+		allowed              []bool
+		kind                 ratelimit.Kind
+	}{
+		{"unlimited", Rate{}, Rate{}, Rate{}, [][2]string{{"a", "192.0.2.1"}, {"a", "192.0.2.1"}, {"a", "192.0.2.1"}}, []bool{true, true, true}, ""},
+		{"identifier burst", Rate{Burst: 2, Interval: time.Hour}, Rate{}, Rate{}, [][2]string{{"a", "192.0.2.1"}, {"a", "192.0.2.2"}, {"a", "192.0.2.3"}, {"b", "192.0.2.1"}}, []bool{true, true, false, true}, ratelimit.KindIdentifier},
+		{"remote ip burst", Rate{}, Rate{Burst: 1, Interval: time.Hour}, Rate{}, [][2]string{{"a", "192.0.2.1"}, {"b", "192.0.2.1"}, {"a", "192.0.2.2"}}, []bool{true, false, true}, ratelimit.KindRemoteIP},
+		{"global burst", Rate{}, Rate{}, Rate{Burst: 2, Interval: time.Hour}, [][2]string{{"a", "192.0.2.1"}, {"b", "192.0.2.2"}, {"c", "192.0.2.3"}}, []bool{true, true, false}, ratelimit.KindGlobal},
+		{"denied not counted", Rate{}, Rate{Burst: 1, Interval: time.Hour}, Rate{Burst: 2, Interval: time.Hour}, [][2]string{{"a", "192.0.2.1"}, {"a", "192.0.2.1"}, {"a", "192.0.2.1"}, {"b", "192.0.2.2"}}, []bool{true, false, false, true}, ratelimit.KindRemoteIP},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := New(100, test.identifier, test.remoteIP, test.global, 0)
+			for i, req := range test.requests {
+				err := allowBoth(l, req[0], req[1])
+				if test.allowed[i] {
+					if err != nil {
+						t.Errorf("request %d: expected allowed, got: %v", i, err)
+					}
+					continue
+				}
+				le := new(ratelimit.LimitError)
+				if !errors.As(err, &le) {
+					t.Fatalf("request %d: expected LimitError, got: %v", i, err)
+				}
+				if le.Kind != test.kind {
+					t.Errorf("request %d: expected kind %s, got %s", i, test.kind, le.Kind)
+				}
+				if le.After <= 0 {
+					t.Errorf("request %d: expected positive retry after, got %v", i, le.After)
+				}
+			}
+		})
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	l := New(100, Rate{}, Rate{}, Rate{}, time.Hour)
+	if err := allowBoth(l, "a", "192.0.2.1"); err != nil {
+		t.Fatalf("expected allowed, got: %v", err)
+	}
+
+	l.Placed(context.Background(), "a")
+
+	le := new(ratelimit.LimitError)
+	if err := allowBoth(l, "a", "192.0.2.1"); !errors.As(err, &le) || le.Kind != ratelimit.KindCooldown {
+		t.Errorf("expected cooldown LimitError, got: %v", err)
+	}
+	if err := allowBoth(l, "b", "192.0.2.1"); err != nil {
+		t.Errorf("expected other identifier to be allowed, got: %v", err)
+	}
+}
+
+// TestAllowIdleEviction checks that a bucket isn't replaced with a full one while it's being used, which would allow more than Burst plus the refill rate
+func TestAllowIdleEviction(t *testing.T) {
+	r := Rate{Burst: 2, Interval: 20 * time.Millisecond}
+	l := New(100, r, Rate{}, Rate{}, 0)
+
+	allowed := 0
+	start := time.Now()
+	for time.Since(start) < 10*r.Interval {
+		if err := allowBoth(l, "a", "192.0.2.1"); err == nil {
+			allowed++
+		}
+		time.Sleep(r.Interval / 20)
+	}
+	elapsed := time.Since(start)
+
+	if max := r.Burst + int(elapsed/r.Interval) + 1; allowed > max {
+		t.Errorf("expected at most %d requests to be allowed in %v, got %d", max, elapsed, allowed)
+	}
+}
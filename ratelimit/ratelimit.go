@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Kind is the kind of limit that was exceeded
+type Kind string
+
+// Limit kinds
+const (
+	KindIdentifier Kind = "identifier"
+	KindRemoteIP   Kind = "remote_ip"
+	KindGlobal     Kind = "global"
+	KindCooldown   Kind = "cooldown"
+)
+
+// Limiter is an interface to limit how often placements can be requested. Each request is checked in two steps:
+// AllowRemote is checked before the identifier is transformed, so an MDM isn't queried for requests over the per-IP or global limits,
+// and AllowIdentifier is checked after, since the transformed identifier isn't known until then
+type Limiter interface {
+	// AllowRemote returns nil if a placement requested from remoteIP is allowed. If it isn't, the returned error will be of type *LimitError
+	AllowRemote(ctx context.Context, remoteIP string) error
+	// AllowIdentifier returns nil if a placement for identifier is allowed. If it isn't, the returned error will be of type *LimitError.
+	// identifier is the transformed identifier, so it's the same whichever type of identifier the client sent
+	AllowIdentifier(ctx context.Context, identifier string) error
+	// Placed is called with the transformed identifier after a placement for it succeeds. Implementations can use it to start a cooldown for identifier
+	Placed(ctx context.Context, identifier string)
+}
+
+// LimitError is returned by a Limiter when a limit has been exceeded
+type LimitError struct {
+	Kind Kind
+	// After is how long the client should wait before trying again
+	After time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s rate limit exceeded: retry after %v", e.Kind, e.After)
+}
+
+// RetryAfter returns how long the client should wait before trying again
+func (e *LimitError) RetryAfter() time.Duration {
+	return e.After
+}
@@ -0,0 +1,109 @@
+package attest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+// DefaultRefreshMaxLifetime is the default value for AttestationService.RefreshMaxLifetime
+const DefaultRefreshMaxLifetime = 24 * time.Hour
+
+// detail wraps an error with a description that's safe to return to the client
+type detail struct {
+	err    error
+	detail string
+}
+
+func (d *detail) Error() string {
+	return d.err.Error()
+}
+
+func (d *detail) Unwrap() error {
+	return d.err
+}
+
+func (d *detail) Detail() string {
+	return d.detail
+}
+
+// bearerToken returns the token from r's Authorization header. If r doesn't have an Authorization header, ErrMissingToken is returned.
+// If the header isn't a valid Bearer header, errInvalidHeader is returned
+func bearerToken(r *http.Request) (string, error) {
+	value := r.Header.Get("Authorization")
+	if value == "" {
+		return "", ErrMissingToken
+	}
+	header := strings.Split(value, " ")
+	if len(header) != 2 || !strings.EqualFold(header[0], "Bearer") || header[1] == "" {
+		return "", errInvalidHeader
+	}
+	return header[1], nil
+}
+
+// bearerStatus returns the HTTP status code for an error returned by bearerToken
+func bearerStatus(err error) int {
+	if errors.Is(err, ErrMissingToken) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+// refreshResponse is the response body of RefreshHandler
+type refreshResponse struct {
+	Token string `json:"token"`
+	// ExpiresAt is when the new token expires, if known
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (s *AttestationService) refreshReturnHandlerFunc(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+	ctx := r.Context()
+	ev := &Event{Type: EventTokenRefreshed, RemoteAddr: r.RemoteAddr, Time: time.Now()}
+
+	refresher, ok := s.TokenStore.(tokenstore.Refresher)
+	if !ok {
+		return http.StatusNotImplemented, errors.New("attest refresh: TokenStore doesn't support refreshing tokens")
+	}
+
+	token, err := bearerToken(r)
+	if err != nil {
+		return bearerStatus(err), fmt.Errorf("attest refresh: %w", err)
+	}
+
+	newToken, err := refresher.Refresh(token, s.RefreshMaxLifetime)
+	var claims *tokenstore.Claims
+	if err == nil {
+		// authenticate the new token to return its identifier in events and logs, and its expiry
+		if claims, err = tokenstore.AuthenticateClaims(s.TokenStore, newToken); err == nil {
+			ev.Identifier = claims.Identifier
+		}
+	}
+	ev.Err = err
+	s.emit(ctx, ev)
+	s.observe(OpRefresh, ev.Time, 0, err)
+	if err != nil {
+		e := fmt.Errorf("attest refresh: could not refresh token: %w", err)
+		if errors.Is(err, tokenstore.ErrChainExpired) {
+			return http.StatusUnauthorized, &detail{err: e, detail: "token chain expired: a new placement is required"}
+		}
+		if errors.As(err, new(*tokenstore.InvalidTokenError)) {
+			return http.StatusUnauthorized, e
+		}
+		return http.StatusInternalServerError, e
+	}
+
+	s.logger().Info("token refreshed", logging.ContextArgs(ctx, logging.KeyIdentifier, ev.Identifier)...)
+
+	return http.StatusOK, &refreshResponse{Token: newToken, ExpiresAt: expiresAt(claims.ExpiresAt)}
+}
+
+// RefreshHandler is an http.Handler that exchanges the token in the Authorization header for a new token for the same identifier, without a new placement. The TokenStore must implement tokenstore.Refresher.
+// Tokens that have expired can be refreshed if the TokenStore allows it (see jwt.TokenStore.RefreshGrace and mem.TokenStore.RefreshGrace). Once a chain of refreshed tokens is older than RefreshMaxLifetime, the client must get a new token with PlaceHandler
+func (s *AttestationService) RefreshHandler() http.Handler {
+	return s.withJSONResponse(s.refreshReturnHandlerFunc)
+}
@@ -0,0 +1,111 @@
+package attest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/tokenstore/jwt"
+)
+
+func TestRefreshHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      func(token string) string
+		maxLifetime time.Duration
+		code        int
+		detail      string
+	}{
+		{"valid", func(token string) string { return "Bearer " + token }, DefaultRefreshMaxLifetime, http.StatusOK, ""},
+		{"no max lifetime", func(token string) string { return "Bearer " + token }, 0, http.StatusOK, ""},
+		{"chain expired", func(token string) string { return "Bearer " + token }, time.Nanosecond, http.StatusUnauthorized, "token chain expired: a new placement is required"},
+		{"missing header", func(token string) string { return "" }, DefaultRefreshMaxLifetime, http.StatusUnauthorized, ""},
+		{"invalid header", func(token string) string { return "Basic " + token }, DefaultRefreshMaxLifetime, http.StatusBadRequest, ""},
+		{"unknown token", func(token string) string { return "Bearer unknown" }, DefaultRefreshMaxLifetime, http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			s.RefreshMaxLifetime = test.maxLifetime
+
+			token, err := s.TokenStore.New("udid")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Authorization", test.header(token))
+			w := httptest.NewRecorder()
+			s.RefreshHandler().ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+
+			resp := new(struct {
+				Token     string     `json:"token"`
+				ExpiresAt *time.Time `json:"expires_at"`
+				Detail    string     `json:"detail"`
+			})
+			decode(t, w, resp)
+			if resp.Detail != test.detail {
+				t.Errorf("expected detail %q, got %q", test.detail, resp.Detail)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+
+			if identifier, err := s.TokenStore.Authenticate(resp.Token); err != nil || identifier != "udid" {
+				t.Errorf("expected new token for udid, got %q, %v", identifier, err)
+			}
+			if _, err = s.TokenStore.Authenticate(token); err == nil {
+				t.Error("expected old token to be revoked")
+			}
+			if resp.ExpiresAt == nil || time.Until(*resp.ExpiresAt) > time.Hour || time.Until(*resp.ExpiresAt) < time.Hour-time.Minute {
+				t.Errorf("expected new token to expire in an hour, got %v", resp.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestRefreshHandlerJWT(t *testing.T) {
+	s, _ := newTestService(t)
+	ts := jwt.New([]byte("01234567890123456789012345678901"), "", nil, time.Hour)
+	s.TokenStore = ts
+
+	token, err := ts.New("udid")
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.RefreshHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// a token can only be refreshed once
+	w = httptest.NewRecorder()
+	s.RefreshHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+}
+
+func TestRefreshHandlerNotImplemented(t *testing.T) {
+	s, _ := newTestService(t)
+	s.TokenStore = basicStore{}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	s.RefreshHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("expected status %d, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
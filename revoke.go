@@ -0,0 +1,89 @@
+package attest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+func (s *AttestationService) revokeReturnHandlerFunc(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+	type request struct {
+		Token            string     `json:"token,omitempty"`
+		Identifier       string     `json:"identifier,omitempty"`
+		ClientIdentifier string     `json:"client_identifier,omitempty"`
+		Before           *time.Time `json:"before,omitempty"`
+	}
+
+	revoker, ok := s.TokenStore.(tokenstore.Revoker)
+	if !ok {
+		return http.StatusNotImplemented, errors.New("attest revoke: TokenStore doesn't support revocation")
+	}
+
+	req := new(request)
+	if err := parseJSON(r, req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("attest revoke: could not parse request: %w", err)
+	}
+
+	set := 0
+	for _, b := range []bool{req.Token != "", req.Identifier != "", req.ClientIdentifier != "", req.Before != nil} {
+		if b {
+			set++
+		}
+	}
+	if set != 1 {
+		return http.StatusBadRequest, errors.New("attest revoke: exactly one of token, identifier, client_identifier, or before must be given")
+	}
+
+	ctx := r.Context()
+
+	switch {
+	case req.Token != "":
+		if err := revoker.Revoke(req.Token); err != nil {
+			e := fmt.Errorf("attest revoke: could not revoke token: %w", err)
+			if errors.As(err, new(*tokenstore.InvalidTokenError)) {
+				return http.StatusBadRequest, e
+			}
+			return http.StatusInternalServerError, e
+		}
+		s.logger().Info("token revoked", logging.ContextArgs(ctx)...)
+	case req.Before != nil:
+		if err := revoker.RevokeBefore(*req.Before); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("attest revoke: could not revoke tokens: %w", err)
+		}
+		s.logger().Info("tokens revoked", logging.ContextArgs(ctx, "before", *req.Before)...)
+	default:
+		identifier := req.Identifier
+		if req.ClientIdentifier != "" {
+			identifier = req.ClientIdentifier
+			if trans, ok := transformer(s.Transport); ok {
+				i, err := trans.TransformContext(ctx, req.ClientIdentifier)
+				if err != nil {
+					e := fmt.Errorf("attest revoke: could not transform identifier: %w", err)
+					if errors.Is(err, ErrInvalidIdentifier) {
+						return http.StatusBadRequest, e
+					}
+					return http.StatusInternalServerError, e
+				}
+				identifier = i
+			}
+		}
+		if err := revoker.RevokeIdentifier(identifier); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("attest revoke: could not revoke identifier: %w", err)
+		}
+		s.logger().Info("tokens revoked", logging.ContextArgs(ctx, logging.KeyIdentifier, identifier)...)
+	}
+
+	return http.StatusOK, nil
+}
+
+// RevokeHandler is an administrative http.Handler that revokes tokens, e.g. when a device is lost or wiped. The TokenStore must implement tokenstore.Revoker.
+// The request body is JSON with exactly one of: "token" to revoke a single token, "identifier" to revoke all tokens for a (server-side) identifier,
+// "client_identifier" to transform a client identifier (e.g. a serial number) and revoke all tokens for the result, or "before" (RFC 3339) to revoke all tokens issued before that time.
+// RevokeHandler does no authentication of its own, so it must be protected by the caller and never exposed to devices
+func (s *AttestationService) RevokeHandler() http.Handler {
+	return s.withJSONResponse(s.revokeReturnHandlerFunc)
+}
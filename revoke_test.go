@@ -0,0 +1,73 @@
+package attest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// basicStore is a TokenStore that doesn't implement any optional tokenstore interfaces
+type basicStore struct{}
+
+func (basicStore) New(identifier string) (string, error)     { return identifier, nil }
+func (basicStore) Authenticate(token string) (string, error) { return token, nil }
+
+func TestRevokeHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		body func(token string) interface{}
+		code int
+		// revoked is whether the device's token is revoked
+		revoked bool
+		// otherRevoked is whether another device's token is revoked
+		otherRevoked bool
+	}{
+		{"token", func(token string) interface{} { return map[string]string{"token": token} }, http.StatusOK, true, false},
+		{"unknown token", func(token string) interface{} { return map[string]string{"token": "unknown"} }, http.StatusBadRequest, false, false},
+		{"identifier", func(token string) interface{} { return map[string]string{"identifier": "udid"} }, http.StatusOK, true, false},
+		{"client identifier", func(token string) interface{} { return map[string]string{"client_identifier": "serial"} }, http.StatusOK, true, false},
+		{"invalid client identifier", func(token string) interface{} { return map[string]string{"client_identifier": "unknown"} }, http.StatusBadRequest, false, false},
+		{"before", func(token string) interface{} {
+			return map[string]time.Time{"before": time.Now().Add(time.Second)}
+		}, http.StatusOK, true, true},
+		{"nothing", func(token string) interface{} { return map[string]string{} }, http.StatusBadRequest, false, false},
+		{"multiple", func(token string) interface{} { return map[string]string{"token": token, "identifier": "udid"} }, http.StatusBadRequest, false, false},
+		{"invalid json", func(token string) interface{} { return "{" }, http.StatusBadRequest, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, tr := newTestService(t)
+			s.Transport = &transformingTransport{tr, map[string]string{"serial": "udid"}}
+
+			token, err := s.TokenStore.New("udid")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+			other, err := s.TokenStore.New("other")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+
+			if w := doJSON(t, s.RevokeHandler(), http.MethodPost, "/", test.body(token)); w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+
+			if _, err = s.TokenStore.Authenticate(token); (err != nil) != test.revoked {
+				t.Errorf("expected token revoked: %t, got: %v", test.revoked, err)
+			}
+			if _, err = s.TokenStore.Authenticate(other); (err != nil) != test.otherRevoked {
+				t.Errorf("expected other token revoked: %t, got: %v", test.otherRevoked, err)
+			}
+		})
+	}
+}
+
+func TestRevokeHandlerNotImplemented(t *testing.T) {
+	s, _ := newTestService(t)
+	s.TokenStore = basicStore{}
+
+	if w := doJSON(t, s.RevokeHandler(), http.MethodPost, "/", map[string]string{"token": "token"}); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected status %d, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package attest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+// ScopePolicy decides which scopes a token is granted when it's placed
+type ScopePolicy interface {
+	// Scopes returns the scopes to grant the token placed for identifier. clientIdentifier is the identifier sent by the client before it was transformed
+	Scopes(ctx context.Context, clientIdentifier, identifier string) ([]string, error)
+}
+
+// ScopePolicyFunc is a func that implements ScopePolicy
+type ScopePolicyFunc func(ctx context.Context, clientIdentifier, identifier string) ([]string, error)
+
+// Scopes calls f
+func (f ScopePolicyFunc) Scopes(ctx context.Context, clientIdentifier, identifier string) ([]string, error) {
+	return f(ctx, clientIdentifier, identifier)
+}
+
+// StaticScopes returns a ScopePolicy that grants scopes to every token
+func StaticScopes(scopes ...string) ScopePolicy {
+	return ScopePolicyFunc(func(context.Context, string, string) ([]string, error) {
+		return scopes, nil
+	})
+}
+
+// InsufficientScopeError is returned by RequireScopes when the token hasn't been granted all of the required scopes
+type InsufficientScopeError struct {
+	// Required are the scopes required by RequireScopes
+	Required []string
+	// Missing are the required scopes the token hasn't been granted
+	Missing []string
+}
+
+func (e *InsufficientScopeError) Error() string {
+	return fmt.Sprintf("insufficient scope: missing %s", strings.Join(e.Missing, ", "))
+}
+
+// Detail returns a description of the error that's safe to return to the client
+func (e *InsufficientScopeError) Detail() string {
+	return fmt.Sprintf("token is missing required scopes: %s", strings.Join(e.Missing, " "))
+}
+
+// newToken creates a token for identifier with the scopes granted by ScopePolicy, if set.
+// If the TokenStore implements tokenstore.ClaimsTokenStore, the device's serial and UDID are also put in the token
+func (s *AttestationService) newToken(ctx context.Context, clientIdentifier, identifier string) (string, error) {
+	claims := &tokenstore.Claims{Identifier: identifier}
+	switch IdentifierType(ctx) {
+	case IdentifierTypeSerial:
+		claims.Serial = clientIdentifier
+	case IdentifierTypeUDID:
+		claims.UDID = clientIdentifier
+	}
+	if _, ok := transformer(s.Transport); ok && identifier != clientIdentifier && claims.UDID == "" {
+		claims.UDID = identifier
+	}
+
+	if s.ScopePolicy != nil {
+		scopes, err := s.ScopePolicy.Scopes(ctx, clientIdentifier, identifier)
+		if err != nil {
+			return "", fmt.Errorf("could not get scopes: %w", err)
+		}
+		claims.Scopes = scopes
+	}
+
+	cts, ok := s.TokenStore.(tokenstore.ClaimsTokenStore)
+	if !ok {
+		if len(claims.Scopes) > 0 {
+			return "", errors.New("TokenStore doesn't support scopes")
+		}
+		return s.TokenStore.New(identifier)
+	}
+	return cts.NewClaims(claims)
+}
+
+// tokenExpiry returns when token expires, or the zero time if the TokenStore doesn't implement tokenstore.ClaimsTokenStore
+func (s *AttestationService) tokenExpiry(token string) time.Time {
+	if _, ok := s.TokenStore.(tokenstore.ClaimsTokenStore); !ok {
+		return time.Time{}
+	}
+	c, err := tokenstore.AuthenticateClaims(s.TokenStore, token)
+	if err != nil {
+		return time.Time{}
+	}
+	return c.ExpiresAt
+}
+
+func (s *AttestationService) requireScopes(next http.Handler, scopes []string) ReturnHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) (int, interface{}) {
+		d, ok := FromContext(r.Context())
+		if !ok {
+			return http.StatusUnauthorized, fmt.Errorf("attest scopes: request not authenticated: %w", ErrMissingToken)
+		}
+
+		var missing []string
+		for _, scope := range scopes {
+			if !d.HasScopes(scope) {
+				missing = append(missing, scope)
+			}
+		}
+		if len(missing) > 0 {
+			return http.StatusForbidden, fmt.Errorf("attest scopes: %w", &InsufficientScopeError{Required: scopes, Missing: missing})
+		}
+
+		next.ServeHTTP(w, r)
+		return StatusCodeSkip, nil
+	}
+}
+
+// RequireScopes returns a middleware that responds with 403 Forbidden if the token authenticated by Middleware hasn't been granted all of scopes.
+// It must be wrapped by Middleware or JSONMiddleware, e.g. as.JSONMiddleware(as.RequireScopes("admin")(handler))
+func (s *AttestationService) RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return s.withJSONResponse(s.requireScopes(next, scopes))
+	}
+}
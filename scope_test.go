@@ -0,0 +1,148 @@
+package attest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+func TestNewToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ScopePolicy
+		store  tokenstore.TokenStore
+		scopes []string
+		valid  bool
+	}{
+		{"no policy", nil, nil, nil, true},
+		{"static", StaticScopes("a", "b"), nil, []string{"a", "b"}, true},
+		{"no scopes", StaticScopes(), basicStore{}, nil, true},
+		{"policy failed", ScopePolicyFunc(func(ctx context.Context, clientIdentifier, identifier string) ([]string, error) {
+			return nil, errors.New("failed")
+		}), nil, nil, false},
+		{"unsupported store", StaticScopes("a"), basicStore{}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			s.ScopePolicy = test.policy
+			if test.store != nil {
+				s.TokenStore = test.store
+			}
+
+			token, err := s.newToken(context.Background(), "serial", "udid")
+			if !test.valid {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+
+			c, err := tokenstore.AuthenticateClaims(s.TokenStore, token)
+			if err != nil {
+				t.Fatalf("could not authenticate token: %v", err)
+			}
+			if c.Identifier != "udid" || len(c.Scopes) != len(test.scopes) || !c.HasScopes(test.scopes...) {
+				t.Errorf("expected udid with scopes %v, got: %+v", test.scopes, c)
+			}
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopes   []string
+		required []string
+		auth     bool
+		code     int
+		detail   string
+	}{
+		{"granted", []string{"admin", "read"}, []string{"read"}, true, http.StatusOK, ""},
+		{"nothing required", nil, nil, true, http.StatusOK, ""},
+		{"missing", []string{"read"}, []string{"admin", "read", "write"}, true, http.StatusForbidden, "token is missing required scopes: admin write"},
+		{"not authenticated", []string{"read"}, []string{"read"}, false, http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			s.ScopePolicy = StaticScopes(test.scopes...)
+
+			token, err := s.newToken(context.Background(), "serial", "udid")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			h := s.RequireScopes(test.required...)(next)
+			if test.auth {
+				h = s.JSONMiddleware(h)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Fatalf("expected status %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if test.code == http.StatusOK {
+				return
+			}
+
+			resp := new(struct {
+				Detail string `json:"detail"`
+			})
+			decode(t, w, resp)
+			if resp.Detail != test.detail {
+				t.Errorf("expected detail %q, got %q", test.detail, resp.Detail)
+			}
+		})
+	}
+}
+
+func TestPlaceHandlerScopes(t *testing.T) {
+	s, tr := newTestService(t)
+	s.ScopePolicy = StaticScopes("read")
+
+	resp := place(t, s, "serial")
+	pl := waitStatus(t, s, resp.ID, transport.StatusCommandSent)
+
+	token, err := tr.fs.Get(pl.fsPath)
+	if err != nil {
+		t.Fatalf("could not get placed token: %v", err)
+	}
+	c, err := tokenstore.AuthenticateClaims(s.TokenStore, string(token))
+	if err != nil {
+		t.Fatalf("could not authenticate placed token: %v", err)
+	}
+	if !c.HasScopes("read") {
+		t.Errorf("expected placed token to have scope read, got %v", c.Scopes)
+	}
+
+	// scopes are carried over when the token is refreshed
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+string(token))
+	w := httptest.NewRecorder()
+	s.RefreshHandler().ServeHTTP(w, r)
+	refreshed := new(struct {
+		Token string `json:"token"`
+	})
+	decode(t, w, refreshed)
+	if c, err = tokenstore.AuthenticateClaims(s.TokenStore, refreshed.Token); err != nil || !c.HasScopes("read") {
+		t.Errorf("expected refreshed token to have scope read, got %+v, %v", c, err)
+	}
+}
@@ -1,35 +1,108 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/korylprince/macos-device-attestation/tokenstore"
 )
 
-// TokenStore implements a stateless TokenStore using JWTs
+const idSize = 16
+
+// claims are the claims put in a token
+type claims struct {
+	jwt.RegisteredClaims
+	// ChainStart is the time the first token in the chain was issued. If it's not set, the chain started when the token was issued
+	ChainStart *jwt.NumericDate `json:"cst,omitempty"`
+	// Scope is the space-separated list of scopes granted to the token (RFC 8693)
+	Scope  string `json:"scope,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	UDID   string `json:"udid,omitempty"`
+}
+
+// tokenClaims returns c as tokenstore.Claims
+func (c *claims) tokenClaims() *tokenstore.Claims {
+	tc := &tokenstore.Claims{
+		ID:         c.ID,
+		Identifier: c.Subject,
+		Serial:     c.Serial,
+		UDID:       c.UDID,
+		Scopes:     strings.Fields(c.Scope),
+	}
+	if c.IssuedAt != nil {
+		tc.IssuedAt = c.IssuedAt.Time
+	}
+	if c.ExpiresAt != nil {
+		tc.ExpiresAt = c.ExpiresAt.Time
+	}
+	return tc
+}
+
+// TokenStore implements a stateless TokenStore using JWTs.
+// Revocations are kept in an in-memory denylist of token IDs (the jti claim) and identifiers until the revoked tokens would have expired anyway,
+// so they aren't shared between multiple TokenStores using the same key
 type TokenStore struct {
 	key []byte
 	iss string
 	aud []string
 	dur time.Duration
+
+	// RefreshGrace is how long after a token expires it can still be refreshed with Refresh. RefreshGrace should be set before the TokenStore is used
+	RefreshGrace time.Duration
+
+	mu            sync.RWMutex
+	revokedBefore time.Time
+	denylist      *ttlcache.Cache
+	identifiers   *ttlcache.Cache
 }
 
 // New returns a new JWT TokenStore. key should be 256 bits. If iss and aud are set, they will be put in the token and verified by Authenticate. dur is used to set the iat, nbf, and exp claims
 func New(key []byte, iss string, aud []string, dur time.Duration) *TokenStore {
-	return &TokenStore{key: key, iss: iss, aud: aud, dur: dur}
+	newCache := func() *ttlcache.Cache {
+		c := ttlcache.NewCache()
+		if err := c.SetTTL(dur); err != nil {
+			panic(fmt.Errorf("could not set ttl on cache: %w", err))
+		}
+		c.SkipTTLExtensionOnHit(true)
+		return c
+	}
+	return &TokenStore{key: key, iss: iss, aud: aud, dur: dur, denylist: newCache(), identifiers: newCache()}
 }
 
-// New generates a new token for identifier
-func (t *TokenStore) New(identifier string) (token string, err error) {
-	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    t.iss,
-		Audience:  t.aud,
-		Subject:   identifier,
-		IssuedAt:  &jwt.NumericDate{Time: time.Now()},
-		NotBefore: &jwt.NumericDate{Time: time.Now().Add(-time.Second * 15)}, // allow small time drift
-		ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(t.dur)},
+// sign generates a new token with tc. If chainStart is not nil, it's set in the token
+func (t *TokenStore) sign(tc *tokenstore.Claims, chainStart *jwt.NumericDate) (token string, err error) {
+	for _, scope := range tc.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\n") {
+			return "", fmt.Errorf("invalid scope: %q", scope)
+		}
+	}
+
+	id := make([]byte, idSize)
+	if _, err = rand.Read(id); err != nil {
+		return "", fmt.Errorf("could not generate token id: %w", err)
+	}
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.iss,
+			Audience:  t.aud,
+			Subject:   tc.Identifier,
+			IssuedAt:  &jwt.NumericDate{Time: time.Now()},
+			NotBefore: &jwt.NumericDate{Time: time.Now().Add(-time.Second * 15)}, // allow small time drift
+			ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(t.dur)},
+			ID:        base64.RawURLEncoding.EncodeToString(id),
+		},
+		ChainStart: chainStart,
+		Scope:      strings.Join(tc.Scopes, " "),
+		Serial:     tc.Serial,
+		UDID:       tc.UDID,
 	})
 
 	token, err = tok.SignedString(t.key)
@@ -40,38 +113,198 @@ func (t *TokenStore) New(identifier string) (token string, err error) {
 	return token, nil
 }
 
-// Authenticate authenticates the token and returns the associated identifier.
-func (t *TokenStore) Authenticate(token string) (identifier string, err error) {
-	claims := make(jwt.MapClaims)
-	_, err = jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+// New generates a new token for identifier
+func (t *TokenStore) New(identifier string) (token string, err error) {
+	return t.sign(&tokenstore.Claims{Identifier: identifier}, nil)
+}
+
+// NewClaims generates a new token with claims. Scopes are put in the scope claim, and Serial and UDID in the serial and udid claims
+func (t *TokenStore) NewClaims(c *tokenstore.Claims) (token string, err error) {
+	return t.sign(c, nil)
+}
+
+// parse verifies the signature of token and returns its claims. Time based claims are not validated
+func (t *TokenStore) parse(token string) (*claims, error) {
+	c := new(claims)
+	p := &jwt.Parser{SkipClaimsValidation: true}
+	if _, err := p.ParseWithClaims(token, c, func(token *jwt.Token) (interface{}, error) {
 		// validate alg
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("invalid signing method: %v", token.Header["alg"])
 		}
 
 		return t.key, nil
-	})
-	if err != nil {
-		return "", &tokenstore.InvalidTokenError{Err: fmt.Errorf("could not parse token: %w", err)}
+	}); err != nil {
+		return nil, &tokenstore.InvalidTokenError{Err: fmt.Errorf("could not parse token: %w", err)}
+	}
+	return c, nil
+}
+
+// verify validates the claims of a parsed token. Tokens that expired less than grace ago are accepted
+func (t *TokenStore) verify(c *claims, grace time.Duration) error {
+	now := time.Now()
+	if !c.VerifyExpiresAt(now.Add(-grace), true) {
+		return &tokenstore.InvalidTokenError{Err: errors.New("token is expired")}
+	}
+	if !c.VerifyNotBefore(now, false) || !c.VerifyIssuedAt(now, false) {
+		return &tokenstore.InvalidTokenError{Err: errors.New("token is not valid yet")}
 	}
 
-	if err = claims.Valid(); err != nil {
-		return "", &tokenstore.InvalidTokenError{Err: fmt.Errorf("token is expired: %w", err)}
+	if t.iss != "" && c.Issuer != t.iss {
+		return &tokenstore.InvalidTokenError{Err: fmt.Errorf("invalid issuer: %s", c.Issuer)}
 	}
 
-	if !claims.VerifyIssuer(t.iss, t.iss == "") {
-		return "", &tokenstore.InvalidTokenError{Err: fmt.Errorf("invalid issuer: %s", claims["iss"])}
+	if len(t.aud) > 0 {
+		valid := false
+		for _, a := range t.aud {
+			if c.VerifyAudience(a, true) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return &tokenstore.InvalidTokenError{Err: fmt.Errorf("invalid audience: %v", c.Audience)}
+		}
 	}
 
-	if len(t.aud) == 0 {
-		return claims["sub"].(string), nil
+	if c.Subject == "" {
+		return &tokenstore.InvalidTokenError{Err: errors.New("empty subject")}
 	}
 
-	for _, a := range t.aud {
-		if claims.VerifyAudience(a, true) {
-			return claims["sub"].(string), nil
+	return t.verifyNotRevoked(c)
+}
+
+// verifyNotRevoked returns an InvalidTokenError if the token with claims c has been revoked
+func (t *TokenStore) verifyNotRevoked(c *claims) error {
+	revoked := &tokenstore.InvalidTokenError{Err: errors.New("token is revoked")}
+
+	if c.ID != "" {
+		if _, err := t.denylist.Get(c.ID); err == nil {
+			return revoked
 		}
 	}
 
-	return "", &tokenstore.InvalidTokenError{Err: fmt.Errorf("invalid audience: %v", claims["aud"])}
+	var issued time.Time
+	if c.IssuedAt != nil {
+		issued = c.IssuedAt.Time
+	}
+
+	t.mu.RLock()
+	before := t.revokedBefore
+	t.mu.RUnlock()
+	if issued.Before(before) {
+		return revoked
+	}
+
+	if at, err := t.identifiers.Get(c.Subject); err == nil && issued.Before(at.(time.Time)) {
+		return revoked
+	}
+
+	return nil
+}
+
+// Authenticate authenticates the token and returns the associated identifier.
+func (t *TokenStore) Authenticate(token string) (identifier string, err error) {
+	c, err := t.parse(token)
+	if err != nil {
+		return "", err
+	}
+
+	if err = t.verify(c, 0); err != nil {
+		return "", err
+	}
+
+	return c.Subject, nil
+}
+
+// AuthenticateClaims authenticates the token and returns its claims
+func (t *TokenStore) AuthenticateClaims(token string) (*tokenstore.Claims, error) {
+	c, err := t.parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = t.verify(c, 0); err != nil {
+		return nil, err
+	}
+
+	return c.tokenClaims(), nil
+}
+
+// Refresh authenticates token, accepting tokens that expired less than RefreshGrace ago, revokes it, and returns a new token with the same claims
+func (t *TokenStore) Refresh(token string, maxLifetime time.Duration) (string, error) {
+	c, err := t.parse(token)
+	if err != nil {
+		return "", err
+	}
+
+	if err = t.verify(c, t.RefreshGrace); err != nil {
+		return "", err
+	}
+
+	chainStart := c.ChainStart
+	if chainStart == nil {
+		chainStart = c.IssuedAt
+	}
+	if chainStart == nil {
+		return "", &tokenstore.InvalidTokenError{Err: errors.New("token has no issue time")}
+	}
+
+	if maxLifetime != 0 && time.Since(chainStart.Time) > maxLifetime {
+		return "", &tokenstore.InvalidTokenError{Err: tokenstore.ErrChainExpired}
+	}
+
+	if c.ID == "" {
+		return "", &tokenstore.InvalidTokenError{Err: errors.New("token has no id")}
+	}
+
+	// only allow a token to be refreshed once
+	t.mu.Lock()
+	if _, err = t.denylist.Get(c.ID); err == nil {
+		t.mu.Unlock()
+		return "", &tokenstore.InvalidTokenError{Err: errors.New("token is revoked")}
+	}
+	err = t.denylist.SetWithTTL(c.ID, struct{}{}, t.dur+t.RefreshGrace)
+	t.mu.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("could not add token to denylist: %w", err)
+	}
+
+	return t.sign(c.tokenClaims(), chainStart)
+}
+
+// Revoke adds the token's ID to the denylist. Tokens without an ID can't be revoked individually
+func (t *TokenStore) Revoke(token string) error {
+	c, err := t.parse(token)
+	if err != nil {
+		return err
+	}
+
+	if c.ID == "" {
+		return &tokenstore.InvalidTokenError{Err: errors.New("token has no id")}
+	}
+
+	if err = t.denylist.SetWithTTL(c.ID, struct{}{}, t.dur+t.RefreshGrace); err != nil {
+		return fmt.Errorf("could not add token to denylist: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeIdentifier revokes all tokens for identifier issued before now. Because the iat claim only has second precision, tokens issued in the same second are also revoked
+func (t *TokenStore) RevokeIdentifier(identifier string) error {
+	if err := t.identifiers.SetWithTTL(identifier, time.Now(), t.dur+t.RefreshGrace); err != nil {
+		return fmt.Errorf("could not add identifier to denylist: %w", err)
+	}
+	return nil
+}
+
+// RevokeBefore revokes all tokens issued before before
+func (t *TokenStore) RevokeBefore(before time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if before.After(t.revokedBefore) {
+		t.revokedBefore = before
+	}
+	return nil
 }
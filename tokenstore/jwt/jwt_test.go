@@ -0,0 +1,240 @@
+package jwt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+var testKey = []byte("01234567890123456789012345678901")
+
+// signClaims signs c with ts's key, for tokens New can't create, e.g. already expired ones
+func signClaims(t *testing.T, ts *TokenStore, c *claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(ts.key)
+	if err != nil {
+		t.Fatalf("could not sign token: %v", err)
+	}
+	return token
+}
+
+func isInvalid(err error) bool {
+	return errors.As(err, new(*tokenstore.InvalidTokenError))
+}
+
+func TestNewClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		valid  bool
+	}{
+		{"no scopes", nil, true},
+		{"scopes", []string{"a", "b:c"}, true},
+		{"empty scope", []string{"a", ""}, false},
+		{"scope with space", []string{"a b"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := New(testKey, "", nil, time.Hour)
+			token, err := ts.NewClaims(&tokenstore.Claims{Identifier: "device", Scopes: test.scopes})
+			if !test.valid {
+				if err == nil {
+					t.Error("expected error for invalid scope")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+
+			c, err := ts.AuthenticateClaims(token)
+			if err != nil {
+				t.Fatalf("could not authenticate token: %v", err)
+			}
+			if c.Identifier != "device" || len(c.Scopes) != len(test.scopes) || !c.HasScopes(test.scopes...) {
+				t.Errorf("expected identifier device with scopes %v, got: %+v", test.scopes, c)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(ts *TokenStore, token string) error
+		valid  bool
+	}{
+		{"not revoked", func(ts *TokenStore, token string) error { return nil }, true},
+		{"token", func(ts *TokenStore, token string) error { return ts.Revoke(token) }, false},
+		{"other token", func(ts *TokenStore, token string) error {
+			other, err := ts.New("device")
+			if err != nil {
+				return err
+			}
+			return ts.Revoke(other)
+		}, true},
+		{"identifier", func(ts *TokenStore, token string) error { return ts.RevokeIdentifier("device") }, false},
+		{"other identifier", func(ts *TokenStore, token string) error { return ts.RevokeIdentifier("other") }, true},
+		{"before now", func(ts *TokenStore, token string) error { return ts.RevokeBefore(time.Now().Add(time.Second)) }, false},
+		{"before past", func(ts *TokenStore, token string) error { return ts.RevokeBefore(time.Now().Add(-time.Hour)) }, true},
+		{"before never moves backwards", func(ts *TokenStore, token string) error {
+			if err := ts.RevokeBefore(time.Now().Add(time.Second)); err != nil {
+				return err
+			}
+			return ts.RevokeBefore(time.Now().Add(-time.Hour))
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := New(testKey, "iss", []string{"aud"}, time.Hour)
+			token, err := ts.New("device")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+
+			if err = test.revoke(ts, token); err != nil {
+				t.Fatalf("could not revoke: %v", err)
+			}
+
+			identifier, err := ts.Authenticate(token)
+			if test.valid {
+				if err != nil {
+					t.Fatalf("expected valid token, got: %v", err)
+				}
+				if identifier != "device" {
+					t.Errorf("expected identifier %q, got %q", "device", identifier)
+				}
+				return
+			}
+			if !isInvalid(err) {
+				t.Fatalf("expected InvalidTokenError, got: %v", err)
+			}
+			if _, err = ts.Refresh(token, 0); !isInvalid(err) {
+				t.Errorf("expected revoked token to not be refreshable, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestRevokeInvalidToken(t *testing.T) {
+	ts := New(testKey, "", nil, time.Hour)
+	other := New([]byte("98765432109876543210987654321098"), "", nil, time.Hour)
+	token, err := other.New("device")
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+
+	for _, token := range []string{"", "not a token", token} {
+		if err = ts.Revoke(token); !isInvalid(err) {
+			t.Errorf("Revoke(%q): expected InvalidTokenError, got: %v", token, err)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		grace       time.Duration
+		maxLifetime time.Duration
+		modify      func(c *claims)
+		err         error
+	}{
+		{"valid", 0, 0, nil, nil},
+		{"chain within lifetime", 0, time.Hour, func(c *claims) { c.ChainStart = jwt.NewNumericDate(now.Add(-time.Minute)) }, nil},
+		{"chain expired", 0, time.Hour, func(c *claims) { c.ChainStart = jwt.NewNumericDate(now.Add(-2 * time.Hour)) }, tokenstore.ErrChainExpired},
+		{"chain start from iat", 0, time.Hour, func(c *claims) { c.IssuedAt = jwt.NewNumericDate(now.Add(-2 * time.Hour)) }, tokenstore.ErrChainExpired},
+		{"expired within grace", time.Hour, 0, func(c *claims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute)) }, nil},
+		{"expired outside grace", time.Minute, 0, func(c *claims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Hour)) }, errors.New("token is expired")},
+		{"no id", 0, 0, func(c *claims) { c.ID = "" }, errors.New("token has no id")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := New(testKey, "", nil, time.Hour)
+			ts.RefreshGrace = test.grace
+
+			c := &claims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Subject:   "device",
+					ID:        "id",
+					IssuedAt:  jwt.NewNumericDate(now),
+					ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				},
+				Scope:  "a b",
+				Serial: "serial",
+			}
+			if test.modify != nil {
+				test.modify(c)
+			}
+			token := signClaims(t, ts, c)
+
+			newToken, err := ts.Refresh(token, test.maxLifetime)
+			if test.err != nil {
+				if !isInvalid(err) {
+					t.Fatalf("expected InvalidTokenError, got: %v", err)
+				}
+				if errors.Is(test.err, tokenstore.ErrChainExpired) && !errors.Is(err, tokenstore.ErrChainExpired) {
+					t.Errorf("expected ErrChainExpired, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not refresh: %v", err)
+			}
+
+			nc, err := ts.AuthenticateClaims(newToken)
+			if err != nil {
+				t.Fatalf("could not authenticate new token: %v", err)
+			}
+			if nc.Identifier != "device" || nc.Serial != "serial" || !nc.HasScopes("a", "b") {
+				t.Errorf("expected claims to be carried over, got: %+v", nc)
+			}
+
+			parsed, err := ts.parse(newToken)
+			if err != nil {
+				t.Fatalf("could not parse new token: %v", err)
+			}
+			wantStart := c.ChainStart
+			if wantStart == nil {
+				wantStart = c.IssuedAt
+			}
+			if parsed.ChainStart == nil || !parsed.ChainStart.Equal(wantStart.Time) {
+				t.Errorf("expected chain start %v, got %v", wantStart, parsed.ChainStart)
+			}
+
+			if _, err = ts.Refresh(token, test.maxLifetime); !isInvalid(err) {
+				t.Errorf("expected token to only be refreshable once, got: %v", err)
+			}
+			if _, err = ts.Authenticate(token); !isInvalid(err) {
+				t.Errorf("expected refreshed token to be revoked, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshRevokedChain(t *testing.T) {
+	ts := New(testKey, "", nil, time.Hour)
+	token, err := ts.New("device")
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+
+	newToken, err := ts.Refresh(token, 0)
+	if err != nil {
+		t.Fatalf("could not refresh: %v", err)
+	}
+
+	if err = ts.RevokeIdentifier("device"); err != nil {
+		t.Fatalf("could not revoke identifier: %v", err)
+	}
+
+	if _, err = ts.Refresh(newToken, 0); !isInvalid(err) {
+		t.Errorf("expected refreshed token to be revoked with its identifier, got: %v", err)
+	}
+}
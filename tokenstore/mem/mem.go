@@ -8,14 +8,35 @@ import (
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/korylprince/macos-device-attestation/logging"
 	"github.com/korylprince/macos-device-attestation/tokenstore"
 )
 
-const tokenSize = 32
+const (
+	tokenSize = 32
+	idSize    = 16
+)
+
+// errExpired is wrapped in an InvalidTokenError when an expired token that's kept for RefreshGrace is authenticated
+var errExpired = errors.New("token is expired")
+
+// entry is the data stored for a token
+type entry struct {
+	claims     tokenstore.Claims
+	chainStart time.Time
+}
 
 // TokenStore implements TokenStore completely in memory and uses an LRU cache to limit memory usage
 type TokenStore struct {
 	tokens *ttlcache.Cache
+	ttl    time.Duration
+
+	// RefreshGrace is how long after a token expires it can still be refreshed with Refresh. Expired tokens are kept in the store until then.
+	// RefreshGrace should be set before the TokenStore is used
+	RefreshGrace time.Duration
+
+	// Logger is an optional logging.Logger. Tokens are never logged
+	Logger logging.Logger
 }
 
 // New returns a new TokenStore with the given cache size (item count) and item ttl
@@ -26,33 +47,170 @@ func New(size int, ttl time.Duration) *TokenStore {
 		panic(fmt.Errorf("could not set ttl on cache: %w", err))
 	}
 	c.SkipTTLExtensionOnHit(true)
-	return &TokenStore{tokens: c}
+	t := &TokenStore{tokens: c, ttl: ttl}
+	c.SetExpirationReasonCallback(func(_ string, reason ttlcache.EvictionReason, e interface{}) {
+		switch reason {
+		case ttlcache.Expired:
+			logging.OrDiscard(t.Logger).Debug("token expired", logging.KeyIdentifier, e.(*entry).claims.Identifier)
+		case ttlcache.EvictedSize:
+			logging.OrDiscard(t.Logger).Warn("token evicted because store is full", logging.KeyIdentifier, e.(*entry).claims.Identifier)
+		}
+	})
+	return t
 }
 
-// New generates a new token identifier
-func (t *TokenStore) New(identifier string) (token string, err error) {
-	tok := make([]byte, tokenSize)
-	if _, err := rand.Read(tok); err != nil {
+// randomString returns a random, base64 encoded string from size bytes
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// set generates a new token with claims. The ID, IssuedAt, and ExpiresAt claims are set to new values
+func (t *TokenStore) set(claims tokenstore.Claims, chainStart time.Time) (token string, err error) {
+	token, err = randomString(tokenSize)
+	if err != nil {
 		return "", fmt.Errorf("could not generate token: %w", err)
 	}
 
-	token = base64.RawURLEncoding.EncodeToString(tok)
+	if claims.ID, err = randomString(idSize); err != nil {
+		return "", fmt.Errorf("could not generate token id: %w", err)
+	}
+	claims.IssuedAt = time.Now()
+	claims.ExpiresAt = claims.IssuedAt.Add(t.ttl)
+	claims.Scopes = append([]string(nil), claims.Scopes...)
+	if chainStart.IsZero() {
+		chainStart = claims.IssuedAt
+	}
 
-	if err := t.tokens.Set(token, identifier); err != nil {
+	// the token is kept after it expires so it can be refreshed during the grace period
+	if err := t.tokens.SetWithTTL(token, &entry{claims: claims, chainStart: chainStart}, t.ttl+t.RefreshGrace); err != nil {
 		return "", fmt.Errorf("could not set token: %w", err)
 	}
 	return token, nil
 }
 
+// New generates a new token identifier
+func (t *TokenStore) New(identifier string) (token string, err error) {
+	return t.NewClaims(&tokenstore.Claims{Identifier: identifier})
+}
+
+// NewClaims generates a new token with claims
+func (t *TokenStore) NewClaims(claims *tokenstore.Claims) (token string, err error) {
+	return t.set(*claims, time.Time{})
+}
+
+// get returns the entry for token
+func (t *TokenStore) get(token string) (*entry, error) {
+	e, err := t.tokens.Get(token)
+	if errors.Is(err, ttlcache.ErrNotFound) {
+		return nil, &tokenstore.InvalidTokenError{Err: ttlcache.ErrNotFound}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not query cache: %w", err)
+	}
+	return e.(*entry), nil
+}
+
+// valid returns the entry for token if it expired less than grace ago
+func (t *TokenStore) valid(token string, grace time.Duration) (*entry, error) {
+	e, err := t.get(token)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(e.claims.ExpiresAt.Add(grace)) {
+		return nil, &tokenstore.InvalidTokenError{Err: errExpired}
+	}
+	return e, nil
+}
+
 // Authenticate authenticates the token and returns the associated identifier
 func (t *TokenStore) Authenticate(token string) (identifier string, err error) {
-	id, err := t.tokens.Get(token)
+	e, err := t.valid(token, 0)
+	if err != nil {
+		return "", err
+	}
+	return e.claims.Identifier, nil
+}
+
+// AuthenticateClaims authenticates the token and returns its claims
+func (t *TokenStore) AuthenticateClaims(token string) (*tokenstore.Claims, error) {
+	e, err := t.valid(token, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := e.claims
+	c.Scopes = append([]string(nil), c.Scopes...)
+	return &c, nil
+}
+
+// Refresh removes token from the store and returns a new token with the same claims. Tokens that expired less than RefreshGrace ago are accepted
+func (t *TokenStore) Refresh(token string, maxLifetime time.Duration) (string, error) {
+	e, err := t.valid(token, t.RefreshGrace)
+	if err != nil {
+		return "", err
+	}
+
+	if maxLifetime != 0 && time.Since(e.chainStart) > maxLifetime {
+		return "", &tokenstore.InvalidTokenError{Err: tokenstore.ErrChainExpired}
+	}
+
+	if err = t.tokens.Remove(token); err != nil {
+		if errors.Is(err, ttlcache.ErrNotFound) {
+			// token was refreshed or revoked concurrently
+			return "", &tokenstore.InvalidTokenError{Err: ttlcache.ErrNotFound}
+		}
+		return "", fmt.Errorf("could not remove token: %w", err)
+	}
+
+	return t.set(e.claims, e.chainStart)
+}
+
+// Revoke removes token from the store
+func (t *TokenStore) Revoke(token string) error {
+	err := t.tokens.Remove(token)
 	if errors.Is(err, ttlcache.ErrNotFound) {
-		return "", &tokenstore.InvalidTokenError{Err: ttlcache.ErrNotFound}
+		return &tokenstore.InvalidTokenError{Err: ttlcache.ErrNotFound}
 	}
 	if err != nil {
-		return "", fmt.Errorf("could not query cache: %w", err)
+		return fmt.Errorf("could not remove token: %w", err)
+	}
+	return nil
+}
+
+// revokeMatching removes all tokens whose entry matches
+func (t *TokenStore) revokeMatching(match func(e *entry) bool) error {
+	for _, token := range t.tokens.GetKeys() {
+		e, err := t.tokens.Get(token)
+		if errors.Is(err, ttlcache.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not query cache: %w", err)
+		}
+		if !match(e.(*entry)) {
+			continue
+		}
+		if err = t.tokens.Remove(token); err != nil && !errors.Is(err, ttlcache.ErrNotFound) {
+			return fmt.Errorf("could not remove token: %w", err)
+		}
 	}
+	return nil
+}
+
+// RevokeIdentifier removes all tokens issued for identifier from the store
+func (t *TokenStore) RevokeIdentifier(identifier string) error {
+	return t.revokeMatching(func(e *entry) bool { return e.claims.Identifier == identifier })
+}
+
+// RevokeBefore removes all tokens issued before before from the store
+func (t *TokenStore) RevokeBefore(before time.Time) error {
+	return t.revokeMatching(func(e *entry) bool { return e.claims.IssuedAt.Before(before) })
+}
 
-	return id.(string), nil
+// Len returns the number of tokens currently stored
+func (t *TokenStore) Len() int {
+	return t.tokens.Count()
 }
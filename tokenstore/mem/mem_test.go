@@ -0,0 +1,174 @@
+package mem
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation/tokenstore"
+)
+
+func isInvalid(err error) bool {
+	return errors.As(err, new(*tokenstore.InvalidTokenError))
+}
+
+func TestRevoke(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(ts *TokenStore, token string) error
+		valid  bool
+		// otherValid is whether another device's token is still valid
+		otherValid bool
+	}{
+		{"not revoked", func(ts *TokenStore, token string) error { return nil }, true, true},
+		{"token", func(ts *TokenStore, token string) error { return ts.Revoke(token) }, false, true},
+		{"identifier", func(ts *TokenStore, token string) error { return ts.RevokeIdentifier("device") }, false, true},
+		{"other identifier", func(ts *TokenStore, token string) error { return ts.RevokeIdentifier("other") }, true, true},
+		{"before now", func(ts *TokenStore, token string) error { return ts.RevokeBefore(time.Now().Add(time.Second)) }, false, false},
+		{"before past", func(ts *TokenStore, token string) error { return ts.RevokeBefore(time.Now().Add(-time.Hour)) }, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := New(10, time.Hour)
+			token, err := ts.New("device")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+			other, err := ts.New("other-device")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+
+			if err = test.revoke(ts, token); err != nil {
+				t.Fatalf("could not revoke: %v", err)
+			}
+
+			_, err = ts.Authenticate(token)
+			if test.valid && err != nil {
+				t.Errorf("expected valid token, got: %v", err)
+			}
+			if !test.valid && !isInvalid(err) {
+				t.Errorf("expected InvalidTokenError, got: %v", err)
+			}
+
+			if _, err = ts.Authenticate(other); test.otherValid != (err == nil) {
+				t.Errorf("expected other device's token valid to be %v, got: %v", test.otherValid, err)
+			}
+		})
+	}
+}
+
+func TestRevokeUnknownToken(t *testing.T) {
+	ts := New(10, time.Hour)
+	if err := ts.Revoke("unknown"); !isInvalid(err) {
+		t.Errorf("expected InvalidTokenError, got: %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLifetime time.Duration
+		age         time.Duration
+		expired     bool
+	}{
+		{"no max lifetime", 0, 24 * time.Hour, false},
+		{"within lifetime", time.Hour, time.Minute, false},
+		{"chain expired", time.Hour, 2 * time.Hour, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := New(10, time.Hour)
+			token, err := ts.NewClaims(&tokenstore.Claims{Identifier: "device", Serial: "serial", Scopes: []string{"a"}})
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+			e, err := ts.get(token)
+			if err != nil {
+				t.Fatalf("could not get token: %v", err)
+			}
+			e.chainStart = e.chainStart.Add(-test.age)
+			chainStart := e.chainStart
+
+			newToken, err := ts.Refresh(token, test.maxLifetime)
+			if test.expired {
+				if !errors.Is(err, tokenstore.ErrChainExpired) || !isInvalid(err) {
+					t.Fatalf("expected InvalidTokenError wrapping ErrChainExpired, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not refresh: %v", err)
+			}
+
+			c, err := ts.AuthenticateClaims(newToken)
+			if err != nil {
+				t.Fatalf("could not authenticate new token: %v", err)
+			}
+			if c.Identifier != "device" || c.Serial != "serial" || !c.HasScopes("a") {
+				t.Errorf("expected claims to be carried over, got: %+v", c)
+			}
+
+			ne, err := ts.get(newToken)
+			if err != nil {
+				t.Fatalf("could not get new token: %v", err)
+			}
+			if !ne.chainStart.Equal(chainStart) {
+				t.Errorf("expected chain start %v, got %v", chainStart, ne.chainStart)
+			}
+
+			if _, err = ts.Authenticate(token); !isInvalid(err) {
+				t.Errorf("expected refreshed token to be removed, got: %v", err)
+			}
+			if _, err = ts.Refresh(token, test.maxLifetime); !isInvalid(err) {
+				t.Errorf("expected token to only be refreshable once, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshGrace(t *testing.T) {
+	tests := []struct {
+		name string
+		// expired is how long ago the token expired
+		expired     time.Duration
+		grace       time.Duration
+		refreshable bool
+	}{
+		{"not expired", -time.Minute, 0, true},
+		{"expired without grace", time.Minute, 0, false},
+		{"within grace", time.Minute, time.Hour, true},
+		{"after grace", 2 * time.Hour, time.Hour, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := New(10, time.Hour)
+			ts.RefreshGrace = test.grace
+			token, err := ts.New("device")
+			if err != nil {
+				t.Fatalf("could not create token: %v", err)
+			}
+			e, err := ts.get(token)
+			if err != nil {
+				t.Fatalf("could not get token: %v", err)
+			}
+			e.claims.ExpiresAt = time.Now().Add(-test.expired)
+
+			// expired tokens are kept for the grace period, but can't be used to authenticate
+			if _, err = ts.Authenticate(token); (err == nil) != (test.expired < 0) {
+				t.Errorf("expected authenticated %t, got: %v", test.expired < 0, err)
+			}
+
+			_, err = ts.Refresh(token, 0)
+			if test.refreshable && err != nil {
+				t.Errorf("expected refresh, got: %v", err)
+			}
+			if !test.refreshable && !isInvalid(err) {
+				t.Errorf("expected InvalidTokenError, got: %v", err)
+			}
+		})
+	}
+}
@@ -1,6 +1,13 @@
 package tokenstore
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrChainExpired is wrapped in an InvalidTokenError by Refresher.Refresh when a token's chain has exceeded its maximum lifetime
+var ErrChainExpired = errors.New("token chain expired")
 
 // TokenStore is an interface to generate and authenticate tokens associated with device identifiers
 type TokenStore interface {
@@ -10,6 +17,80 @@ type TokenStore interface {
 	Authenticate(token string) (identifier string, err error)
 }
 
+// Revoker is an optional interface a TokenStore can implement to revoke tokens before they expire. Revoked tokens fail Authenticate with an InvalidTokenError
+type Revoker interface {
+	// Revoke revokes token. If token is invalid, err will be of type InvalidTokenError
+	Revoke(token string) error
+	// RevokeIdentifier revokes all tokens issued for identifier
+	RevokeIdentifier(identifier string) error
+	// RevokeBefore revokes all tokens issued before t
+	RevokeBefore(t time.Time) error
+}
+
+// Refresher is an optional interface a TokenStore can implement to issue a new token in exchange for an existing one, without placing a new token on the device.
+// A token created by New starts a chain; tokens created by Refresh belong to the same chain as the token they replaced
+type Refresher interface {
+	// Refresh authenticates token and returns a new token for the same identifier and claims. Implementations should revoke token if they can.
+	// If token's chain started more than maxLifetime ago, err will be of type InvalidTokenError wrapping ErrChainExpired. If maxLifetime is zero, chains never expire.
+	// If token is invalid, err will be of type InvalidTokenError
+	Refresh(token string, maxLifetime time.Duration) (newToken string, err error)
+}
+
+// Claims are the attributes of a token
+type Claims struct {
+	// ID uniquely identifies the token. It's set by the TokenStore
+	ID string
+	// Identifier is the device identifier the token was issued for
+	Identifier string
+	// Serial is the serial number of the device, if known
+	Serial string
+	// UDID is the UDID of the device, if known
+	UDID string
+	// Scopes are the scopes granted to the token. Scopes must not contain spaces
+	Scopes []string
+	// IssuedAt is when the token was issued. It's set by the TokenStore
+	IssuedAt time.Time
+	// ExpiresAt is when the token expires. It's set by the TokenStore
+	ExpiresAt time.Time
+}
+
+// HasScopes returns true if c has been granted all of scopes
+func (c *Claims) HasScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, s := range c.Scopes {
+			if s == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ClaimsTokenStore is an optional interface a TokenStore can implement to issue tokens with Claims other than the identifier, e.g. scopes
+type ClaimsTokenStore interface {
+	// NewClaims generates a new token with claims. ID, IssuedAt, and ExpiresAt are ignored
+	NewClaims(claims *Claims) (token string, err error)
+	// AuthenticateClaims authenticates the token and returns its claims. If token is invalid, err will be of type InvalidTokenError
+	AuthenticateClaims(token string) (claims *Claims, err error)
+}
+
+// AuthenticateClaims authenticates token with ts and returns its claims. If ts doesn't implement ClaimsTokenStore, only the Identifier is set
+func AuthenticateClaims(ts TokenStore, token string) (*Claims, error) {
+	if cts, ok := ts.(ClaimsTokenStore); ok {
+		return cts.AuthenticateClaims(token)
+	}
+	identifier, err := ts.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Claims{Identifier: identifier}, nil
+}
+
 type InvalidTokenError struct {
 	Err error
 }
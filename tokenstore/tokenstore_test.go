@@ -0,0 +1,53 @@
+package tokenstore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHasScopes(t *testing.T) {
+	c := &Claims{Identifier: "device", Scopes: []string{"a", "b"}}
+
+	tests := []struct {
+		scopes []string
+		has    bool
+	}{
+		{nil, true},
+		{[]string{"a"}, true},
+		{[]string{"b", "a"}, true},
+		{[]string{"a", "c"}, false},
+		{[]string{"ab"}, false},
+	}
+
+	for _, test := range tests {
+		if has := c.HasScopes(test.scopes...); has != test.has {
+			t.Errorf("HasScopes(%v): expected %t, got %t", test.scopes, test.has, has)
+		}
+	}
+}
+
+// identifierStore is a TokenStore whose tokens are the identifier
+type identifierStore struct{}
+
+func (identifierStore) New(identifier string) (string, error) { return identifier, nil }
+
+func (identifierStore) Authenticate(token string) (string, error) {
+	if token == "" {
+		return "", &InvalidTokenError{Err: errors.New("empty token")}
+	}
+	return token, nil
+}
+
+func TestAuthenticateClaims(t *testing.T) {
+	c, err := AuthenticateClaims(identifierStore{}, "device")
+	if err != nil {
+		t.Fatalf("could not authenticate: %v", err)
+	}
+	if c.Identifier != "device" || len(c.Scopes) != 0 {
+		t.Errorf("expected identifier device without scopes, got: %+v", c)
+	}
+
+	if _, err = AuthenticateClaims(identifierStore{}, ""); !errors.As(err, new(*InvalidTokenError)) {
+		t.Errorf("expected InvalidTokenError, got: %v", err)
+	}
+}
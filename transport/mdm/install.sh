@@ -1,9 +1,25 @@
 #!/bin/bash
 
-# use install to create a new file with locked off permissions so a timing attack can't get a read handle
-rm -f {{.Path}}
-install -m 600 /dev/null {{.Path}}
+path={{quote .Path}}
+dir={{quote .Dir}}
+
+# only root should be able to see anything this script creates
+umask 077
+
+# mkdir -m is atomic, so the directory never exists with looser permissions. Intermediate directories get 700 from umask
+mkdir -p -m 700 "$dir"
+
+# refuse to use a directory that could have been created or swapped by someone else
+if [ -L "$dir" ] || [ ! -d "$dir" ] || [ "$(stat -f '%u %Lp' "$dir")" != "0 700" ]; then
+    echo "$dir is not a directory owned by root with mode 700" >&2
+    exit 1
+fi
+
+# mktemp creates a new file with mode 600 that didn't exist before, so a timing attack can't get a read handle
+tmp="$(mktemp "$dir/.token.XXXXXXXX")" || exit 1
 # use built-in echo so token isn't leaked in process parameters
-echo -n "{{.Token}}" > {{.Path}}
+echo -n {{quote .Token}} > "$tmp"
+# rename is atomic, so the token is never visible at path partially written
+mv -f "$tmp" "$path" || { rm -f "$tmp"; exit 1; }
 # fork, wait 2 minutes, and clean secret
-{ sleep 120; rm -f {{.Path}}; }&
+{ sleep 120; rm -f "$path"; }&
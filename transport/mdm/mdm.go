@@ -2,9 +2,13 @@ package mdm
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"text/template"
 
 	// embed install.sh
@@ -12,12 +16,19 @@ import (
 
 	macospkg "github.com/korylprince/go-macos-pkg"
 	"github.com/korylprince/macos-device-attestation/filestore"
+	"github.com/korylprince/macos-device-attestation/logging"
 	"github.com/korylprince/macos-device-attestation/mdm"
+	"github.com/korylprince/macos-device-attestation/transport"
 )
 
 //go:embed install.sh
 var installScript string
-var tmplPostinstall = template.Must(template.New("install.sh").Parse(installScript))
+var tmplPostinstall = template.Must(template.New("install.sh").Funcs(template.FuncMap{"quote": quote}).Parse(installScript))
+
+// quote single-quotes s for use in a shell script
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
 // Transport implements a Transport which uses an MDM to install a signed pkg to place a secure token on the filesystem
 type Transport struct {
@@ -26,21 +37,42 @@ type Transport struct {
 	filestore.FileStore
 	cert *x509.Certificate
 	key  *rsa.PrivateKey
+	// Logger is an optional logging.Logger
+	Logger logging.Logger
 }
 
-// New returns a new Transport with the given parameters.
-// cert should be an "Apple Developer ID Installer" certificate
+// New returns a new Transport with the given parameters. urlPrefix is the URL FileStore paths are appended to; it's set automatically if attest.AttestationService.Handler is used.
+// If it's empty and isn't set by Handler, PlaceContext returns an error. cert should be an "Apple Developer ID Installer" certificate
 func New(m mdm.MDM, urlPrefix string, fs filestore.FileStore, cert *x509.Certificate, key *rsa.PrivateKey) *Transport {
 	return &Transport{MDM: m, prefix: urlPrefix, FileStore: fs, cert: cert, key: key}
 }
 
+// SetFileURLPrefix sets the URL prefix (without the trailing slash) of the FileStore handler that devices download payloads from. It must not be called while the Transport is in use
+func (m *Transport) SetFileURLPrefix(prefix string) {
+	m.prefix = strings.TrimSuffix(prefix, "/")
+}
+
 // Place places the token at path on the device with udid
 func (m *Transport) Place(token, udid, path string) error {
+	return m.PlaceContext(context.Background(), token, udid, path)
+}
+
+// PlaceContext places the token at path on the device with udid. The directory containing path is created owned by root with mode 0700 if it doesn't exist.
+// If it already exists and isn't a directory owned by root with mode 0700, the token isn't placed
+func (m *Transport) PlaceContext(ctx context.Context, token, udid, path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path || filepath.Dir(path) == "/" {
+		return errors.New("path must be a clean, absolute path not in /")
+	}
+	if m.prefix == "" {
+		return errors.New("file URL prefix not set")
+	}
+
 	postinstall := new(bytes.Buffer)
 	if err := tmplPostinstall.Execute(postinstall, struct {
 		Token string
 		Path  string
-	}{token, path}); err != nil {
+		Dir   string
+	}{token, path, filepath.Dir(path)}); err != nil {
 		return fmt.Errorf("could not create postinstall script: %w", err)
 	}
 
@@ -54,16 +86,33 @@ func (m *Transport) Place(token, udid, path string) error {
 		return fmt.Errorf("could not sign payload pkg: %w", err)
 	}
 
-	fsPath, err := m.Put("payload.pkg", signedPkg)
+	fsPath, err := filestore.WithContext(m.FileStore).PutContext(ctx, "payload.pkg", signedPkg)
 	if err != nil {
 		return fmt.Errorf("could not store payload pkg: %w", err)
 	}
+	transport.ReportStatus(ctx, transport.StatusPkgGenerated, fsPath)
+	logging.OrDiscard(m.Logger).Debug("payload pkg stored", logging.ContextArgs(ctx,
+		logging.KeyUDID, udid,
+		logging.KeyPlacementPath, path,
+		logging.KeyFileStorePath, fsPath,
+	)...)
 
 	manifest := macospkg.NewManifest(signedPkg, fmt.Sprintf("%s/%s", m.prefix, fsPath), macospkg.ManifestHashSHA256)
 
-	if err = m.InstallEnterpriseApplication(udid, manifest); err != nil {
+	if err = mdm.WithContext(m.MDM).InstallEnterpriseApplicationContext(ctx, udid, manifest); err != nil {
 		return fmt.Errorf("could not execute install command: %w", err)
 	}
+	transport.ReportStatus(ctx, transport.StatusCommandSent, fsPath)
+	logging.OrDiscard(m.Logger).Info("install command sent", logging.ContextArgs(ctx,
+		logging.KeyUDID, udid,
+		logging.KeyPlacementPath, path,
+		logging.KeyFileStorePath, fsPath,
+	)...)
 
 	return nil
 }
+
+// TransformContext returns the UDID for the given serial. If the serial is not found, attest.ErrInvalidIdentifier is returned
+func (m *Transport) TransformContext(ctx context.Context, serial string) (string, error) {
+	return mdm.WithContext(m.MDM).TransformContext(ctx, serial)
+}
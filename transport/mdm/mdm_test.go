@@ -0,0 +1,30 @@
+package mdm
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPlaceContextInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		path   string
+		err    string
+	}{
+		{"relative path", "https://attest.example.com/files", "token", "path must be"},
+		{"unclean path", "https://attest.example.com/files", "/var/run/../token", "path must be"},
+		{"path in root", "https://attest.example.com/files", "/token", "path must be"},
+		{"no prefix", "", "/var/run/macos-device-attestation/token", "file URL prefix not set"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := New(nil, test.prefix, nil, nil, nil)
+			if err := m.PlaceContext(context.Background(), "token", "udid", test.path); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
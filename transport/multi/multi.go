@@ -0,0 +1,207 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/korylprince/macos-device-attestation"
+	"github.com/korylprince/macos-device-attestation/logging"
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+// resolvedCacheSize is the number of identifiers returned by TransformContext that are remembered for PlaceContext
+const resolvedCacheSize = 10000
+
+// Entry is a Transport tried by a multi Transport
+type Entry struct {
+	// Name identifies the Transport in logs and placement statuses
+	Name string
+	transport.Transport
+}
+
+// transform transforms identifier with the Entry's Transport if it implements attest.ContextTransformer or attest.Transformer. Otherwise identifier is returned unchanged
+func (e *Entry) transform(ctx context.Context, identifier string) (string, error) {
+	switch t := e.Transport.(type) {
+	case attest.ContextTransformer:
+		return t.TransformContext(ctx, identifier)
+	case attest.Transformer:
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		return t.Transform(identifier)
+	}
+	return identifier, nil
+}
+
+// DefaultFallthrough falls through to the next Transport for every error except the placement's context being canceled or its deadline being exceeded
+func DefaultFallthrough(ctx context.Context, err error) bool {
+	return ctx.Err() == nil
+}
+
+// Error is returned when no Transport placed the token. It holds the error returned by each Transport that was tried, in order
+type Error struct {
+	Errors []error
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("all transports failed: %s", strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error from the last Transport tried
+func (e *Error) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[len(e.Errors)-1]
+}
+
+// resolved is the Transport that transformed an identifier in TransformContext, and the identifier sent by the client
+type resolved struct {
+	entry            int
+	clientIdentifier string
+}
+
+// Transport implements transport.Transport and attest.ContextTransformer by trying each of its Transports in order until one places the token.
+// TransformContext returns the identifier transformed by the first Transport that accepts it, like a single Transport would, so tokens, coalescing, Authorizers,
+// and revocation are keyed the same as with that Transport alone. PlaceContext places with that Transport first, then transforms the client's identifier
+// separately for each Transport it falls through to. A Transport whose Transformer returns attest.ErrInvalidIdentifier (e.g. an MDM that doesn't know the device) is skipped
+type Transport struct {
+	entries []*Entry
+	// resolved maps identifiers returned by TransformContext to a *resolved
+	resolved *lru.TwoQueueCache
+	// Fallthrough decides whether the next Transport is tried after a Transport returns err. If nil, DefaultFallthrough is used
+	Fallthrough func(ctx context.Context, err error) bool
+	// Logger is an optional logging.Logger
+	Logger logging.Logger
+}
+
+// New returns a new Transport that tries entries in order
+func New(entries ...*Entry) *Transport {
+	resolved, err := lru.New2Q(resolvedCacheSize)
+	if err != nil {
+		panic(fmt.Errorf("could not create cache: %w", err))
+	}
+	return &Transport{entries: entries, resolved: resolved}
+}
+
+func (t *Transport) shouldFallthrough(ctx context.Context, err error) bool {
+	if t.Fallthrough == nil {
+		return DefaultFallthrough(ctx, err)
+	}
+	return t.Fallthrough(ctx, err)
+}
+
+// SetFileURLPrefix sets the file URL prefix of each Transport that implements attest.FileURLPrefixSetter
+func (t *Transport) SetFileURLPrefix(prefix string) {
+	for _, e := range t.entries {
+		if setter, ok := e.Transport.(attest.FileURLPrefixSetter); ok {
+			setter.SetFileURLPrefix(prefix)
+		}
+	}
+}
+
+// Place places the token at path on the device identified by identifier
+func (t *Transport) Place(token, identifier, path string) error {
+	return t.PlaceContext(context.Background(), token, identifier, path)
+}
+
+// order returns the indexes of the entries in the order they're tried, starting with first if it's not negative
+func (t *Transport) order(first int) []int {
+	order := make([]int, 0, len(t.entries))
+	if first >= 0 {
+		order = append(order, first)
+	}
+	for i := range t.entries {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// PlaceContext places the token at path with each Transport in order, until one succeeds or returns an error Fallthrough rejects.
+// If identifier was returned by TransformContext, the Transport that transformed it is tried first with identifier, and the others transform the client's identifier.
+// Otherwise identifier is treated as the client's identifier and transformed by each Transport. Before each Transport is tried, its name is reported with transport.ReportTransport
+func (t *Transport) PlaceContext(ctx context.Context, token, identifier, path string) error {
+	first, clientIdentifier := -1, identifier
+	if v, ok := t.resolved.Get(identifier); ok {
+		r := v.(*resolved)
+		first, clientIdentifier = r.entry, r.clientIdentifier
+	}
+
+	var errs []error
+	for _, i := range t.order(first) {
+		e := t.entries[i]
+		id, err := identifier, error(nil)
+		if i != first {
+			id, err = e.transform(ctx, clientIdentifier)
+		}
+		if errors.Is(err, attest.ErrInvalidIdentifier) {
+			logging.OrDiscard(t.Logger).Debug("identifier not found by transport", logging.ContextArgs(ctx,
+				logging.KeyTransport, e.Name,
+				logging.KeyClientIdentifier, clientIdentifier,
+			)...)
+			errs = append(errs, fmt.Errorf("%s: could not transform identifier: %w", e.Name, err))
+			continue
+		}
+		if err == nil {
+			transport.ReportTransport(ctx, e.Name)
+			if err = transport.WithContext(e.Transport).PlaceContext(ctx, token, id, path); err == nil {
+				logging.OrDiscard(t.Logger).Info("token placed", logging.ContextArgs(ctx,
+					logging.KeyTransport, e.Name,
+					logging.KeyIdentifier, id,
+					logging.KeyPlacementPath, path,
+				)...)
+				return nil
+			}
+			err = fmt.Errorf("%s: could not place token: %w", e.Name, err)
+		} else {
+			err = fmt.Errorf("%s: could not transform identifier: %w", e.Name, err)
+		}
+
+		errs = append(errs, err)
+		if !t.shouldFallthrough(ctx, err) {
+			break
+		}
+		logging.OrDiscard(t.Logger).Warn("transport failed, falling through", logging.ContextArgs(ctx,
+			logging.KeyTransport, e.Name,
+			logging.KeyClientIdentifier, clientIdentifier,
+			logging.KeyError, err,
+		)...)
+	}
+
+	if len(errs) == 0 {
+		return errors.New("no transports configured")
+	}
+	return &Error{Errors: errs}
+}
+
+// TransformContext returns identifier transformed by the first Transport, in order, that accepts it, and remembers the Transport so PlaceContext tries it first.
+// If no Transport accepts identifier, attest.ErrInvalidIdentifier is returned
+func (t *Transport) TransformContext(ctx context.Context, identifier string) (string, error) {
+	var last error
+	for i, e := range t.entries {
+		id, err := e.transform(ctx, identifier)
+		if err == nil {
+			t.resolved.Add(id, &resolved{entry: i, clientIdentifier: identifier})
+			return id, nil
+		}
+		if !errors.Is(err, attest.ErrInvalidIdentifier) {
+			last = fmt.Errorf("%s: %w", e.Name, err)
+			if !t.shouldFallthrough(ctx, last) {
+				return "", last
+			}
+		}
+	}
+	if last != nil {
+		return "", last
+	}
+	return "", attest.ErrInvalidIdentifier
+}
@@ -0,0 +1,256 @@
+package multi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korylprince/macos-device-attestation"
+	fsmem "github.com/korylprince/macos-device-attestation/filestore/mem"
+	tsmem "github.com/korylprince/macos-device-attestation/tokenstore/mem"
+	"github.com/korylprince/macos-device-attestation/transport"
+)
+
+// testTransport is a Transport that records placements and fails with err, if set
+type testTransport struct {
+	err error
+
+	mu     sync.Mutex
+	placed []string
+}
+
+func (t *testTransport) Place(token, identifier, path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.placed = append(t.placed, identifier)
+	return t.err
+}
+
+// transformingTransport is a testTransport that transforms identifiers with udids.
+// Unknown identifiers are invalid, unless transformErr is set, in which case it's returned instead
+type transformingTransport struct {
+	*testTransport
+	udids        map[string]string
+	transformErr error
+}
+
+func (t *transformingTransport) Transform(identifier string) (string, error) {
+	if t.transformErr != nil {
+		return "", t.transformErr
+	}
+	udid, ok := t.udids[identifier]
+	if !ok {
+		return "", fmt.Errorf("unknown identifier %s: %w", identifier, attest.ErrInvalidIdentifier)
+	}
+	return udid, nil
+}
+
+// recordReporter is a transport.Reporter that records the reported Transport names
+type recordReporter struct {
+	names []string
+}
+
+func (r *recordReporter) ReportStatus(status transport.Status, path string) {}
+
+func (r *recordReporter) ReportTransport(name string) {
+	r.names = append(r.names, name)
+}
+
+func TestPlaceContext(t *testing.T) {
+	errFailed := errors.New("failed")
+	stop := func(ctx context.Context, err error) bool { return false }
+
+	tests := []struct {
+		name       string
+		transports []transport.Transport
+		fall       func(ctx context.Context, err error) bool
+		placed     []string
+		reported   []string
+		errs       int
+	}{
+		{"first succeeds",
+			[]transport.Transport{&testTransport{}, &testTransport{}},
+			nil, []string{"serial", ""}, []string{"0"}, 0},
+		{"falls through",
+			[]transport.Transport{&testTransport{err: errFailed}, &testTransport{}},
+			nil, []string{"serial", "serial"}, []string{"0", "1"}, 0},
+		{"skips unknown identifier",
+			[]transport.Transport{&transformingTransport{&testTransport{}, nil, nil}, &transformingTransport{&testTransport{}, map[string]string{"serial": "udid"}, nil}},
+			nil, []string{"", "udid"}, []string{"1"}, 0},
+		{"falls through transform error",
+			[]transport.Transport{&transformingTransport{&testTransport{}, nil, errFailed}, &testTransport{}},
+			nil, []string{"", "serial"}, []string{"1"}, 0},
+		{"all fail",
+			[]transport.Transport{&testTransport{err: errFailed}, &transformingTransport{&testTransport{}, nil, nil}},
+			nil, []string{"serial", ""}, []string{"0"}, 2},
+		{"fallthrough rejected",
+			[]transport.Transport{&testTransport{err: errFailed}, &testTransport{}},
+			stop, []string{"serial", ""}, []string{"0"}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var entries []*Entry
+			for idx, tr := range test.transports {
+				entries = append(entries, &Entry{Name: fmt.Sprint(idx), Transport: tr})
+			}
+			m := New(entries...)
+			m.Fallthrough = test.fall
+
+			r := new(recordReporter)
+			err := m.PlaceContext(transport.WithReporter(context.Background(), r), "token", "serial", "/path")
+
+			if test.errs == 0 && err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if test.errs != 0 {
+				var merr *Error
+				if !errors.As(err, &merr) || len(merr.Errors) != test.errs {
+					t.Fatalf("expected %d errors, got: %v", test.errs, err)
+				}
+			}
+
+			for idx, tr := range test.transports {
+				var placed string
+				switch tr := tr.(type) {
+				case *testTransport:
+					placed = strings.Join(tr.placed, ",")
+				case *transformingTransport:
+					placed = strings.Join(tr.placed, ",")
+				}
+				if placed != test.placed[idx] {
+					t.Errorf("transport %d: expected placements %q, got %q", idx, test.placed[idx], placed)
+				}
+			}
+			if fmt.Sprint(r.names) != fmt.Sprint(test.reported) {
+				t.Errorf("expected reported transports %v, got %v", test.reported, r.names)
+			}
+		})
+	}
+}
+
+func TestPlaceContextNoTransports(t *testing.T) {
+	if err := New().Place("token", "serial", "/path"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTransformContext(t *testing.T) {
+	errFailed := errors.New("failed")
+	known := func() transport.Transport {
+		return &transformingTransport{&testTransport{}, map[string]string{"serial": "udid"}, nil}
+	}
+	unknown := func() transport.Transport { return &transformingTransport{&testTransport{}, nil, nil} }
+	failing := func() transport.Transport { return &transformingTransport{&testTransport{}, nil, errFailed} }
+
+	tests := []struct {
+		name       string
+		transports []transport.Transport
+		identifier string
+		err        error
+	}{
+		{"accepted", []transport.Transport{unknown(), known()}, "udid", nil},
+		{"no transformer", []transport.Transport{unknown(), &testTransport{}}, "serial", nil},
+		{"unknown", []transport.Transport{unknown(), unknown()}, "", attest.ErrInvalidIdentifier},
+		{"failed before accepted", []transport.Transport{failing(), known()}, "udid", nil},
+		{"failed", []transport.Transport{failing(), unknown()}, "", errFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var entries []*Entry
+			for idx, tr := range test.transports {
+				entries = append(entries, &Entry{Name: fmt.Sprint(idx), Transport: tr})
+			}
+
+			identifier, err := New(entries...).TransformContext(context.Background(), "serial")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if identifier != test.identifier {
+				t.Errorf("expected identifier %q, got %q", test.identifier, identifier)
+			}
+		})
+	}
+}
+
+func TestPlaceContextResolved(t *testing.T) {
+	first := &transformingTransport{&testTransport{err: errors.New("failed")}, map[string]string{"serial": "udid0"}, nil}
+	second := &transformingTransport{&testTransport{}, map[string]string{"serial": "udid1"}, nil}
+	tr := New(&Entry{Name: "0", Transport: first}, &Entry{Name: "1", Transport: second})
+
+	identifier, err := tr.TransformContext(context.Background(), "serial")
+	if err != nil {
+		t.Fatalf("could not transform identifier: %v", err)
+	}
+	if identifier != "udid0" {
+		t.Fatalf("expected identifier %q, got %q", "udid0", identifier)
+	}
+
+	// the resolved identifier is placed as is by its Transport, and the client's identifier is transformed for the next
+	if err = tr.PlaceContext(context.Background(), "token", identifier, "/path"); err != nil {
+		t.Fatalf("could not place token: %v", err)
+	}
+	if fmt.Sprint(first.placed) != "[udid0]" {
+		t.Errorf("expected first transport to place udid0, got %v", first.placed)
+	}
+	if fmt.Sprint(second.placed) != "[udid1]" {
+		t.Errorf("expected second transport to place udid1, got %v", second.placed)
+	}
+}
+
+func TestAttestationServiceHandler(t *testing.T) {
+	first := &transformingTransport{&testTransport{err: errors.New("failed")}, map[string]string{"serial": "udid"}, nil}
+	second := &testTransport{}
+	tr := New(&Entry{Name: "first", Transport: first}, &Entry{Name: "second", Transport: second})
+
+	fs := fsmem.New(100, time.Minute)
+	s := attest.New(tsmem.New(100, time.Hour), tr, fs, nil)
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.Handle("/", s.Handler(srv.URL+"/v1"))
+
+	res, err := http.Post(srv.URL+"/v1"+attest.PathPlace, "application/json", strings.NewReader(`{"identifier":"serial"}`))
+	if err != nil {
+		t.Fatalf("could not place: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, res.StatusCode)
+	}
+	resp := new(struct {
+		ID string `json:"id"`
+	})
+	if err = json.NewDecoder(res.Body).Decode(resp); err != nil {
+		t.Fatalf("could not parse response: %v", err)
+	}
+
+	// the first transport fails, so the placement falls through to the second
+	pl := new(attest.Placement)
+	for deadline := time.Now().Add(2 * time.Second); pl.Status != transport.StatusCommandSent && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		res, err := http.Get(srv.URL + "/v1" + attest.PathStatus + resp.ID)
+		if err != nil {
+			t.Fatalf("could not get status: %v", err)
+		}
+		err = json.NewDecoder(res.Body).Decode(pl)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("could not parse status: %v", err)
+		}
+	}
+
+	if pl.Status != transport.StatusCommandSent || pl.Transport != "second" {
+		t.Errorf("expected command sent by second, got: %+v", pl)
+	}
+	if fmt.Sprint(first.placed, second.placed) != "[udid] [serial]" {
+		t.Errorf("expected first to place udid and second to place serial, got %v and %v", first.placed, second.placed)
+	}
+}
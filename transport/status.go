@@ -0,0 +1,55 @@
+package transport
+
+import "context"
+
+// Status is a stage in the lifecycle of a placement
+type Status string
+
+// Placement statuses, in the order they normally occur. StatusExpired and StatusFailed are terminal
+const (
+	// StatusQueued means the placement has been accepted but the Transport hasn't reported any progress
+	StatusQueued Status = "queued"
+	// StatusPkgGenerated means the payload has been generated and stored in a FileStore
+	StatusPkgGenerated Status = "pkg_generated"
+	// StatusCommandSent means the device has been instructed to retrieve the payload
+	StatusCommandSent Status = "command_sent"
+	// StatusDownloaded means the device has retrieved the payload from the FileStore
+	StatusDownloaded Status = "downloaded"
+	// StatusExpired means the payload expired from the FileStore before the device retrieved it
+	StatusExpired Status = "expired"
+	// StatusFailed means the Transport returned an error
+	StatusFailed Status = "failed"
+)
+
+// Reporter receives progress updates from a Transport during a placement
+type Reporter interface {
+	// ReportStatus is called when a placement reaches status. path is the FileStore path of the payload the status refers to, or empty if there isn't one
+	ReportStatus(status Status, path string)
+}
+
+type reporterKey struct{}
+
+// WithReporter returns a copy of ctx that carries r. Transports report progress to r with ReportStatus
+func WithReporter(ctx context.Context, r Reporter) context.Context {
+	return context.WithValue(ctx, reporterKey{}, r)
+}
+
+// ReportStatus reports status to the Reporter carried by ctx, if any. Transports should call ReportStatus as a placement progresses
+func ReportStatus(ctx context.Context, status Status, path string) {
+	if r, ok := ctx.Value(reporterKey{}).(Reporter); ok {
+		r.ReportStatus(status, path)
+	}
+}
+
+// TransportReporter is an optional interface a Reporter can implement to be told which Transport is placing the token, e.g. by a Transport that delegates to other Transports
+type TransportReporter interface {
+	// ReportTransport is called when the Transport named name starts placing the token. Any status reported before belongs to a previous attempt
+	ReportTransport(name string)
+}
+
+// ReportTransport reports that the Transport named name is starting to place the token to the Reporter carried by ctx, if it implements TransportReporter
+func ReportTransport(ctx context.Context, name string) {
+	if r, ok := ctx.Value(reporterKey{}).(TransportReporter); ok {
+		r.ReportTransport(name)
+	}
+}
@@ -1,8 +1,36 @@
 package transport
 
+import "context"
+
 // Transport is an interface for securely transporting and placing a secure token at a specified location on a macOS device.
 // Implementers should take care to make sure the token is never readable by non-root users, both during transport and once written to disk
 type Transport interface {
 	// Place places the token at path on the device identified by identifier
 	Place(token, identifier, path string) error
 }
+
+// ContextTransport is an optional interface a Transport can implement to accept a context.Context.
+// Implementers should stop placing the token and return as soon as possible when ctx is canceled
+type ContextTransport interface {
+	// PlaceContext places the token at path on the device identified by identifier
+	PlaceContext(ctx context.Context, token, identifier, path string) error
+}
+
+type contextTransport struct {
+	Transport
+}
+
+func (t contextTransport) PlaceContext(ctx context.Context, token, identifier, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.Place(token, identifier, path)
+}
+
+// WithContext returns t as a ContextTransport. If t doesn't implement ContextTransport, it is wrapped so that the context is only checked before calling Place
+func WithContext(t Transport) ContextTransport {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct
+	}
+	return contextTransport{t}
+}